@@ -4,23 +4,44 @@ import (
 	"bufio"
 	"bytes"
 	"cmp"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/sys/unix"
 )
 
 var (
 	ErrExitTerminal = errors.New("exit terminal")
+	ErrIsDirectory  = errors.New("is a directory")
+
+	// ErrTransientRead marks a failed key read that is worth retrying,
+	// e.g. one interrupted by a signal
+	ErrTransientRead = errors.New("transient read error")
+
+	// ErrEndOfInput is returned once there are no more keys to read, as
+	// when stdin is redirected from a file that has run out
+	ErrEndOfInput = errors.New("end of input")
+
+	// ErrNoTTY is returned when there is no terminal to edit on, as when
+	// run from cron or a CI job with stdin redirected
+	ErrNoTTY = errors.New("not a terminal")
 )
 
 const (
@@ -31,14 +52,71 @@ const (
 	Ctrl_L    = 12
 	Ctrl_H    = 8
 	Ctrl_F    = 6
+	Ctrl_E    = 5
+	Ctrl_J    = 10
+	Ctrl_B    = 2
+	Ctrl_G    = 7
+	Ctrl_V    = 22
+	Ctrl_W    = 23
+	TAB       = 9
 	Esc       = 27
 	Ctrl_S    = 19
 	SpaceBar  = 32
+	// what terminals send for Ctrl-/
+	Ctrl_Slash = 31
+	Ctrl_N     = 14
+	Ctrl_C     = 3
 
 	// constants
-	KILO_VERSION    = "0.0.1"
-	KILO_TAB_STOP   = 8
-	KILO_QUIT_TIMES = 3
+	KILO_VERSION     = "0.0.1"
+	KILO_TAB_STOP    = 8
+	KILO_QUIT_TIMES  = 3
+	KILO_HISTORY     = 100
+	KILO_CPR_TIMEOUT = time.Second
+
+	// How long the main loop waits for a key before doing background work
+	// such as following a file
+	KILO_IDLE_INTERVAL = 500 * time.Millisecond
+
+	// How many indented lines to look at when guessing a file's indentation
+	KILO_INDENT_SAMPLE = 100
+
+	// How many lines at each end of a file are searched for a modeline
+	KILO_MODELINES = 5
+
+	// The widest tab stop a modeline may ask for
+	KILO_MODELINE_MAX_TAB = 16
+
+	// The fewest columns the file name is squeezed into in the status bar
+	KILO_MIN_NAME = 12
+
+	// The mark set to the cursor's position before a jump, so the jump
+	// command can go back
+	KILO_LAST_MARK = "'"
+
+	// The longest line editorReadRows will read
+	KILO_MAX_LINE = 1 << 30
+
+	// How long a status message stays in the message bar
+	KILO_MESSAGE_TIMEOUT = 5 * time.Second
+
+	// How many bytes a save writes between updates of its progress
+	KILO_SAVE_PROGRESS = 8 << 20
+
+	// The column the guide is drawn at when it is on, counted from 1
+	KILO_GUIDE_COLUMN = 80
+
+	// How long after an Esc the rest of an escape sequence, or the key of
+	// an Alt combination, may take to arrive. Longer than that and the Esc
+	// was pressed on its own
+	KILO_ESC_TIMEOUT = 50 * time.Millisecond
+
+	// The rows at the bottom of the screen taken by the status bar and the
+	// message bar
+	KILO_CHROME_ROWS = 2
+
+	// The layout the date command uses unless .kilorc sets another
+	KILO_DATE_FORMAT = time.DateOnly
 
 	// EDITOR KEYS
 	ARROW_UP = iota + 1_114_112
@@ -50,6 +128,15 @@ const (
 	HOME_KEY
 	END_KEY
 	DEL_KEY
+	SHIFT_ARROW_UP
+	SHIFT_ARROW_DOWN
+	SHIFT_ARROW_LEFT
+	SHIFT_ARROW_RIGHT
+	F1_KEY
+	INS_KEY
+
+	// Alt-x reads as ALT_KEY | 'x', clear of the runes and the keys above
+	ALT_KEY = 1 << 22
 
 	// raw mode options
 	ioctlReadTermios  = unix.TIOCGETA
@@ -59,39 +146,165 @@ const (
 	HL_NORMAL uint8 = 0
 	HL_NUMBER uint8 = 1
 	HL_MATCH  uint8 = 2
+	HL_ERROR  uint8 = 3
+	// control characters, drawn in caret notation with inverted colors
+	HL_CONTROL uint8 = 4
+	// other occurrences of the word under the cursor
+	HL_WORD     uint8 = 5
+	HL_COMMENT  uint8 = 6
+	HL_KEYWORD  uint8 = 7
+	HL_STRING   uint8 = 8
+	HL_VARIABLE uint8 = 9
+	HL_KEY      uint8 = 10
+	// a backslash escape inside a string, like \n or \u00e9
+	HL_STRING_ESCAPE uint8 = 11
 
 	// ANSI Color Codes
-	ColorRed   = 31
-	ColorBlack = 30
-	ColorWhite = 37
-	ColorBlue  = 34
+	ColorRed         = 31
+	ColorBlack       = 30
+	ColorWhite       = 37
+	ColorBlue        = 34
+	ColorMagenta     = 35
+	ColorCyan        = 36
+	ColorGreen       = 32
+	ColorYellow      = 33
+	ColorBrightBlack = 90
+	ColorBrightBlue  = 94
+	ColorBrightCyan  = 96
+
+	ColorBrightMagenta = 95
+
+	// A dark grey background from the 256 color palette, set behind the
+	// cursor line. Only the background changes, so syntax colors still show
+	CursorLineBackground = "\x1b[48;5;236m"
+
+	// A lighter grey for the column of the guide
+	GuideBackground = "\x1b[48;5;238m"
+
+	// A dark red behind the part of a line past maxLineLength
+	OverflowBackground = "\x1b[48;5;52m"
+
+	// The part of the scrollbar standing for the rows on the screen
+	ScrollbarThumb = "\x1b[48;5;245m"
+
+	// Drawn dim over a space of the indentation at each tab stop
+	IndentGuide = "\x1b[2m│\x1b[22m"
+
+	// Drawn dim after a line ending in a newline, and after a last line
+	// that doesn't, with showEOL on
+	EOLMarker       = "¶"
+	NoNewlineMarker = "[no newline]"
 
 	HL_HIGHLIGHT_NUMBERS  = 1 << 0
 	HL_HIGHLIGHT_STRINGS  = 1 << 1
 	HL_HIGHLIGHT_COMMENTS = 1 << 2
+	// $VAR and ${...} references, as in shell scripts
+	HL_HIGHLIGHT_VARIABLES = 1 << 3
+	// the key before the first ": " of a line, as in YAML
+	HL_HIGHLIGHT_KEYS = 1 << 4
+	// the targets of a Makefile rule, colored like keys
+	HL_HIGHLIGHT_TARGETS = 1 << 5
+	// $(VAR), ${VAR} and $@ references, as in Makefiles
+	HL_HIGHLIGHT_MAKE_VARIABLES = 1 << 6
 )
 
 var (
-	lastMatch       = -1
-	direction       = 1
-	savedHLLine     = 0
-	savedHL         = []uint8{}
-	quitkeyPresses  = KILO_QUIT_TIMES
 	C_HL_extension  = []string{".c", ".h", ".cpp"}
 	Go_HL_extension = []string{".go"}
+	Sh_HL_extension = []string{".sh", ".bash", ".bashrc", ".bash_profile", ".profile", ".zshrc"}
+
+	Sh_HL_keywords = []string{
+		"if", "then", "else", "elif", "fi", "for", "in", "do", "done",
+		"while", "until", "case", "esac", "function", "return", "local",
+	}
+
+	YAML_HL_extension = []string{".yml", ".yaml"}
+	YAML_HL_keywords  = []string{"true", "false", "null", "yes", "no", "~"}
+
+	// Makefiles are mostly known by their name rather than an extension
+	Make_HL_extension = []string{".mk", "Makefile", "makefile", "GNUmakefile"}
+
+	Docker_HL_extension = []string{"Dockerfile", "Dockerfile.*", "*.dockerfile", "Containerfile"}
+	Docker_HL_keywords  = []string{
+		"FROM", "AS", "RUN", "CMD", "LABEL", "EXPOSE", "ENV", "ADD", "COPY",
+		"ENTRYPOINT", "VOLUME", "USER", "WORKDIR", "ARG", "ONBUILD",
+		"STOPSIGNAL", "HEALTHCHECK", "SHELL",
+	}
+
+	Python_HL_extension = []string{".py", ".pyw"}
+	Python_HL_keywords  = []string{
+		"False", "None", "True", "and", "as", "assert", "async", "await",
+		"break", "class", "continue", "def", "del", "elif", "else", "except",
+		"finally", "for", "from", "global", "if", "import", "in", "is",
+		"lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try",
+		"while", "with", "yield",
+	}
 
 	// HLDB stands for “highlight database”
 	HL_DB = []editorSyntax{
 		{
-			fileType:  "c",
-			fileMatch: C_HL_extension,
-			flags:     HL_HIGHLIGHT_NUMBERS,
+			fileType:              "c",
+			fileMatch:             C_HL_extension,
+			singleLineComment:     "//",
+			multiLineCommentStart: "/*",
+			multiLineCommentEnd:   "*/",
+			flags:                 HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS,
 		},
 		{
-			fileType:  "go",
-			fileMatch: Go_HL_extension,
-			flags:     HL_HIGHLIGHT_NUMBERS,
+			fileType:              "go",
+			fileMatch:             Go_HL_extension,
+			singleLineComment:     "//",
+			multiLineCommentStart: "/*",
+			multiLineCommentEnd:   "*/",
+			flags:                 HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS,
 		},
+		{
+			fileType:          "sh",
+			fileMatch:         Sh_HL_extension,
+			keywords:          Sh_HL_keywords,
+			singleLineComment: "#",
+			flags:             HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS | HL_HIGHLIGHT_VARIABLES,
+		},
+		{
+			fileType:          "yaml",
+			fileMatch:         YAML_HL_extension,
+			keywords:          YAML_HL_keywords,
+			singleLineComment: "#",
+			flags:             HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS | HL_HIGHLIGHT_KEYS,
+		},
+		{
+			fileType:          "make",
+			fileMatch:         Make_HL_extension,
+			singleLineComment: "#",
+			flags:             HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS | HL_HIGHLIGHT_TARGETS | HL_HIGHLIGHT_MAKE_VARIABLES,
+		},
+		{
+			fileType:          "dockerfile",
+			fileMatch:         Docker_HL_extension,
+			keywords:          Docker_HL_keywords,
+			singleLineComment: "#",
+			flags:             HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS | HL_HIGHLIGHT_VARIABLES,
+		},
+		{
+			fileType:          "python",
+			fileMatch:         Python_HL_extension,
+			keywords:          Python_HL_keywords,
+			singleLineComment: "#",
+			flags:             HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS | HL_HIGHLIGHT_COMMENTS,
+		},
+	}
+
+	// colorSettings names the highlights whose colors .kilorc can set, as
+	// color_<name>
+	colorSettings = map[string]uint8{
+		"number":   HL_NUMBER,
+		"match":    HL_MATCH,
+		"comment":  HL_COMMENT,
+		"keyword":  HL_KEYWORD,
+		"string":   HL_STRING,
+		"escape":   HL_STRING_ESCAPE,
+		"variable": HL_VARIABLE,
+		"key":      HL_KEY,
 	}
 )
 
@@ -108,12 +321,19 @@ type eRow struct {
 	// Set in editorUpdateRow when tabs are processed
 	render string
 
-	// Size of the rendered content
+	// Size of the rendered content in bytes, which is not its width on
+	// screen once it holds wide or multi-byte characters (see runeWidth)
 	// Set in editorUpdateRow after render string is created
 	rsize int
 
 	// syntax highlighting format
 	hl []uint8 // we only need 0 to 255
+
+	// Whether the row starts, and ends, inside a block comment. The start
+	// is what the row was last highlighted with, which an edit above can
+	// leave behind the end of the row above, see editorSyncHighlight
+	hlInComment   bool
+	hlOpenComment bool
 }
 
 type EditorConfig struct {
@@ -129,8 +349,8 @@ type EditorConfig struct {
 	// - Incremented/decremented in editorMoveCursor:
 	// - Decrements when moving left
 	// - Increments when moving right
-	// - Resets to 0 on END_KEY
-	// - Sets to window width-1 on HOME_KEY
+	// - Resets to 0 on HOME_KEY
+	// - Sets to the end of the row on END_KEY
 	cursorX int
 
 	// Current cursor position - vertical (row)
@@ -163,8 +383,11 @@ type EditorConfig struct {
 	// Calculated from cursorX considering tab expansion
 	rowX int
 
-	// Current file being edited or viewed
+	// Current file being edited or viewed, as it was named, and the
+	// absolute path to it which is what is read and written. Set together
+	// by editorSetFileName
 	fileName string
+	filePath string
 
 	// This is for displaying messages to the user, and prompting
 	// the user for input when doing a search, for example
@@ -176,8 +399,206 @@ type EditorConfig struct {
 
 	// Tells us if the file has been modified since it was opened or saved
 	dirty bool
-	
+
+	// Counts changes to the rows, so that work that depends on the text,
+	// like syncing the language server, can tell when there is any to do
+	edits int
+
+	// Rows before hlSynced were brought up to date with the block comments
+	// above them when edits was hlSyncedEdits, see editorSyncHighlight
+	hlSynced      int
+	hlSyncedEdits int
+
+	// Set when the file's last line isn't terminated by a newline, so
+	// saving doesn't add one
+	noFinalNewline bool
+
+	// Saving drops blank lines at the end of the file but one
+	trimBlankLines bool
+
 	syntax *editorSyntax
+
+	// Terminal used for reading keys and drawing the screen. Normally
+	// stdin and stdout, but both point at /dev/tty when writeStdout is set
+	in  *os.File
+	out *os.File
+
+	// Buffers in, so that the bytes of an escape sequence or a paste
+	// aren't lost between key reads
+	reader *bufio.Reader
+
+	// When set, the buffer is written to stdout on quit instead of
+	// being saved to a file, so kilo can sit in the middle of a pipe
+	writeStdout bool
+
+	// Placed between the two halves of a line join (Ctrl-J)
+	joinSeparator string
+
+	// Columns per tab stop, and whether Tab inserts spaces up to the next
+	// stop instead of a tab. Set from .kilorc, then from the file's own
+	// indentation when it is clear enough (see detectIndent)
+	tabWidth int
+	softTabs bool
+
+	// Point out lines whose indentation mixes tabs and spaces, see
+	// mixedIndent. The filetype's section of .kilorc can turn it on or off
+	mixedIndent bool
+
+	// Rows kept visible above and below the cursor while scrolling, like
+	// vim's scrolloff
+	scrollOff int
+
+	// Draw the row the cursor is on with a different background
+	cursorLine bool
+
+	// Color the other occurrences of the word under the cursor
+	wordHighlight bool
+
+	// Home goes to the first non-blank character, then to column 0
+	smartHome bool
+
+	// Leave Ctrl-S and Ctrl-Q to the terminal's XON/XOFF flow control
+	// instead of reading them as keys. Set from .kilorc
+	flowControl bool
+
+	// Show line numbers down the left side. relativeNumbers numbers them
+	// by distance from the cursor instead, see editorLineNumber
+	lineNumbers     bool
+	relativeNumbers bool
+
+	// Give the last column of the text to a scrollbar showing where the
+	// screen is in the file, see editorScrollbarThumb
+	scrollbar bool
+
+	// Mark each level of a line's indentation with a line at its tab stop
+	indentGuides bool
+
+	// Draw a mark after each line for its newline, or a different one for
+	// a last line without one
+	showEOL bool
+
+	// Draw a guide down the screen at guideColumn, counted from 1, like
+	// vim's colorcolumn, to help keep lines short enough
+	guide       bool
+	guideColumn int
+
+	// Lines are drawn with what goes past this many columns on a different
+	// background. 0 turns it off
+	maxLineLength int
+
+	// When the buffer was last saved, and whether the status bar says how
+	// long ago that was. now is the clock, which tests replace
+	lastSavedTime time.Time
+	showSaved     bool
+	now           func() time.Time
+
+	// The time.Format layout the date command inserts the time in
+	dateFormat string
+
+	// Typing replaces the character under the cursor instead of pushing
+	// it along. Insert toggles it
+	overwrite bool
+
+	// Colors set in .kilorc, over those of editorSyntaxToColor. The
+	// filetype's section wins over the global one, see editorResolveColors
+	colors map[uint8]uint8
+
+	// Extra cursors, besides cursorX and cursorY, that typing and deleting
+	// act at too. Any other key drops them, see editorMultiCursorKey
+	cursors []mark
+
+	// Shown in the middle of the screen while the buffer is empty, one
+	// centered line each. Empty hides it, see editorWelcome
+	welcome []string
+
+	// Set by a quoted insert (Ctrl-V), so the next key is inserted as it
+	// is instead of running whatever it is bound to
+	quoteNext bool
+
+	// What the command being run ends with: why it failed, see
+	// editorCommandFailed, or ErrExitTerminal from the quit command
+	commandErr error
+
+	// Positions saved with the mark command, by name. KILO_LAST_MARK is
+	// where the cursor was before the last jump
+	marks map[string]mark
+
+	// Set when the buffer must not be changed or saved, see editorReadOnly
+	readOnly bool
+
+	// Set by -follow, which keeps reading the file as it grows
+	follow *followState
+
+	// Set by -view, which makes kilo a pager: the buffer is read-only and
+	// letters move around instead of typing, see editorViewKey
+	view bool
+
+	// The file as it was on disk when it was last read or written, so
+	// editorCheckDisk can tell when something else changes it
+	disk diskState
+
+	// Set while the window is split into two panes side by side, each with
+	// its own view of the buffer. The fields above (cursorX, rowOff, ...)
+	// belong to the active pane and other holds the one not in use.
+	// splitRight is set when the active pane is the right one
+	split      bool
+	splitRight bool
+	other      view
+
+	// Folded blocks of rows, sorted and not overlapping. The rows stay in
+	// rows, they are only skipped when drawing and moving
+	folds []fold
+
+	// Settings read from ~/.kilorc
+	rc rcConfig
+
+	// Language server for the current file, nil unless one is configured
+	// for its filetype
+	lsp *lspClient
+
+	// Previous prompt inputs, oldest first, keyed by the kind of prompt
+	// ("search", "command", ...)
+	history map[string][]string
+
+	// Set while a selection is being made with Ctrl-B. The selection
+	// runs from the anchor to the cursor, whichever way round they are
+	selecting bool
+	anchorX   int
+	anchorY   int
+
+	// Set when the selection was started with Shift+Arrow, in which case
+	// a plain arrow drops it again
+	shiftSelect bool
+
+	// Keys bound to actions, the defaults plus whatever .kilorc changed
+	keymap map[int]Action
+
+	// How many extra times quit has to be pressed to throw away unsaved
+	// changes, and how many of those are left
+	quitTimes   int
+	quitPresses int
+
+	// Show `Ln, Col` in the status bar rather than just the line
+	showRuler bool
+
+	search searchState
+}
+
+// searchState is what an incremental search remembers between key presses
+type searchState struct {
+	// Row of the current match, -1 before the first one
+	lastMatch int
+
+	// 1 to search forwards, -1 backwards
+	direction int
+
+	// The match is highlighted by overwriting the row's hl, so the
+	// original is kept here to be put back. savedRender is what the row
+	// looked like then: once it is edited its hl is rebuilt without the match,
+	// and the saved copy is no longer any use
+	savedHLLine int
+	savedHL     []uint8
+	savedRender string
 }
 
 type state struct {
@@ -195,9 +616,20 @@ type editorSyntax struct {
 
 	// filematch is an array of strings, where each string contains a pattern
 	// to match a filename against. If the filename matches, then the file will
-	// be recognized as having that filetype.
+	// be recognized as having that filetype. See fileMatches for the kinds
+	// of pattern.
 	fileMatch []string
 
+	// Words colored as keywords wherever they stand alone
+	keywords []string
+
+	// What starts a comment that runs to the end of the line
+	singleLineComment string
+
+	// What starts and ends a comment that can run over several lines
+	multiLineCommentStart string
+	multiLineCommentEnd   string
+
 	// Finally, flags is a bit field that will contain flags for whether
 	// to highlight numbers and whether to highlight strings for that filetype
 	flags int
@@ -205,52 +637,271 @@ type editorSyntax struct {
 
 type callback func(query string, lastKeyPressed int)
 
+// completer returns the possible completions of a prompt's input
+type completer func(input string) []string
+
+type promptOptions struct {
+	// Called after every key press with the input so far
+	callback callback
+
+	// Enables Tab completion when set
+	complete completer
+
+	// Enables Up/Down to recall earlier inputs of this kind when set
+	history string
+}
+
+// rcConfig holds the settings read from a .kilorc file. Keys that come
+// before any [section] header live in the "" section; the rest are grouped
+// under their section, which is usually a filetype such as "go"
+type rcConfig map[string]map[string]string
+
 func main() {
+	os.Exit(run())
+}
+
+// run is the editor, from parsing flags to quitting. It returns the exit
+// status rather than calling os.Exit so that its deferred clean up (the
+// terminal, history, language server) always happens
+func run() int {
 
 	var fileName string
+	var writeStdout bool
+	var quitTimes int
+	var version bool
+	var follow bool
+	var template string
+	var noWelcome bool
+	var view bool
+	var check bool
+	var script string
+	var ttyName string
 	flag.StringVar(&fileName, "filename", "", "enter file to edit")
+	flag.BoolVar(&writeStdout, "write-stdout", false, "write the buffer to stdout on quit instead of saving it")
+	flag.IntVar(&quitTimes, "quit-times", KILO_QUIT_TIMES, "extra quit presses needed to discard unsaved changes")
+	flag.BoolVar(&version, "version", false, "print version information and exit")
+	flag.BoolVar(&follow, "follow", false, "open the file read-only and keep reading what is appended to it, like tail -f")
+	flag.StringVar(&template, "template", "", "start a file that doesn't exist yet with the contents of this one")
+	flag.BoolVar(&noWelcome, "no-welcome", false, "don't show the welcome message on an empty buffer")
+	flag.BoolVar(&view, "view", false, "open the file read-only to page through and search, like less")
+	flag.BoolVar(&check, "check", false, "check that the file opens as text and exit, with status 1 if it doesn't")
+	flag.StringVar(&ttyName, "tty", "", "run on this terminal, such as a pty, instead of stdin and stdout")
+	flag.StringVar(&script, "script", "", "apply the commands in this file to the file without opening the editor, one per line")
 	flag.Parse()
 
-	fd := int(os.Stdin.Fd())
+	if version {
+		printVersion(os.Stdout)
+		return 0
+	}
+
+	// the file can also be given as the first argument, which may carry a
+	// position as in `kilo main.go:42:10`
+	if fileName == "" {
+		fileName = flag.Arg(0)
+	}
+	fileName, line, col := splitLocation(fileName)
+
+	if check {
+		return checkFile(fileName, os.Stderr)
+	}
+	if script != "" {
+		return runScript(fileName, script, os.Stderr)
+	}
+
+	in, out := os.Stdin, os.Stdout
+	controlling := false
+	if writeStdout && ttyName == "" {
+		// stdin and stdout belong to the pipe, so talk to the terminal
+		// directly
+		ttyName = "/dev/tty"
+		controlling = true
+	}
+	if ttyName != "" {
+		tty, err := os.OpenFile(ttyName, os.O_RDWR, 0)
+		if err != nil {
+			if controlling {
+				// there is no controlling terminal to open
+				err = fmt.Errorf("%w: %w", ErrNoTTY, err)
+			}
+			printStartupError(os.Stderr, err)
+			return 1
+		}
+		defer tty.Close()
+		in, out = tty, tty
+	}
+
+	fd := int(in.Fd())
 
 	oldState, err := enableRawMode(fd)
 	if err != nil {
-		log.Fatal(err)
+		printStartupError(os.Stderr, err)
+		return 1
 	}
 	defer restore(fd, oldState)
 
-	config, err := initEditor(fd, oldState)
+	// a panic anywhere below would otherwise leave the shell in raw mode
+	defer recoverPanic(out, os.Stderr, func() { restore(fd, oldState) }, os.Exit)
+
+	config, err := initEditor(in, out, oldState)
 	if err != nil {
-		die(err)
-		return
+		restore(fd, oldState)
+		log.Print(err)
+		return 1
+	}
+	config.writeStdout = writeStdout
+	config.view = view
+	config.readOnly = view
+
+	rcErr := editorLoadRC(config)
+	if rcErr == nil {
+		rcErr = editorBindKeys(config)
+	}
+	if rcErr == nil {
+		rcErr = editorApplySettings(config)
+	}
+	if isFlagSet("quit-times") {
+		editorSetQuitTimes(config, quitTimes)
 	}
+	if noWelcome {
+		config.welcome = nil
+	}
+	if config.flowControl {
+		if err := setFlowControl(fd, true); err != nil {
+			rcErr = errors.Join(rcErr, fmt.Errorf("flow_control: %w", err))
+		}
+	}
+	editorLoadHistory(config)
+	defer editorSaveHistory(config)
+
+	// what opening the file has to say goes over the help
+	editorSetStatusMessage(config, "%s", editorStartupHelp(config))
 
+	var openErr, templateErr error
 	if fileName != "" {
-		err = editorOpen(config, fileName)
+		openErr = editorOpen(config, fileName)
+		if openErr != nil && !errors.Is(openErr, ErrIsDirectory) {
+			die(config, openErr)
+			return 1
+		}
+		if template != "" && openErr == nil {
+			templateErr = editorOpenTemplate(config, template)
+		}
+		editorGoTo(config, line, col)
+		if follow && openErr == nil {
+			editorStartFollow(config)
+		}
+	} else if writeStdout && !isTerminal(int(os.Stdin.Fd())) {
+		err = editorReadRows(config, os.Stdin)
 		if err != nil {
-			die(err)
-			return
+			die(config, err)
+			return 1
 		}
 	}
 
-	editorSetStatusMessage(config, "HELP: Ctrl-S = save | Ctrl-Q = quit | Ctrl-F = find")
+	if rcErr != nil {
+		editorSetStatusMessage(config, "Ignoring .kilorc: %s", rcErr.Error())
+	}
+	if openErr != nil {
+		editorSetStatusMessage(config, "Can't open %s", openErr.Error())
+	}
+	if templateErr != nil {
+		editorSetStatusMessage(config, "Starting empty, can't read the template: %s", templateErr.Error())
+	}
+
+	editorStartLSP(config)
+	if config.lsp != nil {
+		defer config.lsp.stop()
+	}
+
+	if err := editorLoop(config); err != nil {
+		die(config, err)
+		return 1
+	}
+
+	if err := editorExit(config, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "kilo: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
 
+// editorLoop draws the screen and handles keys from the editor's terminal
+// until it is told to quit, or the input ends
+func editorLoop(cfg *EditorConfig) error {
 	for {
-		editorRefreshScreen(config)
-		err = editorProcessKeyPress(config)
-		if errors.Is(err, ErrExitTerminal) {
-			break
+		editorRefreshScreen(cfg)
+
+		// with no key pressed for a while, catch up on whatever else needs
+		// doing and redraw
+		ready, err := editorWaitForKey(cfg, KILO_IDLE_INTERVAL)
+		if err != nil {
+			return err
+		}
+
+		if !ready {
+			editorIdle(cfg)
+			continue
+		}
+
+		err = editorProcessKeyPress(cfg)
+		editorSyncLSP(cfg)
+		if errors.Is(err, ErrExitTerminal) || errors.Is(err, ErrEndOfInput) {
+			return nil
+		}
+
+		if errors.Is(err, ErrTransientRead) {
+			continue
 		}
 
 		if err != nil {
-			die(err)
-			break
+			return err
 		}
 	}
 }
 
+// editorExit takes the editor off the screen after a quit, and with
+// -write-stdout then writes the buffer to stdout. The screen and raw mode
+// have to be gone before anything reaches stdout, otherwise the pipe gets
+// our escape sequences too. A failed write is returned, since the buffer
+// goes nowhere else
+func editorExit(cfg *EditorConfig, stdout io.Writer) error {
+	cleanupScreen(cfg.out)
+	editorRestoreTerminal(cfg)
+	if !cfg.writeStdout {
+		return nil
+	}
+
+	w := bufio.NewWriter(stdout)
+	_, err := writeRows(cfg, cfg.rows, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("writing to stdout: %w", err)
+	}
+
+	return nil
+}
+
+// cleanupScreen clears the screen and shows the cursor, so that the shell
+// gets it back as it was rather than under the last frame
+func cleanupScreen(out io.Writer) {
+	out.Write([]byte("\x1b[2J\x1b[H\x1b[?25h"))
+}
+
 // *** Editor Operations
 
+// editorReadOnly tells the user off and returns true if the buffer can't be
+// changed. Everything that edits the buffer checks it first
+func editorReadOnly(cfg *EditorConfig) bool {
+	if cfg.readOnly {
+		editorCommandFailed(cfg, "Buffer is read-only")
+	}
+
+	return cfg.readOnly
+}
+
 func editorInsertRow(config *EditorConfig, line string, at int) {
 
 	if at < 0 || at > len(config.rows) {
@@ -262,7 +913,8 @@ func editorInsertRow(config *EditorConfig, line string, at int) {
 		chars: line,
 	}
 
-	editorUpdateRow(&row)
+	editorUpdateRow(config, &row)
+	editorShiftRows(config, at, 1)
 
 	config.numRows++
 
@@ -274,7 +926,9 @@ func editorInsertRow(config *EditorConfig, line string, at int) {
 	config.rows = slices.Insert(config.rows, at, row)
 }
 
-func editorUpdateRow(row *eRow) {
+func editorUpdateRow(cfg *EditorConfig, row *eRow) {
+	cfg.edits++
+
 	var b strings.Builder
 
 	tabs := 0
@@ -285,62 +939,88 @@ func editorUpdateRow(row *eRow) {
 		}
 	}
 
-	// add 8 characters per tab
+	// pad each tab out to the next tab stop
 	idx := 0
+	var controls []int
 	for _, r := range row.chars {
 		if r == '\t' {
 			b.WriteString(" ")
 			idx++
-			for idx%KILO_TAB_STOP != 0 {
+			for idx%cfg.tabWidth != 0 {
 				b.WriteString(" ")
 				idx++
 			}
+		} else if r < utf8.RuneSelf && isControl(byte(r)) {
+			// ^A for 1, ^? for 127
+			controls = append(controls, b.Len())
+			b.WriteByte('^')
+			b.WriteByte(byte(r) ^ 0x40)
+			idx += 2
 		} else {
 			b.WriteRune(r)
+			idx += runeWidth(r)
 		}
 	}
 
 	row.render = b.String()
 	row.rsize = len(row.render)
 	row.hl = make([]uint8, row.rsize)
-	editorUpdateSyntax(row)
+	editorUpdateSyntax(cfg, row)
+
+	for _, at := range controls {
+		row.hl[at] = HL_CONTROL
+		row.hl[at+1] = HL_CONTROL
+	}
 }
 
-func editorRowInsertChar(row *eRow, at, key int) {
+func editorRowInsertChar(cfg *EditorConfig, row *eRow, at int, r rune) {
 	if at < 0 || at > row.size {
 		at = row.size
 	}
 
-	row.chars = row.chars[:at] + fmt.Sprintf("%c", rune(key)) + row.chars[at:]
+	row.chars = row.chars[:at] + string(r) + row.chars[at:]
 	row.size = len(row.chars)
-	editorUpdateRow(row)
+	editorUpdateRow(cfg, row)
 }
 
-func editorRowDelChar(row *eRow, at int) {
+// editorRowDelChar deletes the character starting at byte at, all of its
+// bytes if it is a multi-byte one
+func editorRowDelChar(cfg *EditorConfig, row *eRow, at int) {
 	if at < 0 || at >= row.size {
 		return
 	}
 
-	row.chars = row.chars[:at] + row.chars[at+1:row.size]
+	_, size := utf8.DecodeRuneInString(row.chars[at:])
+	row.chars = row.chars[:at] + row.chars[at+size:row.size]
 	row.size = len(row.chars)
-	editorUpdateRow(row)
+	editorUpdateRow(cfg, row)
 }
 
 func editorDelChar(cfg *EditorConfig) {
-	if cfg.cursorY == cfg.numRows {
+	if editorReadOnly(cfg) {
 		return
 	}
 
+	// nothing comes before the start of the file
 	if cfg.cursorX == 0 && cfg.cursorY == 0 {
 		return
 	}
 
+	// the line past the end is empty, so joining it onto the last row
+	// leaves the text as it is and only moves the cursor to the end of it
+	if cfg.cursorY == cfg.numRows {
+		cfg.cursorY--
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+		return
+	}
+
 	cfg.dirty = true
 
 	currentRow := &cfg.rows[cfg.cursorY]
 	if cfg.cursorX > 0 {
-		editorRowDelChar(currentRow, cfg.cursorX-1)
-		cfg.cursorX--
+		_, size := utf8.DecodeLastRuneInString(currentRow.chars[:cfg.cursorX])
+		editorRowDelChar(cfg, currentRow, cfg.cursorX-size)
+		cfg.cursorX -= size
 		return
 	}
 
@@ -351,725 +1031,5567 @@ func editorDelChar(cfg *EditorConfig) {
 	cfg.cursorY--
 }
 
+// editorBackspace deletes the character before the cursor. With soft tabs,
+// in indentation of nothing but spaces, it deletes back to the tab stop
+// before, as if the spaces were the tab they stand for
+func editorBackspace(cfg *EditorConfig) {
+	n := 1
+	if cfg.softTabs && cfg.cursorY < cfg.numRows && cfg.cursorX > 0 &&
+		strings.Trim(cfg.rows[cfg.cursorY].chars[:cfg.cursorX], " ") == "" {
+		n = cfg.cursorX - (cfg.cursorX-1)/cfg.tabWidth*cfg.tabWidth
+	}
+
+	for range n {
+		editorDelChar(cfg)
+	}
+}
+
+// editorShiftRows moves everything that refers to rows by index along with
+// them, when n rows are inserted (or for a negative n, deleted) at row at
+func editorShiftRows(cfg *EditorConfig, at, n int) {
+	editorShiftFolds(cfg, at, n)
+	editorShiftMarks(cfg, at, n)
+	editorShiftSearch(cfg, at, n)
+}
+
 func editorDelRow(cfg *EditorConfig, at int) {
-	if at < 0 || at > cfg.numRows {
+	if at < 0 || at >= cfg.numRows {
 		return
 	}
 
+	editorShiftRows(cfg, at, -1)
 	cfg.rows = append(cfg.rows[:at], cfg.rows[at+1:len(cfg.rows)]...)
 	cfg.numRows--
+	cfg.edits++
 }
 
 func editorRowAppendString(cfg *EditorConfig, row *eRow, text string) {
 	row.chars = row.chars + text
 	row.size = len(row.chars)
-	editorUpdateRow(row)
+	editorUpdateRow(cfg, row)
 	cfg.dirty = true
 }
 
-func editorInsertChar(cfg *EditorConfig, key int) {
+// editorInsertChar inserts r at the cursor and moves past it. cursorX
+// counts bytes, so it moves by as many bytes as r takes in UTF-8
+func editorInsertChar(cfg *EditorConfig, r rune) {
+	if !utf8.ValidRune(r) || editorReadOnly(cfg) {
+		return
+	}
+
+	// on the line past the end, typing starts a new last line
 	if cfg.cursorY == cfg.numRows {
-		if cfg.cursorY == 0 {
-			editorInsertRow(cfg, "", 0)
-		} else {
-			editorInsertRow(cfg, "", cfg.cursorY-1)
-		}
+		editorInsertRow(cfg, "", cfg.numRows)
 	}
-	editorRowInsertChar(&cfg.rows[cfg.cursorY], cfg.cursorX, key)
-	cfg.cursorX++
+	editorRowInsertChar(cfg, &cfg.rows[cfg.cursorY], cfg.cursorX, r)
+	cfg.cursorX += utf8.RuneLen(r)
 	cfg.dirty = true
 }
 
+// editorOverwriteChar types r over the character under the cursor, as in
+// overwrite mode. Past the end of the line it inserts, so the line grows
+func editorOverwriteChar(cfg *EditorConfig, r rune) {
+	if !utf8.ValidRune(r) || editorReadOnly(cfg) {
+		return
+	}
+
+	if cfg.cursorY < cfg.numRows {
+		editorRowDelChar(cfg, &cfg.rows[cfg.cursorY], cfg.cursorX)
+	}
+	editorInsertChar(cfg, r)
+}
+
 func editorInsertNewLine(cfg *EditorConfig) {
-	if cfg.cursorX == 0 {
-		editorInsertRow(cfg, "", cfg.cursorY-1)
+	if editorReadOnly(cfg) {
+		return
+	}
+
+	cfg.dirty = true
+
+	// at the start of a line, and on the line past the end, the new line
+	// goes in above, pushing the cursor's line down with the cursor
+	if cfg.cursorX == 0 || cfg.cursorY == cfg.numRows {
+		editorInsertRow(cfg, "", cfg.cursorY)
+		cfg.cursorX = 0
 		cfg.cursorY++
 		return
 	}
 
-	row := &cfg.rows[cfg.cursorY]
-	editorInsertRow(cfg, row.chars[cfg.cursorX:len(row.chars)], cfg.cursorY+1)
+	editorInsertRow(cfg, cfg.rows[cfg.cursorY].chars[cfg.cursorX:], cfg.cursorY+1)
 
+	// inserting can move the rows, so only take the row afterwards
+	row := &cfg.rows[cfg.cursorY]
 	row.chars = row.chars[:cfg.cursorX]
 	row.size = len(row.chars)
-	editorUpdateRow(row)
+	editorUpdateRow(cfg, row)
 	cfg.cursorX = 0
 	cfg.cursorY++
 }
 
-//*** drawing editor functions
-
-func editorDrawStatusBar(cfg *EditorConfig, buf *bytes.Buffer) {
-	// To make the status bar stand out, we’re going to display it with
-	// inverted colors: black text on a white background. The escape sequence
-	// <esc>[7m switches to inverted colors, and <esc>[m switches back to
-	// normal formatting
-	buf.WriteString("\x1b[7m")
-	status := fmt.Sprintf("%.20s - %d lines", cmp.Or(cfg.fileName, "[No Name]"), cfg.numRows)
-	if cfg.dirty {
-		status = fmt.Sprintf("%s %s", status, "(modified)")
+// editorDeleteLine removes the row under the cursor
+func editorDeleteLine(cfg *EditorConfig) {
+	if editorReadOnly(cfg) {
+		return
 	}
-	buf.WriteString(status)
-	rStatus := fmt.Sprintf("%d/%d", cfg.cursorY+1, cfg.numRows)
-	length := len(status)
 
-	if length > int(cfg.winSize.Col) {
-		length = int(cfg.winSize.Col)
+	if cfg.cursorY >= cfg.numRows {
+		return
 	}
 
-	for length < int(cfg.winSize.Col) {
-		if int(cfg.winSize.Col)-len(rStatus) == length {
-			buf.WriteString(rStatus)
-			break
-		}
-		buf.WriteString(" ")
-		length++
-	}
+	editorDelRow(cfg, cfg.cursorY)
+	cfg.dirty = true
 
-	buf.WriteString("\x1b[m")
-	buf.Write([]byte("\r\n"))
+	if cfg.cursorY == cfg.numRows {
+		cfg.cursorX = 0
+	} else if cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
 }
 
-func editorDrawMessageBar(cfg *EditorConfig, buf *bytes.Buffer) {
-	buf.WriteString("\x1b[K")
-	msgLen := len(cfg.statusMsg)
-	if msgLen > int(cfg.winSize.Col) {
-		msgLen = int(cfg.winSize.Col)
+// editorJoinLines appends the next row to the current one, dropping the
+// next row's indentation, the way vi's J does. The cursor is left where
+// the two lines meet
+func editorJoinLines(cfg *EditorConfig) {
+	if editorReadOnly(cfg) {
+		return
 	}
 
-	if msgLen > 0 && time.Now().Sub(cfg.statusMsgTime) < 5*time.Second {
-		buf.WriteString(cfg.statusMsg)
+	if cfg.cursorY+1 >= cfg.numRows {
+		return
 	}
-}
 
-func editorDrawRows(cfg *EditorConfig, buf *bytes.Buffer) {
-	var y uint16
-	for y = 0; y < cfg.winSize.Row; y++ {
-		fileRow := cfg.rowOff + int(y)
-		if fileRow >= cfg.numRows {
-			if y == cfg.winSize.Row/3 && cfg.numRows == 0 {
-				message := fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)
-				end := uint16(len(message))
+	row := &cfg.rows[cfg.cursorY]
+	next := strings.TrimLeft(cfg.rows[cfg.cursorY+1].chars, " \t")
 
-				// try not to go past the screen
-				if end > cfg.winSize.Col {
-					end = cfg.winSize.Col
-				}
+	separator := cfg.joinSeparator
+	if row.chars == "" || next == "" || strings.HasSuffix(row.chars, " ") || strings.HasSuffix(row.chars, "\t") {
+		separator = ""
+	}
 
-				// center the welcome text
-				padding := (cfg.winSize.Col - end) / 2
-				if padding > 0 {
-					buf.Write([]byte("~"))
-					padding--
-				}
+	joinAt := row.size
+	editorRowAppendString(cfg, row, separator+next)
+	editorDelRow(cfg, cfg.cursorY+1)
+	cfg.cursorX = joinAt
+}
 
-				for padding > 0 {
-					buf.Write([]byte(" "))
-					padding--
-				}
+// *** Selection
 
-				buf.Write([]byte(message[:end]))
+func editorToggleSelection(cfg *EditorConfig) {
+	if cfg.selecting {
+		cfg.selecting = false
+		editorSetStatusMessage(cfg, "Selection cleared")
+		return
+	}
+
+	cfg.selecting = true
+	cfg.shiftSelect = false
+	cfg.anchorX = cfg.cursorX
+	cfg.anchorY = cfg.cursorY
+	editorSetStatusMessage(cfg, "Selecting: move the cursor, Ctrl-B or Esc to stop")
+}
+
+// editorSelection returns the selected region in chars coordinates, ordered
+// so that the start comes first. The end position is exclusive
+func editorSelection(cfg *EditorConfig) (startY, startX, endY, endX int, ok bool) {
+	if !cfg.selecting || cfg.numRows == 0 {
+		return 0, 0, 0, 0, false
+	}
+
+	startY, startX = editorClampPosition(cfg, cfg.anchorY, cfg.anchorX)
+	endY, endX = editorClampPosition(cfg, cfg.cursorY, cfg.cursorX)
+
+	if endY < startY || endY == startY && endX < startX {
+		startY, startX, endY, endX = endY, endX, startY, startX
+	}
+
+	return startY, startX, endY, endX, true
+}
+
+// editorClampPosition pulls a position back onto a real row, since the
+// cursor may sit on the virtual line after the last row and the anchor may
+// have been left behind by an edit
+func editorClampPosition(cfg *EditorConfig, y, x int) (int, int) {
+	if y >= cfg.numRows {
+		y = cfg.numRows - 1
+		x = cfg.rows[y].size
+	}
+
+	if x > cfg.rows[y].size {
+		x = cfg.rows[y].size
+	}
+
+	return y, x
+}
+
+// editorRowSelection returns the selected part of a row in render coordinates
+func editorRowSelection(cfg *EditorConfig, fileRow int) (start, end int, ok bool) {
+	startY, startX, endY, endX, ok := editorSelection(cfg)
+	if !ok || fileRow < startY || fileRow > endY {
+		return 0, 0, false
+	}
+
+	row := cfg.rows[fileRow]
+	start, end = 0, editorCursorXToRowX(cfg, row, row.size)
+	if fileRow == startY {
+		start = editorCursorXToRowX(cfg, row, startX)
+	}
+
+	if fileRow == endY {
+		end = editorCursorXToRowX(cfg, row, endX)
+	}
+
+	return start, end, true
+}
+
+// editorSelectedText returns the selected text, with rows joined by newlines
+func editorSelectedText(cfg *EditorConfig) (string, bool) {
+	startY, startX, endY, endX, ok := editorSelection(cfg)
+	if !ok {
+		return "", false
+	}
+
+	var b strings.Builder
+	for y := startY; y <= endY; y++ {
+		row := cfg.rows[y]
+		from, to := 0, row.size
+		if y == startY {
+			from = startX
+		}
+
+		if y == endY {
+			to = endX
+		}
+
+		if y > startY {
+			b.WriteByte('\n')
+		}
+		b.WriteString(row.chars[from:to])
+	}
+
+	return b.String(), true
+}
+
+// editorWordAt returns the bounds of the word touching position x of the row
+func editorWordAt(row eRow, x int) (start, end int) {
+	start, end = x, x
+	for start > 0 && isWordByte(row.chars[start-1]) {
+		start--
+	}
+
+	for end < row.size && isWordByte(row.chars[end]) {
+		end++
+	}
+
+	return start, end
+}
+
+// editorMapSelection replaces the selected text, or the word under the
+// cursor when nothing is selected, with the result of fn. fn is applied one
+// row at a time
+func editorMapSelection(cfg *EditorConfig, fn func(string) string) {
+	if editorReadOnly(cfg) {
+		return
+	}
+
+	startY, startX, endY, endX, ok := editorSelection(cfg)
+	if !ok {
+		if cfg.cursorY >= cfg.numRows {
+			return
+		}
+
+		startY, endY = cfg.cursorY, cfg.cursorY
+		startX, endX = editorWordAt(cfg.rows[cfg.cursorY], cfg.cursorX)
+		if startX == endX {
+			editorSetStatusMessage(cfg, "No word under the cursor")
+			return
+		}
+	}
+
+	for y := startY; y <= endY; y++ {
+		row := &cfg.rows[y]
+		from, to := 0, row.size
+		if y == startY {
+			from = startX
+		}
+
+		if y == endY {
+			to = endX
+		}
+
+		row.chars = row.chars[:from] + fn(row.chars[from:to]) + row.chars[to:]
+		row.size = len(row.chars)
+		editorUpdateRow(cfg, row)
+	}
+
+	cfg.dirty = true
+
+	if cfg.cursorY < cfg.numRows && cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
+}
+
+// editorReplaceRows swaps rows start through end (inclusive) for lines
+func editorReplaceRows(cfg *EditorConfig, start, end int, lines []string) {
+	for y := end; y >= start; y-- {
+		editorDelRow(cfg, y)
+	}
+
+	for i, line := range lines {
+		editorInsertRow(cfg, strings.TrimRight(line, "\r"), start+i)
+	}
+
+	cfg.dirty = true
+
+	if cfg.cursorY > cfg.numRows {
+		cfg.cursorY = cfg.numRows
+	}
+
+	if cfg.cursorY < cfg.numRows && cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
+}
+
+// *** Folding
+
+// fold hides rows start+1 through end, leaving start on screen with a
+// marker saying how many rows it stands for
+type fold struct {
+	start, end int
+}
+
+// editorFoldAt returns the index in cfg.folds of the fold starting at row y
+func editorFoldAt(cfg *EditorConfig, y int) (int, bool) {
+	for i, f := range cfg.folds {
+		if f.start == y {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// editorHiddenBy returns the fold hiding row y, if it is hidden
+func editorHiddenBy(cfg *EditorConfig, y int) (int, bool) {
+	for i, f := range cfg.folds {
+		if y > f.start && y <= f.end {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// editorStepRows moves n rows on from y (back when n is negative), counting
+// a folded block as one row. It stops at the first row and at the line past
+// the end
+func editorStepRows(cfg *EditorConfig, y, n int) int {
+	for ; n > 0 && y < cfg.numRows; n-- {
+		if i, ok := editorFoldAt(cfg, y); ok {
+			y = cfg.folds[i].end
+		}
+		y++
+	}
+
+	for ; n < 0 && y > 0; n++ {
+		y--
+		if i, ok := editorHiddenBy(cfg, y); ok {
+			y = cfg.folds[i].start
+		}
+	}
+
+	return y
+}
+
+// editorScreenRow returns the line of the screen row y is drawn on, which
+// is fewer than y-rowOff when there are folds in between
+func editorScreenRow(cfg *EditorConfig, y int) int {
+	n := 0
+	for from := cfg.rowOff; from < y; from = editorStepRows(cfg, from, 1) {
+		n++
+	}
+
+	return n
+}
+
+// editorShiftFolds keeps the folds on the same rows when n rows are inserted
+// (or for a negative n, deleted) at row at. A fold whose first row is
+// deleted goes, as does one left with nothing to hide
+func editorShiftFolds(cfg *EditorConfig, at, n int) {
+	folds := cfg.folds[:0]
+	for _, f := range cfg.folds {
+		switch {
+		case f.start > at || (n > 0 && f.start == at):
+			f.start += n
+			f.end += n
+		case f.start == at:
+			continue
+		case f.end >= at:
+			f.end += n
+		}
+
+		if f.end > f.start {
+			folds = append(folds, f)
+		}
+	}
+
+	cfg.folds = folds
+}
+
+// editorIndentWidth is how many columns a row is indented by. Blank rows
+// return -1, since they belong to whatever block they sit in
+func editorIndentWidth(cfg *EditorConfig, row eRow) int {
+	text := strings.TrimLeft(row.chars, " \t")
+	if text == "" {
+		return -1
+	}
+
+	return editorCursorXToRowX(cfg, row, row.size-len(text))
+}
+
+// editorFold folds the indented block under the cursor's row. If the rows
+// after it aren't indented any deeper, the block the cursor is in is folded
+// instead, from the less indented row it hangs off
+func editorFold(cfg *EditorConfig, _ string) {
+	if cfg.cursorY >= cfg.numRows {
+		return
+	}
+
+	header := cfg.cursorY
+	end := editorBlockEnd(cfg, header)
+	if indent := editorIndentWidth(cfg, cfg.rows[header]); end == header && indent > 0 {
+		for y := header - 1; y >= 0; y-- {
+			if w := editorIndentWidth(cfg, cfg.rows[y]); w >= 0 && w < indent {
+				header = y
+				end = editorBlockEnd(cfg, header)
+				break
+			}
+		}
+	}
+
+	if end == header {
+		editorSetStatusMessage(cfg, "Nothing to fold here")
+		return
+	}
+
+	// a fold swallows any folds inside it
+	folds := cfg.folds[:0]
+	for _, f := range cfg.folds {
+		if f.start < header || f.start > end {
+			folds = append(folds, f)
+		}
+	}
+
+	i, _ := slices.BinarySearchFunc(folds, header, func(f fold, y int) int {
+		return f.start - y
+	})
+	cfg.folds = slices.Insert(folds, i, fold{start: header, end: end})
+	cfg.cursorY = header
+	cfg.cursorX = 0
+}
+
+// editorBlockEnd returns the last row indented deeper than row y, not
+// counting blank rows at the end, or y if there are none
+func editorBlockEnd(cfg *EditorConfig, y int) int {
+	indent := editorIndentWidth(cfg, cfg.rows[y])
+	if indent < 0 {
+		return y
+	}
+
+	end := y
+	for next := y + 1; next < cfg.numRows; next++ {
+		w := editorIndentWidth(cfg, cfg.rows[next])
+		if w < 0 {
+			continue
+		}
+
+		if w <= indent {
+			break
+		}
+
+		end = next
+	}
+
+	return end
+}
+
+// editorUnfold opens the fold on the cursor's row, or with the "all"
+// argument every fold
+func editorUnfold(cfg *EditorConfig, args string) {
+	if args == "all" {
+		cfg.folds = nil
+		return
+	}
+
+	i, ok := editorFoldAt(cfg, cfg.cursorY)
+	if !ok {
+		editorSetStatusMessage(cfg, "No fold here")
+		return
+	}
+
+	cfg.folds = slices.Delete(cfg.folds, i, i+1)
+}
+
+// *** Marks
+
+// mark is a saved cursor position
+type mark struct {
+	cursorX, cursorY int
+}
+
+// editorSetMark saves the cursor position under the name given
+func editorSetMark(cfg *EditorConfig, args string) {
+	if args == "" {
+		editorCommandFailed(cfg, "Usage: mark <name>")
+		return
+	}
+
+	cfg.marks[args] = mark{cfg.cursorX, cfg.cursorY}
+	editorSetStatusMessage(cfg, "Marked %s", args)
+}
+
+// editorJumpToMark moves the cursor to a saved mark, or with no name back to
+// where it was before the last jump. Jumping sets that mark too, so two
+// jumps back return to the start
+func editorJumpToMark(cfg *EditorConfig, args string) {
+	name := cmp.Or(args, KILO_LAST_MARK)
+	m, ok := cfg.marks[name]
+	if !ok {
+		editorCommandFailed(cfg, "No mark %s", name)
+		return
+	}
+
+	cfg.marks[KILO_LAST_MARK] = mark{cfg.cursorX, cfg.cursorY}
+	editorJumpTo(cfg, m.cursorY, m.cursorX)
+}
+
+// editorShiftMarks keeps the marks on the same rows when n rows are
+// inserted (or for a negative n, deleted) at row at. Marks on deleted rows
+// go
+func editorShiftMarks(cfg *EditorConfig, at, n int) {
+	for name, m := range cfg.marks {
+		switch {
+		case n < 0 && m.cursorY == at:
+			delete(cfg.marks, name)
+		case m.cursorY >= at:
+			m.cursorY += n
+			cfg.marks[name] = m
+		}
+	}
+}
+
+// *** Multiple cursors
+
+// editorAddCursor adds a cursor in the next occurrence of the word under
+// the cursor, as a whole word and at the same place in it, after the cursor
+// added last. The search wraps around the end of the buffer
+func editorAddCursor(cfg *EditorConfig) {
+	var word string
+	var offset int
+	if cfg.cursorY < cfg.numRows {
+		start, end := editorWordAt(cfg.rows[cfg.cursorY], cfg.cursorX)
+		word, offset = cfg.rows[cfg.cursorY].chars[start:end], cfg.cursorX-start
+	}
+	if word == "" {
+		editorSetStatusMessage(cfg, "No word under the cursor")
+		return
+	}
+
+	last := mark{cfg.cursorX, cfg.cursorY}
+	if len(cfg.cursors) > 0 {
+		last = cfg.cursors[len(cfg.cursors)-1]
+	}
+
+	// the rest of the last cursor's row, the rows after it, the rows
+	// before it and then the start of its own row
+	for n := 0; n <= cfg.numRows; n++ {
+		y := (last.cursorY + n) % cfg.numRows
+		row := cfg.rows[y]
+		from, to := 0, row.size
+		if n == 0 {
+			// an edit may have moved the word under the last cursor
+			from = max(last.cursorX-offset+1, 0)
+		} else if n == cfg.numRows {
+			to = last.cursorX - offset
+		}
+
+		for {
+			start := wordIndex(row.chars, word, from)
+			if start < 0 || start >= to {
+				break
+			}
+			from = start + 1
+
+			at := mark{start + offset, y}
+			if at == (mark{cfg.cursorX, cfg.cursorY}) || slices.Contains(cfg.cursors, at) {
+				continue
+			}
+			cfg.cursors = append(cfg.cursors, at)
+			editorSetStatusMessage(cfg, "%d cursors", len(cfg.cursors)+1)
+			return
+		}
+	}
+
+	editorSetStatusMessage(cfg, "No more %s to add a cursor to", word)
+}
+
+// wordIndex returns where word next appears in s from byte from on as a
+// whole word, or -1
+func wordIndex(s, word string, from int) int {
+	if from < 0 {
+		return -1
+	}
+
+	for from <= len(s) {
+		i := strings.Index(s[from:], word)
+		if i < 0 {
+			return -1
+		}
+
+		start, end := from+i, from+i+len(word)
+		if (start == 0 || !isWordByte(s[start-1])) && (end == len(s) || !isWordByte(s[end])) {
+			return start
+		}
+		from = start + 1
+	}
+
+	return -1
+}
+
+// editorMultiCursorKey types or deletes at every cursor, reporting true,
+// when key does that. Any other key drops the extra cursors, except the one
+// that adds them, and is left to editorProcessKeyPress, reporting false
+func editorMultiCursorKey(cfg *EditorConfig, key int) bool {
+	action, bound := cfg.keymap[key]
+	switch {
+	case key == BACKSPACE || key == Ctrl_H:
+		// deleting stays within each line, a join would move the others
+		editorEachCursor(cfg, func() {
+			if cfg.cursorX > 0 {
+				editorBackspace(cfg)
+			}
+		})
+		return true
+	case key == DEL_KEY:
+		editorEachCursor(cfg, func() {
+			if cfg.cursorY < cfg.numRows && cfg.cursorX < cfg.rows[cfg.cursorY].size {
+				editorMoveCursor(ARROW_RIGHT, cfg)
+				editorDelChar(cfg)
+			}
+		})
+		return true
+	case bound && action == ACTION_ADD_CURSOR:
+		return false
+	case !bound && key <= utf8.MaxRune && !unicode.IsControl(rune(key)):
+		editorEachCursor(cfg, func() {
+			if cfg.overwrite {
+				editorOverwriteChar(cfg, rune(key))
+			} else {
+				editorInsertChar(cfg, rune(key))
+			}
+		})
+		return true
+	}
+
+	cfg.cursors = nil
+	return false
+}
+
+// editorEachCursor runs edit at every cursor, which edit may move along its
+// row but not off it. Cursors are visited from the bottom right up, so an
+// edit never moves a cursor still to be visited; the ones already visited
+// further along the same row are moved by what the edit added or removed
+func editorEachCursor(cfg *EditorConfig, edit func()) {
+	all := append([]mark{{cfg.cursorX, cfg.cursorY}}, cfg.cursors...)
+	order := make([]int, len(all))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Or(cmp.Compare(all[b].cursorY, all[a].cursorY), cmp.Compare(all[b].cursorX, all[a].cursorX))
+	})
+
+	for n, i := range order {
+		at := all[i]
+		if at.cursorY >= cfg.numRows {
+			continue
+		}
+
+		size := cfg.rows[at.cursorY].size
+		cfg.cursorX, cfg.cursorY = at.cursorX, at.cursorY
+		edit()
+		delta := cfg.rows[at.cursorY].size - size
+
+		for _, j := range order[:n] {
+			if all[j].cursorY == at.cursorY && all[j].cursorX >= at.cursorX {
+				all[j].cursorX += delta
+			}
+		}
+		all[i] = mark{cfg.cursorX, cfg.cursorY}
+	}
+
+	cfg.cursorX, cfg.cursorY = all[0].cursorX, all[0].cursorY
+	cfg.cursors = cfg.cursors[:0]
+	for _, m := range all[1:] {
+		if m != all[0] && !slices.Contains(cfg.cursors, m) {
+			cfg.cursors = append(cfg.cursors, m)
+		}
+	}
+}
+
+// editorRowCursors returns the screen columns of the extra cursors on a
+// row, for drawing them
+func editorRowCursors(cfg *EditorConfig, fileRow int) []int {
+	var cols []int
+	for _, m := range cfg.cursors {
+		if m.cursorY == fileRow {
+			cols = append(cols, editorCursorXToRowX(cfg, cfg.rows[fileRow], m.cursorX))
+		}
+	}
+
+	return cols
+}
+
+// *** Split window
+
+// view is the part of EditorConfig that differs between the panes of a
+// split window
+type view struct {
+	cursorX, cursorY int
+	rowX             int
+	rowOff, colOff   int
+}
+
+// editorSplit splits the window in two, both panes starting out on the same
+// place in the buffer, or joins it back up, keeping the active pane
+func editorSplit(cfg *EditorConfig, _ string) {
+	cfg.split = !cfg.split
+	cfg.splitRight = false
+	cfg.other = view{cfg.cursorX, cfg.cursorY, cfg.rowX, cfg.rowOff, cfg.colOff}
+}
+
+// editorOtherPane makes the other pane of a split window the active one
+func editorOtherPane(cfg *EditorConfig) {
+	if !cfg.split {
+		editorSetStatusMessage(cfg, "The window isn't split")
+		return
+	}
+
+	editorSwapView(cfg)
+}
+
+// editorSwapView swaps the active pane's view for the other one. The other
+// pane may have been left beyond the end of the buffer by edits in this one
+func editorSwapView(cfg *EditorConfig) {
+	current := view{cfg.cursorX, cfg.cursorY, cfg.rowX, cfg.rowOff, cfg.colOff}
+	cfg.cursorX, cfg.cursorY = cfg.other.cursorX, cfg.other.cursorY
+	cfg.rowX = cfg.other.rowX
+	cfg.rowOff, cfg.colOff = cfg.other.rowOff, cfg.other.colOff
+	cfg.other = current
+	cfg.splitRight = !cfg.splitRight
+
+	cfg.cursorY = min(cfg.cursorY, cfg.numRows)
+	cfg.rowOff = min(cfg.rowOff, cfg.numRows)
+	if cfg.cursorY < cfg.numRows {
+		cfg.cursorX = min(cfg.cursorX, cfg.rows[cfg.cursorY].size)
+	} else {
+		cfg.cursorX = 0
+	}
+}
+
+// editorPaneWidth is how many columns the left or right pane gets. Without
+// a split there is one pane as wide as the screen
+func editorPaneWidth(cfg *EditorConfig, right bool) int {
+	cols := int(cfg.winSize.Col)
+	if !cfg.split {
+		return cols
+	}
+
+	// one column goes to the line between the panes
+	left := (cols - 1) / 2
+	if right {
+		return cols - 1 - left
+	}
+
+	return left
+}
+
+//*** drawing editor functions
+
+func editorDrawStatusBar(cfg *EditorConfig, buf *bytes.Buffer) {
+	// To make the status bar stand out, we’re going to display it with
+	// inverted colors: black text on a white background. The escape sequence
+	// <esc>[7m switches to inverted colors, and <esc>[m switches back to
+	// normal formatting
+	buf.WriteString("\x1b[7m")
+	status := fmt.Sprintf(" - %d lines", cfg.numRows)
+	if cfg.noFinalNewline {
+		status = fmt.Sprintf("%s %s", status, "[noeol]")
+	}
+	if cfg.dirty {
+		status = fmt.Sprintf("%s %s", status, "(modified)")
+	}
+	if cfg.overwrite {
+		status = fmt.Sprintf("%s %s", status, "[OVR]")
+	}
+	if cfg.view {
+		status = fmt.Sprintf("%s %s", status, "[VIEW]")
+	} else if cfg.readOnly {
+		status = fmt.Sprintf("%s %s", status, "[readonly]")
+	}
+	if cfg.follow != nil {
+		if editorFollowPaused(cfg) {
+			status = fmt.Sprintf("%s %s", status, "[paused]")
+		} else {
+			status = fmt.Sprintf("%s %s", status, "[follow]")
+		}
+	}
+	rStatus := fmt.Sprintf("%d/%d", cfg.cursorY+1, cfg.numRows)
+	if cfg.showRuler {
+		rStatus = editorRuler(cfg)
+	}
+	rStatus = fmt.Sprintf("%s | %s", editorIndentStyle(cfg), rStatus)
+	if cfg.lsp != nil {
+		if errs, warnings := cfg.lsp.summary(); errs+warnings > 0 {
+			rStatus = fmt.Sprintf("E:%d W:%d | %s", errs, warnings, rStatus)
+		}
+	}
+
+	// the file name gets whatever room is left, keeping a space before
+	// rStatus. When the time since the save fits as well, it goes first
+	room := int(cfg.winSize.Col) - len(status) - len(rStatus) - 1
+	if cfg.showSaved && !cfg.lastSavedTime.IsZero() {
+		saved := savedAgo(cfg.now().Sub(cfg.lastSavedTime)) + " | "
+		if room-len(saved) >= KILO_MIN_NAME {
+			rStatus = saved + rStatus
+			room -= len(saved)
+		}
+	}
+	status = fitPath(cmp.Or(cfg.fileName, "[No Name]"), max(room, KILO_MIN_NAME)) + status
+	// the name keeps its room, so on a narrow screen the rest may not fit,
+	// and a line too wide would wrap onto the message bar
+	status = ellipsize(status, int(cfg.winSize.Col))
+	buf.WriteString(status)
+	length := stringWidth(status)
+
+	for length < int(cfg.winSize.Col) {
+		if int(cfg.winSize.Col)-len(rStatus) == length {
+			buf.WriteString(rStatus)
+			break
+		}
+		buf.WriteString(" ")
+		length++
+	}
+
+	buf.WriteString("\x1b[m")
+	buf.Write([]byte("\r\n"))
+}
+
+// savedAgo describes how long ago a save was, roughly, as in `saved 12s ago`
+func savedAgo(elapsed time.Duration) string {
+	switch {
+	case elapsed < time.Second:
+		return "saved just now"
+	case elapsed < time.Minute:
+		return fmt.Sprintf("saved %ds ago", int(elapsed/time.Second))
+	case elapsed < time.Hour:
+		return fmt.Sprintf("saved %dm ago", int(elapsed/time.Minute))
+	default:
+		return fmt.Sprintf("saved %dh ago", int(elapsed/time.Hour))
+	}
+}
+
+// fitPath shortens path to fit in width columns. The file's own name is the
+// last thing to go: first the directories are cut down to the parent, as in
+// `.../parent/name.go`, then to nothing, and only then is the name itself
+// cut short, at a character boundary
+func fitPath(path string, width int) string {
+	if stringWidth(path) <= width {
+		return path
+	}
+
+	name := filepath.Base(path)
+	if parent := filepath.Base(filepath.Dir(path)); parent != "." && parent != string(filepath.Separator) {
+		short := filepath.Join("...", parent, name)
+		if stringWidth(short) <= width {
+			return short
+		}
+	}
+
+	return ellipsize(name, width)
+}
+
+// ellipsize cuts s short at a character boundary to fit in width columns,
+// ending it with an ellipsis to show something is missing
+func ellipsize(s string, width int) string {
+	if stringWidth(s) <= width {
+		return s
+	}
+	if width <= 0 {
+		return ""
+	}
+
+	// leave a column for the ellipsis
+	var b strings.Builder
+	used := 0
+	for _, r := range s {
+		w := runeWidth(r)
+		if used+w > width-1 {
+			break
+		}
+		b.WriteRune(r)
+		used += w
+	}
+
+	return b.String() + "…"
+}
+
+// editorRuler describes the cursor position as `Ln 3/120, Col 9`. Col is the
+// column on screen, so a tab counts for as many columns as it takes up
+func editorRuler(cfg *EditorConfig) string {
+	ruler := fmt.Sprintf("Ln %d/%d, Col %d", cfg.cursorY+1, cfg.numRows, cfg.rowX+1)
+	if text, ok := editorSelectedText(cfg); ok {
+		ruler = fmt.Sprintf("%s (%d selected)", ruler, utf8.RuneCountInString(text))
+	}
+
+	return ruler
+}
+
+func editorDrawMessageBar(cfg *EditorConfig, buf *bytes.Buffer) {
+	buf.WriteString("\x1b[K")
+	width := int(cfg.winSize.Col)
+
+	if cfg.statusMsg != "" && time.Since(cfg.statusMsgTime) < KILO_MESSAGE_TIMEOUT {
+		buf.WriteString(ellipsize(cfg.statusMsg, width))
+		return
+	}
+
+	// with nothing else to say, explain what is wrong with the current line
+	if cfg.lsp != nil {
+		buf.WriteString(ellipsize(cfg.lsp.message(cfg.cursorY), width))
+	}
+}
+
+// editorDrawRows draws the text area: the whole width, or when the window
+// is split the two panes side by side with a line between them
+func editorDrawRows(cfg *EditorConfig, buf *bytes.Buffer) {
+	if !cfg.split {
+		editorDrawPane(cfg, buf, 0, int(cfg.winSize.Col))
+	} else {
+		left := editorPaneWidth(cfg, false)
+
+		// draw the active pane as it is, and the other one by swapping its
+		// view in for a moment. Only the active pane shows the selection
+		// and the extra cursors
+		active, other := 0, left+1
+		if cfg.splitRight {
+			active, other = other, active
+		}
+		editorDrawPane(cfg, buf, active, editorPaneWidth(cfg, cfg.splitRight))
+
+		editorSwapView(cfg)
+		selecting, cursors := cfg.selecting, cfg.cursors
+		cfg.selecting, cfg.cursors = false, nil
+		editorScrollView(cfg)
+		editorDrawPane(cfg, buf, other, editorPaneWidth(cfg, cfg.splitRight))
+		cfg.selecting, cfg.cursors = selecting, cursors
+		editorSwapView(cfg)
+
+		for y := range editorTextRows(cfg) {
+			fmt.Fprintf(buf, "\x1b[%d;%dH│", y+1, left+1)
+		}
+	}
+
+	fmt.Fprintf(buf, "\x1b[%d;1H", editorTextRows(cfg)+1)
+}
+
+// editorDrawPane draws the rows from rowOff on into the columns from left
+// to left+width of the screen
+func editorDrawPane(cfg *EditorConfig, buf *bytes.Buffer, left, width int) {
+	word := editorCursorWord(cfg)
+
+	// the line numbers come out of the pane's width, before the text, and
+	// the scrollbar after it
+	toEdge := left+width >= int(cfg.winSize.Col)
+	gutter := editorGutterWidth(cfg)
+	width = max(width-gutter-editorScrollbarWidth(cfg), 0)
+	thumbStart, thumbEnd := editorScrollbarThumb(cfg)
+	editorSyncHighlight(cfg, editorStepRows(cfg, cfg.rowOff, editorTextRows(cfg)))
+
+	// the column of the text area the guide is in, off it when scrolled away
+	guide := -1
+	if cfg.guide {
+		guide = cfg.guideColumn - 1 - cfg.colOff
+	}
+
+	fileRow := cfg.rowOff
+	for y := 0; y < editorTextRows(cfg); y, fileRow = y+1, editorStepRows(cfg, fileRow, 1) {
+		fmt.Fprintf(buf, "\x1b[%d;%dH", y+1, left+1)
+		if gutter > 0 {
+			buf.WriteString(editorLineNumber(cfg, fileRow, gutter))
+		}
+
+		// how many of the width columns this line has filled
+		used := 0
+		if fileRow >= cfg.numRows {
+			if line := y - editorTextRows(cfg)/3; line >= 0 && line < len(cfg.welcome) && cfg.numRows == 0 {
+				message := cfg.welcome[line]
+
+				// try not to go past the screen
+				end := min(len(message), width)
+
+				// center the welcome text
+				padding := (width - end) / 2
+				if padding > 0 {
+					buf.Write([]byte("~"))
+					padding--
+					used++
+				}
+
+				for padding > 0 {
+					buf.Write([]byte(" "))
+					padding--
+					used++
+				}
+
+				buf.Write([]byte(message[:end]))
+				used += end
+			} else {
+				buf.Write([]byte("~"))
+				used++
+			}
+		} else {
+			row := cfg.rows[fileRow]
+			background := "\x1b[49m"
+			if cfg.cursorLine && fileRow == cfg.cursorY {
+				background = CursorLineBackground
+				buf.WriteString(CursorLineBackground)
+			}
+
+			hl := row.hl
+			currentColor := -1
+			currentBackground := background
+
+			selStart, selEnd, hasSelection := editorRowSelection(cfg, fileRow)
+			inverted := false
+			cursors := editorRowCursors(cfg, fileRow)
+
+			diagStart, diagEnd, hasDiagnostic := editorRowDiagnostic(cfg, fileRow)
+			if !hasDiagnostic {
+				diagStart, diagEnd, hasDiagnostic = editorRecipeIndent(cfg, fileRow)
+			}
+			if !hasDiagnostic {
+				diagStart, diagEnd, hasDiagnostic = editorMixedIndent(cfg, fileRow)
+			}
+
+			words := editorRowWordMatches(cfg, fileRow, word)
+			underlined := false
+
+			// tabs are spaces in render, so the indentation is the spaces
+			// it starts with, and its tab stops are the same columns
+			indent := -1
+			if cfg.indentGuides {
+				indent = len(row.render) - len(strings.TrimLeft(row.render, " "))
+			}
+
+			// i indexes the bytes of render (and hl), col counts screen
+			// columns, which is what colOff and the selection are in
+			col := 0
+			for i, r := range row.render {
+				w := runeWidth(r)
+				col += w
+				if col <= cfg.colOff {
+					continue
+				}
+
+				// we do not want to write past the screen
+				if col > cfg.colOff+width {
+					break
+				}
+
+				// half of a wide character is scrolled off the left edge
+				if col-w < cfg.colOff {
+					buf.WriteString(strings.Repeat(" ", col-cfg.colOff))
+					continue
+				}
+
+				// control characters are inverted already, so inside a
+				// selection they flip back
+				selected := hasSelection && col-w >= selStart && col-w < selEnd
+				selected = selected || slices.Contains(cursors, col-w)
+				control := hl[i] == HL_CONTROL
+				if selected != control != inverted {
+					if !inverted {
+						buf.WriteString("\x1b[7m")
+					} else {
+						buf.WriteString("\x1b[27m")
+					}
+					inverted = !inverted
+				}
+
+				highlight := hl[i]
+				if control {
+					highlight = HL_NORMAL
+				}
+				for _, match := range words {
+					if col-w >= match[0] && col-w < match[1] {
+						highlight = HL_WORD
+					}
+				}
+				diagnosed := hasDiagnostic && col-w >= diagStart && col-w < diagEnd
+				if diagnosed {
+					highlight = HL_ERROR
+				}
+				if diagnosed != underlined {
+					if diagnosed {
+						buf.WriteString("\x1b[4m")
+					} else {
+						buf.WriteString("\x1b[24m")
+					}
+					underlined = diagnosed
+				}
+
+				cellBackground := background
+				if col-w-cfg.colOff == guide {
+					cellBackground = GuideBackground
+				}
+				if cfg.maxLineLength > 0 && col-w >= cfg.maxLineLength {
+					cellBackground = OverflowBackground
+				}
+				if cellBackground != currentBackground {
+					buf.WriteString(cellBackground)
+					currentBackground = cellBackground
+				}
+
+				if i < indent && (col-w)%cfg.tabWidth == 0 {
+					buf.WriteString(IndentGuide)
+				} else if highlight == HL_NORMAL {
+					if currentColor != -1 {
+						buf.WriteString("\x1b[39m")
+						currentColor = -1
+					}
+					buf.WriteRune(r)
+				} else {
+					color := editorSyntaxToColor(cfg, highlight)
+					if currentColor != int(color) {
+						buf.WriteString(fmt.Sprintf("\x1b[%dm", color))
+						currentColor = int(color)
+					}
+					buf.WriteRune(r)
+				}
+			}
+			if currentBackground != background {
+				buf.WriteString(background)
+			}
+			if inverted {
+				buf.WriteString("\x1b[27m")
+			}
+			if underlined {
+				buf.WriteString("\x1b[24m")
+			}
+			buf.WriteString("\x1b[39m")
+
+			used = max(min(col, cfg.colOff+width)-cfg.colOff, 0)
+
+			// a folded block shows as its first row, dimmed marker after
+			if i, ok := editorFoldAt(cfg, fileRow); ok {
+				marker := fmt.Sprintf(" +-- %d lines", cfg.folds[i].end-fileRow)
+				marker = marker[:min(len(marker), width-used)]
+				buf.WriteString("\x1b[2m" + marker + "\x1b[22m")
+				used += len(marker)
+			} else if cfg.showEOL && col >= cfg.colOff && used < width {
+				marker := EOLMarker
+				if fileRow == cfg.numRows-1 && cfg.noFinalNewline {
+					marker = NoNewlineMarker
+				}
+				marker = string([]rune(marker)[:min(utf8.RuneCountInString(marker), width-used)])
+				buf.WriteString("\x1b[2m" + marker + "\x1b[22m")
+				used += utf8.RuneCountInString(marker)
+			}
+
+			// past the end of a short line the guide is a blank cell
+			if guide >= used && guide < width {
+				buf.WriteString(strings.Repeat(" ", guide-used) + GuideBackground + " " + background)
+				used = guide + 1
+			}
+
+			// if length > 0 {
+			// 	buf.WriteString(row.render[cfg.colOff : cfg.colOff+length])
+			// }
+		}
+		// clearing the rest of the line paints it with the current
+		// background, which carries the cursor line to the edge. A pane
+		// with another one to its right has to stop short with spaces
+		if toEdge {
+			buf.Write([]byte("\x1b[K"))
+		} else {
+			buf.WriteString(strings.Repeat(" ", max(width-used, 0)))
+		}
+		if cfg.cursorLine && fileRow == cfg.cursorY {
+			buf.WriteString("\x1b[49m")
+		}
+
+		if cfg.scrollbar {
+			fmt.Fprintf(buf, "\x1b[%d;%dH", y+1, left+gutter+width+1)
+			if y >= thumbStart && y < thumbEnd {
+				buf.WriteString(ScrollbarThumb + " \x1b[49m")
+			} else {
+				buf.WriteString(" ")
+			}
+		}
+	}
+}
+
+// editorTextRows is how many rows of the screen the text gets, after the
+// status and message bars at the bottom. winSize is the whole terminal, so
+// anything else drawn around the text comes out of here too
+func editorTextRows(cfg *EditorConfig) int {
+	return max(int(cfg.winSize.Row)-KILO_CHROME_ROWS, 0)
+}
+
+// editorTextWidth is how many columns of a pane the text gets, after the
+// line numbers and the scrollbar
+func editorTextWidth(cfg *EditorConfig, right bool) int {
+	return editorPaneWidth(cfg, right) - editorGutterWidth(cfg) - editorScrollbarWidth(cfg)
+}
+
+func editorScrollbarWidth(cfg *EditorConfig) int {
+	if !cfg.scrollbar {
+		return 0
+	}
+
+	return 1
+}
+
+// editorScrollbarThumb returns the screen rows, from start up to end, that
+// the scrollbar highlights: where the rows on the screen sit in the whole
+// file, and as much of the scrollbar as they are of the file. Folds aren't
+// counted, so it is only a guide
+func editorScrollbarThumb(cfg *EditorConfig) (start, end int) {
+	height := editorTextRows(cfg)
+	if cfg.numRows <= height {
+		return 0, height
+	}
+
+	// rounding would leave the thumb short of the bottom at the end of the
+	// file, so it is pinned there once the last row is on the screen
+	size := max(height*height/cfg.numRows, 1)
+	start = min(cfg.rowOff*height/cfg.numRows, height-size)
+	if cfg.rowOff+height >= cfg.numRows {
+		start = height - size
+	}
+
+	return start, start + size
+}
+
+// editorGutterWidth is how many columns the line numbers take, including
+// the space after them, or 0 when they are off
+func editorGutterWidth(cfg *EditorConfig) int {
+	if !cfg.lineNumbers && !cfg.relativeNumbers {
+		return 0
+	}
+
+	return len(strconv.Itoa(max(cfg.numRows, 1))) + 1
+}
+
+// editorLineNumber renders the gutter for a row, dimmed and right aligned.
+// With relative numbers, rows are numbered by their distance from the
+// cursor's row, which shows its own number when lineNumbers is on too and
+// 0 otherwise, like vim's relativenumber. Rows past the end get a blank
+func editorLineNumber(cfg *EditorConfig, fileRow, gutter int) string {
+	if fileRow >= cfg.numRows {
+		return strings.Repeat(" ", gutter)
+	}
+
+	n := fileRow + 1
+	if cfg.relativeNumbers && (fileRow != cfg.cursorY || !cfg.lineNumbers) {
+		n = fileRow - cfg.cursorY
+		if n < 0 {
+			n = -n
+		}
+	}
+
+	return fmt.Sprintf("\x1b[2m%*d\x1b[22m ", gutter-1, n)
+}
+
+// editorCursorWord returns the word under the cursor, for highlighting its
+// other occurrences, or "" if there is none or highlighting is off
+func editorCursorWord(cfg *EditorConfig) string {
+	if !cfg.wordHighlight || cfg.cursorY >= cfg.numRows {
+		return ""
+	}
+
+	row := cfg.rows[cfg.cursorY]
+	start, end := editorWordAt(row, cfg.cursorX)
+	return row.chars[start:end]
+}
+
+// editorRowWordMatches returns where word appears in a row as a whole word,
+// in render coordinates. The occurrence under the cursor is left out. Like
+// the selection, these are worked out as the row is drawn rather than kept
+// in hl, so there is nothing to undo when the cursor moves on
+func editorRowWordMatches(cfg *EditorConfig, fileRow int, word string) [][2]int {
+	if word == "" {
+		return nil
+	}
+
+	row := cfg.rows[fileRow]
+	var matches [][2]int
+	for from := 0; ; {
+		i := strings.Index(row.chars[from:], word)
+		if i < 0 {
+			break
+		}
+
+		start := from + i
+		end := start + len(word)
+		from = end
+
+		if start > 0 && isWordByte(row.chars[start-1]) {
+			continue
+		}
+
+		if end < row.size && isWordByte(row.chars[end]) {
+			continue
+		}
+
+		if fileRow == cfg.cursorY && cfg.cursorX >= start && cfg.cursorX <= end {
+			continue
+		}
+
+		matches = append(matches, [2]int{
+			editorCursorXToRowX(cfg, row, start),
+			editorCursorXToRowX(cfg, row, end),
+		})
+	}
+
+	return matches
+}
+
+// editorRowDiagnostic returns the part of a row the language server
+// complained about, in render coordinates
+func editorRowDiagnostic(cfg *EditorConfig, fileRow int) (start, end int, ok bool) {
+	if cfg.lsp == nil {
+		return 0, 0, false
+	}
+
+	row := cfg.rows[fileRow]
+	start, end, ok = cfg.lsp.rowDiagnostic(fileRow, row.chars)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return editorCursorXToRowX(cfg, row, start), editorCursorXToRowX(cfg, row, end), true
+}
+
+// editorMixedIndent returns the screen columns of row fileRow's indentation
+// when it mixes tabs and spaces and the mixed_indent setting is on
+func editorMixedIndent(cfg *EditorConfig, fileRow int) (start, end int, ok bool) {
+	row := cfg.rows[fileRow]
+	if !cfg.mixedIndent || !mixedIndent(row.chars, cfg.tabWidth) {
+		return 0, 0, false
+	}
+
+	indent := len(row.chars) - len(strings.TrimLeft(row.chars, " \t"))
+	return 0, editorCursorXToRowX(cfg, row, indent), true
+}
+
+// mixedIndent reports whether the indentation of line has a space before a
+// tab, or after a tab a tab's width or more of spaces. Fewer spaces after
+// the tabs are left alone, as they line up a comment's * or a continued
+// line rather than indent
+func mixedIndent(line string, tabWidth int) bool {
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	if strings.Contains(indent, " \t") {
+		return true
+	}
+
+	tabs := strings.LastIndexByte(indent, '\t')
+	return tabs >= 0 && len(indent)-tabs-1 >= tabWidth
+}
+
+// editorCheckMixedIndent says in the message bar how many lines mix tabs and
+// spaces in their indentation, when the mixed_indent setting is on and any do.
+// It runs as a file is opened or reloaded, and when its filetype changes
+func editorCheckMixedIndent(cfg *EditorConfig) {
+	if !cfg.mixedIndent {
+		return
+	}
+
+	count, first := 0, -1
+	for y, row := range cfg.rows {
+		if mixedIndent(row.chars, cfg.tabWidth) {
+			count++
+			if first < 0 {
+				first = y
+			}
+		}
+	}
+	if count > 0 {
+		editorSetStatusMessage(cfg, "%d lines mix tabs and spaces in their indentation, the first is line %d", count, first+1)
+	}
+}
+
+// editorRecipeIndent finds a Makefile recipe line indented with spaces
+// instead of a tab, which make rejects, and returns the screen columns its
+// indentation covers. Continuation lines may be indented any way
+func editorRecipeIndent(cfg *EditorConfig, fileRow int) (start, end int, ok bool) {
+	if cfg.syntax == nil || cfg.syntax.fileType != "make" {
+		return 0, 0, false
+	}
+
+	row := cfg.rows[fileRow]
+	indent := len(row.chars) - len(strings.TrimLeft(row.chars, " "))
+	if indent == 0 || indent == row.size {
+		return 0, 0, false
+	}
+	if fileRow > 0 && strings.HasSuffix(cfg.rows[fileRow-1].chars, "\\") {
+		return 0, 0, false
+	}
+
+	// it is a recipe line when the first line above that isn't blank, a
+	// comment or indented itself is a rule
+	for y := fileRow - 1; y >= 0; y-- {
+		chars := cfg.rows[y].chars
+		trimmed := strings.TrimSpace(chars)
+		if trimmed == "" || trimmed[0] == '#' || chars[0] == ' ' || chars[0] == '\t' {
+			continue
+		}
+		if _, ok := targetEnd(chars); !ok {
+			return 0, 0, false
+		}
+		return 0, editorCursorXToRowX(cfg, row, indent), true
+	}
+
+	return 0, 0, false
+}
+
+// *** Editor manage cursor position
+
+// editorCursorXToRowX turns a byte offset into chars into the screen column
+// it is drawn at
+func editorCursorXToRowX(cfg *EditorConfig, row eRow, cursorX int) int {
+	rx := 0
+
+	for _, r := range row.chars[:min(cursorX, row.size)] {
+		rx += editorCharWidth(cfg, r, rx)
+	}
+
+	return rx
+}
+
+func editorRowXToCursorX(cfg *EditorConfig, row eRow, rx int) int {
+	cur_rx := 0
+
+	var cx int
+
+	for cx = 0; cx < row.size; {
+		r, size := utf8.DecodeRuneInString(row.chars[cx:])
+		cur_rx += editorCharWidth(cfg, r, cur_rx)
+
+		if cur_rx > rx {
+			return cx
+		}
+		cx += size
+	}
+
+	return cx
+}
+
+// editorHome moves the cursor to the start of the line. With smartHome it
+// goes to the first non-blank character instead, unless it is there already,
+// so pressing Home again toggles between the two
+func editorHome(cfg *EditorConfig) {
+	if !cfg.smartHome || cfg.cursorY >= cfg.numRows {
+		cfg.cursorX = 0
+		return
+	}
+
+	row := cfg.rows[cfg.cursorY]
+	text := row.size - len(strings.TrimLeft(row.chars, " \t"))
+	if cfg.cursorX == text {
+		cfg.cursorX = 0
+		return
+	}
+
+	cfg.cursorX = text
+}
+
+// editorGoTo puts the cursor on line and col, both counted from 1 and
+// clamped to the buffer. A line of 0 leaves the cursor where it is, and a col
+// of 0 means the start of the line
+func editorGoTo(cfg *EditorConfig, line, col int) {
+	if line < 1 {
+		return
+	}
+
+	editorJumpTo(cfg, min(line-1, max(cfg.numRows-1, 0)), max(col-1, 0))
+}
+
+// editorJumpTo puts the cursor on row y at byte x, clamped to the buffer and
+// to the start of a character. A row that is off the screen is brought to
+// the middle of it, rather than to whichever edge editorScroll would leave
+// it at, so every jump lands the same way. One already on the screen stays
+// where it is
+func editorJumpTo(cfg *EditorConfig, y, x int) {
+	cfg.cursorY = min(max(y, 0), cfg.numRows)
+	cfg.cursorX = 0
+	if cfg.cursorY < cfg.numRows {
+		row := cfg.rows[cfg.cursorY]
+		cfg.cursorX = min(max(x, 0), row.size)
+		for cfg.cursorX > 0 && cfg.cursorX < row.size && !utf8.RuneStart(row.chars[cfg.cursorX]) {
+			cfg.cursorX--
+		}
+	}
+
+	height := editorTextRows(cfg)
+	if cfg.cursorY < cfg.rowOff || editorScreenRow(cfg, cfg.cursorY) >= height {
+		cfg.rowOff = editorStepRows(cfg, cfg.cursorY, -height/2)
+	}
+}
+
+// editorCharWidth is how many columns r takes when drawn at column rx: up to
+// the next tab stop for a tab, two for a control character in caret
+// notation, and otherwise its runeWidth
+func editorCharWidth(cfg *EditorConfig, r rune, rx int) int {
+	switch {
+	case r == '\t':
+		return cfg.tabWidth - rx%cfg.tabWidth
+	case r < utf8.RuneSelf && isControl(byte(r)):
+		return 2
+	default:
+		return runeWidth(r)
+	}
+}
+
+func editorScroll(cfg *EditorConfig) {
+	// a jump (a search, say) into a folded block opens it
+	if i, ok := editorHiddenBy(cfg, cfg.cursorY); ok {
+		cfg.folds = slices.Delete(cfg.folds, i, i+1)
+	}
+
+	editorScrollView(cfg)
+}
+
+// editorScrollView is editorScroll for the pane that isn't active, which
+// leaves the folds alone. Its cursor may be in a block folded from the
+// other pane since, and moves to the block's first row instead
+func editorScrollView(cfg *EditorConfig) {
+	cfg.rowX = 0
+
+	if i, ok := editorHiddenBy(cfg, cfg.cursorY); ok {
+		cfg.cursorY = cfg.folds[i].start
+		cfg.cursorX = 0
+	}
+
+	if i, ok := editorHiddenBy(cfg, cfg.rowOff); ok {
+		cfg.rowOff = cfg.folds[i].start
+	}
+
+	if cfg.cursorY < cfg.numRows {
+		cfg.rowX = editorCursorXToRowX(cfg, cfg.rows[cfg.cursorY], cfg.cursorX)
+	}
+
+	// keep scrollOff rows between the cursor and the edges of the screen,
+	// except where the file itself ends. A margin of more than half the
+	// screen would leave nowhere for the cursor to be. Rows are counted as
+	// they appear on screen, so a folded block is one row
+	margin := max(min(cfg.scrollOff, (editorTextRows(cfg)-1)/2), 0)
+	top := editorStepRows(cfg, cfg.cursorY, -margin)
+	bottom := editorStepRows(cfg, cfg.cursorY, margin)
+
+	if top < cfg.rowOff {
+		cfg.rowOff = top
+	}
+
+	if bottom > editorStepRows(cfg, cfg.rowOff, editorTextRows(cfg)-1) {
+		cfg.rowOff = editorStepRows(cfg, bottom, -(editorTextRows(cfg) - 1))
+	}
+
+	width := editorTextWidth(cfg, cfg.splitRight)
+	if cfg.rowX < cfg.colOff {
+		cfg.colOff = cfg.rowX
+	}
+
+	if cfg.rowX >= cfg.colOff+width {
+		cfg.colOff = cfg.rowX - width + 1
+	}
+}
+
+func editorRefreshScreen(cfg *EditorConfig) {
+	editorScroll(cfg)
+
+	var buf bytes.Buffer
+
+	// hide cursor
+	buf.Write([]byte("\x1b[?25l"))
+	buf.Write([]byte("\x1b[H"))
+
+	editorDrawRows(cfg, &buf)
+	editorDrawStatusBar(cfg, &buf)
+	editorDrawMessageBar(cfg, &buf)
+
+	// move cursor
+	left := editorGutterWidth(cfg)
+	if cfg.split && cfg.splitRight {
+		left += editorPaneWidth(cfg, false) + 1
+	}
+	buf.Write([]byte(fmt.Sprintf("\x1b[%d;%dH", editorScreenRow(cfg, cfg.cursorY)+1, left+(cfg.rowX-cfg.colOff)+1)))
+
+	// show cursor
+	buf.Write([]byte("\x1b[?25h"))
+	cfg.out.Write(buf.Bytes())
+}
+
+// *** process key presses
+func editorProcessKeyPress(cfg *EditorConfig) error {
+	key, err := editorReadKey(cfg)
+	if err != nil {
+		return fmt.Errorf("processing key press: %w", err)
+	}
+
+	// after a quoted insert the key goes into the buffer whatever it is,
+	// as long as it is a character rather than, say, an arrow key
+	if cfg.quoteNext {
+		cfg.quoteNext = false
+		if key <= utf8.MaxRune {
+			editorInsertChar(cfg, rune(key))
+		}
+		cfg.quitPresses = cfg.quitTimes
+		return nil
+	}
+
+	if cfg.view {
+		var handled bool
+		key, handled, err = editorViewKey(cfg, key)
+		if handled {
+			return err
+		}
+	}
+
+	if len(cfg.cursors) > 0 && editorMultiCursorKey(cfg, key) {
+		cfg.quitPresses = cfg.quitTimes
+		return nil
+	}
+
+	if action, ok := cfg.keymap[key]; ok {
+		// a quit, by its key or the quit command, counts towards quitting
+		// and anything else starts the count again
+		presses := cfg.quitPresses
+		err := editorDoAction(cfg, action)
+		if cfg.quitPresses == presses {
+			cfg.quitPresses = cfg.quitTimes
+		}
+		return err
+	}
+
+	switch key {
+	case ARROW_UP, ARROW_DOWN, ARROW_RIGHT, ARROW_LEFT:
+		if cfg.selecting && cfg.shiftSelect {
+			cfg.selecting = false
+		}
+		editorMoveCursor(key, cfg)
+	case SHIFT_ARROW_UP, SHIFT_ARROW_DOWN, SHIFT_ARROW_RIGHT, SHIFT_ARROW_LEFT:
+		if !cfg.selecting {
+			cfg.selecting = true
+			cfg.shiftSelect = true
+			cfg.anchorX = cfg.cursorX
+			cfg.anchorY = cfg.cursorY
+		}
+		editorMoveCursor(unshifted[key], cfg)
+	case PAGE_DOWN, PAGE_UP:
+		{
+			if key == PAGE_UP {
+				cfg.cursorY = cfg.rowOff
+			} else if key == PAGE_DOWN {
+				cfg.cursorY = cfg.rowOff + max(editorTextRows(cfg)-1, 0)
+			}
+
+			if cfg.cursorY >= cfg.numRows {
+				cfg.cursorY = cfg.numRows
+			}
+			i := editorTextRows(cfg)
+			for i != 0 {
+				if key == PAGE_UP {
+					editorMoveCursor(ARROW_UP, cfg)
+				} else {
+					editorMoveCursor(ARROW_DOWN, cfg)
+				}
+				i--
+			}
+		}
+	case HOME_KEY:
+		editorHome(cfg)
+	case END_KEY:
+		if cfg.cursorY < cfg.numRows {
+			cfg.cursorX = cfg.rows[cfg.cursorY].size
+		}
+	case BACKSPACE, Ctrl_H:
+		editorBackspace(cfg)
+	case DEL_KEY:
+		editorMoveCursor(ARROW_RIGHT, cfg)
+		editorDelChar(cfg)
+	case ENTER:
+		editorInsertNewLine(cfg)
+	case TAB:
+		editorInsertTab(cfg)
+	case Esc:
+		cfg.selecting = false
+	case Ctrl_L:
+		break
+	default:
+		// unbound control keys and special keys would only corrupt the
+		// buffer. Ctrl-V still inserts a control character on purpose
+		if key > utf8.MaxRune || unicode.IsControl(rune(key)) {
+			break
+		}
+		if cfg.overwrite {
+			editorOverwriteChar(cfg, rune(key))
+			break
+		}
+		editorInsertChar(cfg, rune(key))
+	}
+
+	cfg.quitPresses = cfg.quitTimes
+	return nil
+}
+
+// editorViewKey handles the keys of a pager in view mode:
+//
+//	q          quit
+//	/          search
+//	:          go to a line
+//	g, G       go to the first or last line
+//	space, b   page down or up (f pages down too)
+//	j, k       move down or up
+//
+// Those that move come back as the key that moves the same way in the
+// editor, for editorProcessKeyPress to carry on with, as do keys that are
+// bound to an action and special keys. Any other key is swallowed, so a
+// stray one can't even complain that the buffer is read-only
+func editorViewKey(cfg *EditorConfig, key int) (int, bool, error) {
+	switch key {
+	case 'q':
+		return key, true, editorDoAction(cfg, ACTION_QUIT)
+	case '/':
+		editorSearch(cfg)
+		return key, true, nil
+	case ':':
+		editorGoToPrompt(cfg)
+		return key, true, nil
+	case 'g':
+		editorGoTo(cfg, 1, 0)
+		return key, true, nil
+	case 'G':
+		editorGoTo(cfg, cfg.numRows, 0)
+		return key, true, nil
+	case ' ', 'f':
+		return PAGE_DOWN, false, nil
+	case 'b':
+		return PAGE_UP, false, nil
+	case 'j':
+		return ARROW_DOWN, false, nil
+	case 'k':
+		return ARROW_UP, false, nil
+	}
+
+	if _, bound := cfg.keymap[key]; bound || key > utf8.MaxRune || key == Esc {
+		return key, false, nil
+	}
+
+	return key, true, nil
+}
+
+// *** Key bindings
+
+// Action is something a key can be bound to, either by default or from the
+// [keys] section of .kilorc:
+//
+//	[keys]
+//	ctrl-d = delete-line
+type Action int
+
+const (
+	ACTION_QUIT Action = iota + 1
+	ACTION_SAVE
+	ACTION_FIND
+	ACTION_COMMAND
+	ACTION_JOIN_LINES
+	ACTION_SELECT
+	ACTION_DELETE_LINE
+	ACTION_STATS
+	ACTION_OTHER_PANE
+	ACTION_QUOTED_INSERT
+	ACTION_HELP
+	ACTION_OVERWRITE
+	ACTION_ADD_CURSOR
+	ACTION_INTERRUPT
+)
+
+var actionNames = map[string]Action{
+	"quit":          ACTION_QUIT,
+	"save":          ACTION_SAVE,
+	"find":          ACTION_FIND,
+	"command":       ACTION_COMMAND,
+	"join-lines":    ACTION_JOIN_LINES,
+	"select":        ACTION_SELECT,
+	"delete-line":   ACTION_DELETE_LINE,
+	"stats":         ACTION_STATS,
+	"other-pane":    ACTION_OTHER_PANE,
+	"quoted-insert": ACTION_QUOTED_INSERT,
+	"help":          ACTION_HELP,
+	"overwrite":     ACTION_OVERWRITE,
+	"add-cursor":    ACTION_ADD_CURSOR,
+	"interrupt":     ACTION_INTERRUPT,
+}
+
+var defaultKeymap = map[int]Action{
+	ExitCode:   ACTION_QUIT,
+	Ctrl_S:     ACTION_SAVE,
+	Ctrl_F:     ACTION_FIND,
+	Ctrl_E:     ACTION_COMMAND,
+	Ctrl_J:     ACTION_JOIN_LINES,
+	Ctrl_B:     ACTION_SELECT,
+	Ctrl_G:     ACTION_STATS,
+	Ctrl_W:     ACTION_OTHER_PANE,
+	Ctrl_V:     ACTION_QUOTED_INSERT,
+	F1_KEY:     ACTION_HELP,
+	Ctrl_Slash: ACTION_HELP,
+	INS_KEY:    ACTION_OVERWRITE,
+	Ctrl_N:     ACTION_ADD_CURSOR,
+	Ctrl_C:     ACTION_INTERRUPT,
+}
+
+// flowControlKeys are the keys the terminal keeps for itself, and kilo
+// never sees, with flow_control on
+var flowControlKeys = []int{Ctrl_S, ExitCode}
+
+// editorActionKey names a key bound to action, as written in .kilorc, or
+// reports false if there is none. With several, the lowest key code wins,
+// so the answer is always the same
+func editorActionKey(cfg *EditorConfig, action Action) (string, bool) {
+	found := -1
+	for key, a := range cfg.keymap {
+		if cfg.flowControl && slices.Contains(flowControlKeys, key) {
+			continue
+		}
+		if a == action && (found == -1 || key < found) {
+			found = key
+		}
+	}
+
+	if found == -1 {
+		return "", false
+	}
+
+	return keyName(found), true
+}
+
+// editorStartupHelp names the keys of the main actions, as they are bound
+func editorStartupHelp(cfg *EditorConfig) string {
+	var keys []string
+	for _, name := range []string{"save", "quit", "find", "command"} {
+		if key, ok := editorActionKey(cfg, actionNames[name]); ok {
+			keys = append(keys, fmt.Sprintf("%s = %s", key, name))
+		}
+	}
+
+	return "HELP: " + strings.Join(keys, " | ")
+}
+
+func editorDoAction(cfg *EditorConfig, action Action) error {
+	switch action {
+	case ACTION_QUIT:
+		return editorQuit(cfg)
+	case ACTION_SAVE:
+		editorSave(cfg)
+	case ACTION_FIND:
+		editorSearch(cfg)
+	case ACTION_COMMAND:
+		return editorCommandPrompt(cfg)
+	case ACTION_JOIN_LINES:
+		editorJoinLines(cfg)
+	case ACTION_SELECT:
+		editorToggleSelection(cfg)
+	case ACTION_DELETE_LINE:
+		editorDeleteLine(cfg)
+	case ACTION_STATS:
+		editorStats(cfg, "")
+	case ACTION_OTHER_PANE:
+		editorOtherPane(cfg)
+	case ACTION_QUOTED_INSERT:
+		cfg.quoteNext = true
+		editorSetStatusMessage(cfg, "Next key is inserted literally")
+	case ACTION_HELP:
+		editorHelp(cfg)
+	case ACTION_OVERWRITE:
+		cfg.overwrite = !cfg.overwrite
+	case ACTION_ADD_CURSOR:
+		editorAddCursor(cfg)
+	case ACTION_INTERRUPT:
+		editorInterrupt(cfg)
+	}
+
+	return nil
+}
+
+// editorQuit ends the editor, unless there are unsaved changes and it hasn't
+// been asked often enough yet
+func editorQuit(cfg *EditorConfig) error {
+	if cfg.dirty && cfg.quitPresses > 0 {
+		// quit can be rebound, or reached another way, as q in -view
+		key, ok := editorActionKey(cfg, ACTION_QUIT)
+		if !ok {
+			key = "quit"
+		}
+		editorSetStatusMessage(cfg, `WARNING!!! File has unsaved changes. Press %s %d more times to quit.`, key, cfg.quitPresses)
+		cfg.quitPresses--
+		return nil
+	}
+
+	return ErrExitTerminal
+}
+
+// editorInterrupt is Ctrl-C, which raw mode delivers as a key rather than a
+// signal. It drops the selection if there is one, and otherwise says how to
+// quit, for those who expect it to, rather than quitting and losing work
+func editorInterrupt(cfg *EditorConfig) {
+	if cfg.selecting {
+		cfg.selecting = false
+		editorSetStatusMessage(cfg, "Selection cleared")
+		return
+	}
+
+	if key, ok := editorActionKey(cfg, ACTION_QUIT); ok {
+		editorSetStatusMessage(cfg, "Use %s to quit", key)
+	}
+}
+
+// actionName is the name action is bound by in .kilorc
+func actionName(action Action) string {
+	for name, a := range actionNames {
+		if a == action {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// editorHelpLines lists the keys as they are bound, then the keys that
+// can't be rebound and the commands of the command prompt
+func editorHelpLines(cfg *EditorConfig) []string {
+	var bound []string
+	for key, action := range cfg.keymap {
+		bound = append(bound, fmt.Sprintf("  %-12s %s", keyName(key), actionName(action)))
+	}
+	slices.Sort(bound)
+
+	lines := append([]string{"Keys", ""}, bound...)
+	lines = append(lines,
+		"  arrows       move the cursor",
+		"  shift-arrows select while moving",
+		"  home, end    go to the start or end of the line",
+		"  pageup/down  move a screen up or down",
+		"  backspace    delete the character before the cursor",
+		"  esc          clear the selection",
+		"",
+	)
+
+	heading := "Commands"
+	if key, ok := editorActionKey(cfg, ACTION_COMMAND); ok {
+		heading = fmt.Sprintf("Commands, run with %s", key)
+	}
+	lines = append(lines, heading, "")
+	for _, name := range slices.Sorted(maps.Keys(editorCommands)) {
+		lines = append(lines, "  "+name)
+	}
+
+	return lines
+}
+
+// editorHelp shows the help over the buffer until Esc or q is pressed. The
+// arrows and Page Up/Down scroll it
+func editorHelp(cfg *EditorConfig) {
+	lines := editorHelpLines(cfg)
+	top := 0
+	for {
+		var buf bytes.Buffer
+		editorDrawHelp(cfg, &buf, lines, top)
+		cfg.out.Write(buf.Bytes())
+
+		key, err := editorReadKey(cfg)
+		if err != nil {
+			if errors.Is(err, ErrTransientRead) {
+				continue
+			}
+			return
+		}
+
+		page := editorTextRows(cfg)
+		switch key {
+		case Esc, 'q':
+			return
+		case ARROW_UP:
+			top--
+		case ARROW_DOWN:
+			top++
+		case PAGE_UP:
+			top -= page
+		case PAGE_DOWN:
+			top += page
+		}
+		top = max(min(top, len(lines)-page), 0)
+	}
+}
+
+// editorDrawHelp draws lines from top on where the buffer usually is, with
+// a status bar telling how to get out
+func editorDrawHelp(cfg *EditorConfig, buf *bytes.Buffer, lines []string, top int) {
+	buf.WriteString("\x1b[?25l\x1b[H")
+
+	width := int(cfg.winSize.Col)
+	for y := range editorTextRows(cfg) {
+		fmt.Fprintf(buf, "\x1b[%d;1H\x1b[K", y+1)
+		if top+y < len(lines) {
+			buf.WriteString(ellipsize(lines[top+y], width))
+		}
+	}
+
+	status := fmt.Sprintf(" Help: lines %d-%d of %d, esc or q to close", top+1, min(top+editorTextRows(cfg), len(lines)), len(lines))
+	status = ellipsize(status, width)
+	fmt.Fprintf(buf, "\x1b[%d;1H\x1b[7m%s%s\x1b[m", editorTextRows(cfg)+1, status, strings.Repeat(" ", width-stringWidth(status)))
+	fmt.Fprintf(buf, "\x1b[%d;1H\x1b[K", editorTextRows(cfg)+2)
+}
+
+// editorBindKeys applies the [keys] section of .kilorc over the default
+// bindings. Bad entries are skipped and reported
+func editorBindKeys(cfg *EditorConfig) error {
+	cfg.keymap = maps.Clone(defaultKeymap)
+
+	var errs []error
+	for name, actionName := range cfg.rc["keys"] {
+		key, ok := parseKeyName(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown key %q", name))
+			continue
+		}
+
+		// none unbinds a key, for the terminal or typing to have it
+		if actionName == "none" {
+			delete(cfg.keymap, key)
+			continue
+		}
+
+		action, ok := actionNames[actionName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown action %q for %s", actionName, name))
+			continue
+		}
+
+		cfg.keymap[key] = action
+	}
+
+	return errors.Join(errs...)
+}
+
+var namedKeys = map[string]int{
+	"up":       ARROW_UP,
+	"down":     ARROW_DOWN,
+	"left":     ARROW_LEFT,
+	"right":    ARROW_RIGHT,
+	"pageup":   PAGE_UP,
+	"pagedown": PAGE_DOWN,
+	"home":     HOME_KEY,
+	"end":      END_KEY,
+	"delete":   DEL_KEY,
+	"tab":      TAB,
+	"enter":    ENTER,
+	"esc":      Esc,
+	"f1":       F1_KEY,
+	"insert":   INS_KEY,
+	"ctrl-/":   Ctrl_Slash,
+}
+
+// parseKeyName understands names like "ctrl-d", "pageup" or a single
+// character. Names are case-insensitive, but a character is taken as it is,
+// so G and g are different keys
+func parseKeyName(name string) (int, bool) {
+	if r, size := utf8.DecodeRuneInString(name); size == len(name) && r != utf8.RuneError {
+		return int(r), true
+	}
+
+	// alt-x and alt-X are different keys too
+	if len(name) > len("alt-") && strings.EqualFold(name[:len("alt-")], "alt-") {
+		r, size := utf8.DecodeRuneInString(name[len("alt-"):])
+		if size == len(name)-len("alt-") && r != utf8.RuneError && !unicode.IsControl(r) {
+			return ALT_KEY | int(r), true
+		}
+		return 0, false
+	}
+
+	name = strings.ToLower(name)
+	if key, ok := namedKeys[name]; ok {
+		return key, true
+	}
+
+	if letter, ok := strings.CutPrefix(name, "ctrl-"); ok {
+		if len(letter) == 1 && letter[0] >= 'a' && letter[0] <= 'z' {
+			return int(letter[0] & 0x1f), true
+		}
+	}
+
+	return 0, false
+}
+
+// keyName is the name parseKeyName understands for key
+func keyName(key int) string {
+	if key&ALT_KEY != 0 {
+		return "alt-" + string(rune(key&^ALT_KEY))
+	}
+
+	for name, k := range namedKeys {
+		if k == key {
+			return name
+		}
+	}
+
+	if key >= 1 && key <= 26 {
+		return "ctrl-" + string(rune('a'+key-1))
+	}
+
+	return string(rune(key))
+}
+
+// editorMoveCursor moves the cursor one step with an arrow key:
+//
+//   - Left at the start of a line wraps to the end of the line above, and
+//     right at the end of a line to the start of the next. Neither moves
+//     at the start or end of the buffer
+//   - Up and down keep the screen column, so the cursor stays in line
+//     across rows indented with tabs or holding wide characters. On a
+//     shorter line it goes to the end
+//   - The cursor may go one line past the last row (cursorY == numRows),
+//     an empty line where typing starts a new row
+func editorMoveCursor(key int, cfg *EditorConfig) {
+	var row eRow
+	if cfg.cursorY < cfg.numRows {
+		row = cfg.rows[cfg.cursorY]
+	}
+
+	// moving between rows steps over folded blocks
+	switch key {
+	case ARROW_UP, ARROW_DOWN:
+		rx := editorCursorXToRowX(cfg, row, cfg.cursorX)
+		if key == ARROW_UP {
+			cfg.cursorY = editorStepRows(cfg, cfg.cursorY, -1)
+		} else {
+			cfg.cursorY = editorStepRows(cfg, cfg.cursorY, 1)
+		}
+		if cfg.cursorY < cfg.numRows {
+			cfg.cursorX = editorRowXToCursorX(cfg, cfg.rows[cfg.cursorY], rx)
+		}
+
+	// cursorX is a byte offset, so step over whole characters
+	case ARROW_LEFT:
+		if cfg.cursorX > 0 {
+			_, size := utf8.DecodeLastRuneInString(row.chars[:cfg.cursorX])
+			cfg.cursorX -= size
+		} else if cfg.cursorY > 0 {
+			cfg.cursorY = editorStepRows(cfg, cfg.cursorY, -1)
+			cfg.cursorX = cfg.rows[cfg.cursorY].size
+		}
+
+	case ARROW_RIGHT:
+		if cfg.cursorX < row.size {
+			_, size := utf8.DecodeRuneInString(row.chars[cfg.cursorX:])
+			cfg.cursorX += size
+		} else if row.size == cfg.cursorX && cfg.cursorY != cfg.numRows {
+			cfg.cursorY = editorStepRows(cfg, cfg.cursorY, 1)
+			cfg.cursorX = 0
+		}
+	}
+
+	// row could have changed here, arrow left and arrow right
+	// could have altered the row. The line past the end is empty
+	row = eRow{}
+	if cfg.cursorY < cfg.numRows {
+		row = cfg.rows[cfg.cursorY]
+	}
+
+	if cfg.cursorX > row.size {
+		cfg.cursorX = row.size
+	}
+}
+
+// editorWaitForKey waits up to timeout for a key, without reading it. Bytes
+// already buffered count as a key, as select can't see them
+func editorWaitForKey(cfg *EditorConfig, timeout time.Duration) (bool, error) {
+	if cfg.reader.Buffered() > 0 {
+		return true, nil
+	}
+
+	ready, err := waitForInput(int(cfg.in.Fd()), timeout)
+	if err != nil {
+		return false, fmt.Errorf("waiting for a key: %w", err)
+	}
+
+	return ready, nil
+}
+
+// editorIdle runs when no key has been pressed for KILO_IDLE_INTERVAL
+func editorIdle(cfg *EditorConfig) {
+	if cfg.follow != nil {
+		editorFollow(cfg)
+	} else {
+		editorCheckDisk(cfg)
+	}
+}
+
+// editorReadKey returns the next key pressed. Escape sequences come back as
+// one of the editor key constants (ARROW_UP, ...), which all lie beyond the
+// last valid rune, and anything else as the rune typed, decoded from as many
+// bytes as it takes. Bytes that aren't valid UTF-8 read as
+// utf8.RuneError, one at a time
+func editorReadKey(cfg *EditorConfig) (int, error) {
+	r, _, err := cfg.reader.ReadRune()
+	if errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN) {
+		return 0, fmt.Errorf("reading key: %w: %w", ErrTransientRead, err)
+	}
+
+	if err == io.EOF {
+		return 0, fmt.Errorf("reading key: %w", ErrEndOfInput)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("reading key: %w", err)
+	}
+
+	if r != Esc {
+		return int(r), nil
+	}
+
+	// a bare Esc and the start of a sequence look the same, except that
+	// a terminal sends the rest of a sequence straight away
+	if cfg.reader.Buffered() == 0 {
+		if ready, err := waitForInput(int(cfg.in.Fd()), KILO_ESC_TIMEOUT); err != nil || !ready {
+			return Esc, nil
+		}
+	}
+
+	return editorDecodeEscape(cfg.reader), nil
+}
+
+// editorDecodeEscape decodes the escape sequence following an Esc that has
+// just been read. An Esc followed by a printable character is that
+// character with Alt, which terminals send as an Esc first. Sequences it
+// doesn't know come back as a plain Esc
+func editorDecodeEscape(reader *bufio.Reader) int {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return Esc
+	}
+
+	switch b {
+	case '[':
+		return editorDecodeCSI(reader)
+	case 'O':
+		// SS3 sequences, sent by terminals in application cursor mode
+		b, err = reader.ReadByte()
+		if err != nil {
+			return Esc
+		}
+
+		switch b {
+		case 'A':
+			return ARROW_UP
+		case 'B':
+			return ARROW_DOWN
+		case 'C':
+			return ARROW_RIGHT
+		case 'D':
+			return ARROW_LEFT
+		case 'H':
+			return HOME_KEY
+		case 'F':
+			return END_KEY
+		case 'P':
+			return F1_KEY
+		}
+		return Esc
+	default:
+		reader.UnreadByte()
+		r, _, err := reader.ReadRune()
+		if err == nil && r != utf8.RuneError && !unicode.IsControl(r) {
+			return ALT_KEY | int(r)
+		}
+
+		// not a sequence after all, so leave the byte for the next read
+		if err == nil {
+			reader.UnreadRune()
+		}
+		return Esc
+	}
+}
+
+// editorDecodeCSI decodes a control sequence, `\x1b[` followed by numeric
+// parameters and a final byte, e.g. `\x1b[A` or `\x1b[5~`
+func editorDecodeCSI(reader *bufio.Reader) int {
+	var params []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return Esc
+		}
+
+		// final bytes are in the range @ to ~
+		if b >= 0x40 && b <= 0x7e {
+			return csiKey(string(params), b)
+		}
+
+		params = append(params, b)
+		if len(params) > 16 {
+			return Esc
+		}
+	}
+}
+
+func csiKey(params string, final byte) int {
+	// `\x1b[1;2A` is Shift+Up and so on
+	if _, modifier, _ := strings.Cut(params, ";"); modifier == "2" {
+		switch final {
+		case 'A':
+			return SHIFT_ARROW_UP
+		case 'B':
+			return SHIFT_ARROW_DOWN
+		case 'C':
+			return SHIFT_ARROW_RIGHT
+		case 'D':
+			return SHIFT_ARROW_LEFT
+		}
+	}
+
+	switch final {
+	case 'A':
+		return ARROW_UP
+	case 'B':
+		return ARROW_DOWN
+	case 'C':
+		return ARROW_RIGHT
+	case 'D':
+		return ARROW_LEFT
+	case 'H':
+		return HOME_KEY
+	case 'F':
+		return END_KEY
+	case '~':
+		// anything after a ; is a modifier, as in `\x1b[5;5~` for
+		// Ctrl-PageUp
+		number, _, _ := strings.Cut(params, ";")
+		if key, ok := tildeKeys[number]; ok {
+			return key
+		}
+	}
+
+	return Esc
+}
+
+// unshifted maps a Shift+Arrow key to the plain arrow
+var unshifted = map[int]int{
+	SHIFT_ARROW_UP:    ARROW_UP,
+	SHIFT_ARROW_DOWN:  ARROW_DOWN,
+	SHIFT_ARROW_LEFT:  ARROW_LEFT,
+	SHIFT_ARROW_RIGHT: ARROW_RIGHT,
+}
+
+// tildeKeys maps the number in a `\x1b[<n>~` sequence to a key. Terminals
+// disagree on Home and End: xterm, screen, tmux and the Linux console send
+// 1 and 4, while rxvt sends 7 and 8
+var tildeKeys = map[string]int{
+	"1": HOME_KEY,
+	"2": INS_KEY,
+	"3": DEL_KEY,
+	"4": END_KEY,
+	"5": PAGE_UP,
+	"6": PAGE_DOWN,
+	"7": HOME_KEY,
+	"8": END_KEY,
+	// rxvt and the Linux console send their own sequence for F1
+	"11": F1_KEY,
+}
+
+//*** Editor Setup
+
+func initEditor(in, out *os.File, oldState *State) (*EditorConfig, error) {
+	winSize, err := getWindowSize(in, out)
+	if err != nil {
+		return nil, fmt.Errorf("getting window size: %w", err)
+	}
+
+	config := newEditor()
+	config.origTermios = oldState
+	config.winSize = winSize
+	config.in = in
+	config.out = out
+	config.reader = bufio.NewReader(in)
+
+	return config, nil
+}
+
+// newEditor returns an editor with the default settings and no terminal
+func newEditor() *EditorConfig {
+	return &EditorConfig{
+		history:     map[string][]string{},
+		marks:       map[string]mark{},
+		keymap:      maps.Clone(defaultKeymap),
+		quitTimes:   KILO_QUIT_TIMES,
+		quitPresses: KILO_QUIT_TIMES,
+		showRuler:   true,
+		tabWidth:    KILO_TAB_STOP,
+		guideColumn: KILO_GUIDE_COLUMN,
+		welcome:     []string{kiloBanner()},
+		now:         time.Now,
+		dateFormat:  KILO_DATE_FORMAT,
+
+		joinSeparator: " ",
+		wordHighlight: true,
+	}
+}
+
+func getCursorPosition(in, out *os.File) (rows, cols int, err error) {
+	buf := make([]byte, 1)
+	// The n command (Device Status Report) can be used to query the
+	// terminal for status information. We want to give it an argument
+	// of 6 to ask for the cursor position.
+	out.Write([]byte("\x1b[6n"))
+	var s bytes.Buffer
+	var b byte
+
+	// Then we can read the reply from the standard input.
+	// expected structure: `\x1b[24;80R`
+	// A terminal that doesn't understand the request never answers, so
+	// give up after a while instead of hanging
+	deadline := time.Now().Add(KILO_CPR_TIMEOUT)
+	for b != 'R' && s.Len() < 32 {
+		ready, err := waitForInput(int(in.Fd()), time.Until(deadline))
+		if err != nil {
+			return 0, 0, fmt.Errorf("waiting for cursor position: %w", err)
+		}
+
+		if !ready {
+			return 0, 0, errors.New("terminal did not report the cursor position")
+		}
+
+		if _, err := in.Read(buf); err != nil {
+			return 0, 0, fmt.Errorf("reading cursor position: %w", err)
+		}
+
+		b = buf[0]
+		s.WriteByte(b)
+	}
+
+	return parseCursorPosition(s.String())
+}
+
+// parseCursorPosition parses a cursor position report such as `\x1b[24;80R`.
+// The leading escape and the trailing R are optional, since either may have
+// been consumed by someone else
+func parseCursorPosition(response string) (rows, cols int, err error) {
+	report := strings.TrimPrefix(response, "\x1b")
+	report = strings.TrimPrefix(report, "[")
+	report = strings.TrimSuffix(report, "R")
+
+	r, c, ok := strings.Cut(report, ";")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed cursor position report %q", response)
+	}
+
+	rows, err = strconv.Atoi(r)
+	if err != nil || rows <= 0 {
+		return 0, 0, fmt.Errorf("malformed cursor position report %q", response)
+	}
+
+	cols, err = strconv.Atoi(c)
+	if err != nil || cols <= 0 {
+		return 0, 0, fmt.Errorf("malformed cursor position report %q", response)
+	}
+
+	return rows, cols, nil
+}
+
+// waitForInput reports whether fd has something to read within timeout
+func waitForInput(fd int, timeout time.Duration) (bool, error) {
+	for {
+		var fds unix.FdSet
+		fds.Set(fd)
+		tv := unix.NsecToTimeval(max(timeout, 0).Nanoseconds())
+
+		n, err := unix.Select(fd+1, &fds, nil, nil, &tv)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return n > 0, nil
+	}
+}
+
+func getWindowSize(in, out *os.File) (*unix.Winsize, error) {
+	size, err := unix.IoctlGetWinsize(int(in.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		// we are using the C [Cursor Forward] and B [Cursor Down]
+		// commands
+		out.Write([]byte("\x1b[999C\x1b[999B"))
+		rows, cols, err := getCursorPosition(in, out)
+		if err != nil {
+			// nothing left to ask, so assume the classic terminal size
+			rows, cols = 24, 80
+		}
+		size = &unix.Winsize{
+			Row: uint16(rows),
+			Col: uint16(cols),
+		}
+		return size, nil
+
+	}
+	return size, nil
+}
+
+func enableRawMode(fd int) (*State, error) {
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if errors.Is(err, unix.ENOTTY) {
+		return nil, fmt.Errorf("%w: %w", ErrNoTTY, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	oldState := State{state{termios: *termios}}
+
+	// This attempts to replicate the behaviour documented for cfmakeraw in
+	// the termios(3) manpage.
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, termios); err != nil {
+		return nil, err
+	}
+
+	return &oldState, nil
+}
+
+// setFlowControl turns the terminal's XON/XOFF flow control, which raw mode
+// turns off, back on or off again
+func setFlowControl(fd int, on bool) error {
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return err
+	}
+
+	if on {
+		termios.Iflag |= unix.IXON
+	} else {
+		termios.Iflag &^= unix.IXON
+	}
+
+	return unix.IoctlSetTermios(fd, ioctlWriteTermios, termios)
+}
+
+func restore(fd int, state *State) error {
+	return unix.IoctlSetTermios(fd, ioctlWriteTermios, &state.termios)
+}
+
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	return err == nil
+}
+
+func editorSetStatusMessage(cfg *EditorConfig, format string, args ...any) {
+	cfg.statusMsg = fmt.Sprintf(format, args...)
+	cfg.statusMsgTime = time.Now()
+}
+
+// *** Configuration
+
+// editorLoadRC reads ~/.kilorc, and then the project's .kilorc over it,
+// into the editor. Missing files are not an error
+func editorLoadRC(cfg *EditorConfig) error {
+	home, _ := os.UserHomeDir()
+	dir, _ := os.Getwd()
+
+	rc, err := loadRCFiles(home, dir)
+	cfg.rc = rc
+
+	return err
+}
+
+// rcCommandKeys are the settings that run a program. A project's .kilorc
+// only gets to set them when the user trusts the project, or else opening
+// a file in a freshly cloned repository could run anything
+var rcCommandKeys = []string{"format", "lsp"}
+
+// loadRCFiles reads the user's .kilorc in home, then the .kilorc of the
+// project dir is in, see findProjectRC, whose settings win. Flags are
+// applied after, and win over both. Setting project_rc to false in the
+// user's file leaves the project's alone, and the project's commands are
+// ignored unless it is under one of the user's trusted_projects. An empty
+// home or dir is skipped
+func loadRCFiles(home, dir string) (rcConfig, error) {
+	rc := rcConfig{}
+	if home != "" {
+		user, err := loadRC(filepath.Join(home, ".kilorc"))
+		if err != nil {
+			return rcConfig{}, err
+		}
+		rc = user
+	}
+
+	useProject := true
+	if err := rc.getBool("", "project_rc", &useProject); err != nil || !useProject || dir == "" {
+		return rc, err
+	}
+
+	path := findProjectRC(dir, home)
+	if path == "" {
+		return rc, nil
+	}
+	project, err := loadRC(path)
+	if err != nil {
+		return rcConfig{}, err
+	}
+	trusted := isTrustedProject(filepath.Dir(path), home, rc.get("", "trusted_projects"))
+	for section, settings := range project {
+		for key, value := range settings {
+			if !trusted && slices.Contains(rcCommandKeys, key) {
+				continue
+			}
+			rc.set(section, key, value)
+		}
+	}
+
+	return rc, nil
+}
+
+// findProjectRC returns the path of the first .kilorc going up from dir, or
+// "" if there is none before the project's root, the directory with .git
+// in it. home ends the search too, since its .kilorc is the user's own.
+// Outside home a project needs its .git, so that a .kilorc dropped in a
+// shared directory like /tmp isn't picked up by everything below it, and
+// files owned by someone else are never read
+func findProjectRC(dir, home string) string {
+	var found string
+	for {
+		if dir == home {
+			return found
+		}
+
+		path := filepath.Join(dir, ".kilorc")
+		if found == "" && ownedByUser(path) {
+			found = path
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return found
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// ownedByUser reports whether path exists and belongs to whoever is running
+// the editor
+func ownedByUser(path string) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false
+	}
+
+	return int(st.Uid) == os.Getuid()
+}
+
+// isTrustedProject reports whether dir is, or is inside, one of the
+// comma-separated directories in trusted. A leading ~ stands for home
+func isTrustedProject(dir, home, trusted string) bool {
+	for _, t := range strings.Split(trusted, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(t, "~"); ok && home != "" {
+			t = home + rest
+		}
+
+		rel, err := filepath.Rel(filepath.Clean(t), dir)
+		if err == nil && filepath.IsAbs(t) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func loadRC(path string) (rcConfig, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rcConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer file.Close()
+
+	rc, err := parseRC(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return rc, nil
+}
+
+// parseRC reads `key = value` lines, grouped by `[section]` headers. Blank
+// lines and lines starting with # are skipped
+func parseRC(r io.Reader) (rcConfig, error) {
+	rc := rcConfig{}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+
+		rc.set(section, strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	return rc, nil
+}
+
+// editorApplySettings applies the global settings of .kilorc
+func editorApplySettings(cfg *EditorConfig) error {
+	quitTimes := cfg.quitTimes
+	tabWidth, softTabs := cfg.tabWidth, cfg.softTabs
+	err := errors.Join(
+		cfg.rc.getInt("", "quit_times", &quitTimes),
+		cfg.rc.getInt("", "scroll_off", &cfg.scrollOff),
+		cfg.rc.getBool("", "ruler", &cfg.showRuler),
+		cfg.rc.getBool("", "cursor_line", &cfg.cursorLine),
+		cfg.rc.getBool("", "word_highlight", &cfg.wordHighlight),
+		cfg.rc.getBool("", "smart_home", &cfg.smartHome),
+		cfg.rc.getBool("", "flow_control", &cfg.flowControl),
+		cfg.rc.getBool("", "line_numbers", &cfg.lineNumbers),
+		cfg.rc.getBool("", "relative_numbers", &cfg.relativeNumbers),
+		cfg.rc.getBool("", "guide", &cfg.guide),
+		cfg.rc.getBool("", "scrollbar", &cfg.scrollbar),
+		cfg.rc.getBool("", "indent_guides", &cfg.indentGuides),
+		cfg.rc.getBool("", "show_eol", &cfg.showEOL),
+		cfg.rc.getBool("", "mixed_indent", &cfg.mixedIndent),
+		cfg.rc.getInt("", "guide_column", &cfg.guideColumn),
+		cfg.rc.getInt("", "max_line_length", &cfg.maxLineLength),
+		cfg.rc.getBool("", "show_saved", &cfg.showSaved),
+		cfg.rc.getBool("", "trim_blank_lines", &cfg.trimBlankLines),
+		cfg.rc.getInt("", "tab_width", &tabWidth),
+		cfg.rc.getBool("", "soft_tabs", &softTabs),
+	)
+	editorSetQuitTimes(cfg, quitTimes)
+	editorSetIndent(cfg, tabWidth, softTabs)
+	if separator, ok := cfg.rc[""]["join_separator"]; ok {
+		// values lose their surrounding spaces, so quotes keep them, as
+		// in ", "
+		if unquoted, err := strconv.Unquote(separator); err == nil {
+			separator = unquoted
+		}
+		cfg.joinSeparator = separator
+	}
+	if layout, ok := cfg.rc[""]["date_format"]; ok && layout != "" {
+		cfg.dateFormat = layout
+	}
+	if welcome, ok := cfg.rc[""]["welcome"]; ok {
+		cfg.welcome = editorWelcome(cfg, welcome)
+	}
+
+	return errors.Join(err, editorCheckFlowControl(cfg), editorResolveColors(cfg))
+}
+
+// editorCheckFlowControl turns flow_control back off unless save and quit
+// are bound to keys the terminal leaves alone, since they couldn't be
+// reached otherwise
+func editorCheckFlowControl(cfg *EditorConfig) error {
+	if !cfg.flowControl {
+		return nil
+	}
+
+	for _, action := range []Action{ACTION_SAVE, ACTION_QUIT} {
+		if _, ok := editorActionKey(cfg, action); !ok {
+			cfg.flowControl = false
+			return fmt.Errorf("flow_control: bind %s to a key other than ctrl-s and ctrl-q first", actionName(action))
+		}
+	}
+
+	return nil
+}
+
+// editorApplyFileTypeSettings applies the section of .kilorc named after
+// the buffer's filetype over the global settings: tab_width, soft_tabs and
+// color_<name>. A file that is clearly indented one way keeps it, as it
+// does over the global settings
+func editorApplyFileTypeSettings(cfg *EditorConfig) error {
+	// mixed_indent isn't carried over from the last filetype, but starts
+	// again from the global setting
+	mixedIndent := false
+	globalErr := cfg.rc.getBool("", "mixed_indent", &mixedIndent)
+	cfg.mixedIndent = mixedIndent
+	if cfg.syntax == nil {
+		return errors.Join(globalErr, editorResolveColors(cfg))
+	}
+
+	section := cfg.syntax.fileType
+	tabWidth, softTabs := cfg.tabWidth, cfg.softTabs
+	err := errors.Join(
+		globalErr,
+		cfg.rc.getInt(section, "tab_width", &tabWidth),
+		cfg.rc.getBool(section, "soft_tabs", &softTabs),
+		cfg.rc.getBool(section, "mixed_indent", &cfg.mixedIndent),
+		editorResolveColors(cfg),
+	)
+	if detectedSoftTabs, width, ok := detectIndent(cfg.rows); ok {
+		tabWidth, softTabs = cmp.Or(width, tabWidth), detectedSoftTabs
+	}
+	editorSetIndent(cfg, tabWidth, softTabs)
+
+	return err
+}
+
+// editorResolveColors works out cfg.colors from the color_<name> settings,
+// global and then the filetype's, which take ANSI foreground codes
+func editorResolveColors(cfg *EditorConfig) error {
+	sections := []string{""}
+	if cfg.syntax != nil {
+		sections = append(sections, cfg.syntax.fileType)
+	}
+
+	var errs []error
+	cfg.colors = nil
+	for _, section := range sections {
+		for key, value := range cfg.rc[section] {
+			name, ok := strings.CutPrefix(key, "color_")
+			if !ok {
+				continue
+			}
+
+			hl, known := colorSettings[name]
+			color, err := strconv.Atoi(value)
+			switch {
+			case !known:
+				errs = append(errs, fmt.Errorf("%s: unknown highlight %q", key, name))
+			case err != nil || !(color >= 30 && color <= 37 || color >= 90 && color <= 97):
+				errs = append(errs, fmt.Errorf("%s: expected a color from 30 to 37 or 90 to 97, got %q", key, value))
+			default:
+				if cfg.colors == nil {
+					cfg.colors = map[uint8]uint8{}
+				}
+				cfg.colors[hl] = uint8(color)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// kiloBanner is the welcome message unless .kilorc says otherwise
+func kiloBanner() string {
+	return fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)
+}
+
+// editorWelcome turns the welcome setting into the lines to show: true for
+// the banner, false for nothing, keys for the banner and the keys of the
+// main actions, as they are bound, or else a message of its own, which
+// quotes can keep spaces around
+func editorWelcome(cfg *EditorConfig, setting string) []string {
+	switch setting {
+	case "true":
+		return []string{kiloBanner()}
+	case "false":
+		return nil
+	case "keys":
+		lines := []string{kiloBanner(), ""}
+		for _, name := range []string{"save", "quit", "find", "command"} {
+			if key, ok := editorActionKey(cfg, actionNames[name]); ok {
+				lines = append(lines, fmt.Sprintf("%-8s %-8s", key, name))
+			}
+		}
+		return lines
+	}
+
+	if unquoted, err := strconv.Unquote(setting); err == nil {
+		setting = unquoted
+	}
+
+	return []string{setting}
+}
+
+func editorSetQuitTimes(cfg *EditorConfig, times int) {
+	cfg.quitTimes = max(times, 0)
+	cfg.quitPresses = cfg.quitTimes
+}
+
+// splitLocation splits a trailing `:line` or `:line:col`, as printed by grep
+// -n and compilers, off a file name. A file whose name really ends like that
+// is left alone, as is anything that isn't a positive number
+func splitLocation(arg string) (fileName string, line, col int) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, 0, 0
+	}
+
+	fileName, last, ok := cutLastNumber(arg)
+	if !ok {
+		return arg, 0, 0
+	}
+
+	// such a file can still be given a line
+	if _, err := os.Stat(fileName); err == nil {
+		return fileName, last, 0
+	}
+
+	if name, first, ok := cutLastNumber(fileName); ok {
+		return name, first, last
+	}
+
+	return fileName, last, 0
+}
+
+// cutLastNumber cuts a `:N` suffix off s
+func cutLastNumber(s string) (before string, n int, ok bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return s, 0, false
+	}
+
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil || n < 1 {
+		return s, 0, false
+	}
+
+	return s[:i], n, true
+}
+
+// checkFile opens fileName as the editor would, but without a terminal, and
+// writes to w what would stop it being edited as text: not being there or
+// readable, holding NUL bytes, as binary files do, or not being valid UTF-8.
+// It returns the exit status for -check
+func checkFile(fileName string, w io.Writer) int {
+	if fileName == "" {
+		fmt.Fprintln(w, "kilo: -check needs a file")
+		return 2
+	}
+
+	// editorOpen takes a missing file for a new one
+	if _, err := os.Stat(fileName); err != nil {
+		fmt.Fprintf(w, "kilo: %v\n", err)
+		return 1
+	}
+
+	cfg := newEditor()
+	if err := editorOpen(cfg, fileName); err != nil {
+		fmt.Fprintf(w, "kilo: %v\n", err)
+		return 1
+	}
+
+	for y, row := range cfg.rows {
+		if strings.IndexByte(row.chars, 0) >= 0 {
+			fmt.Fprintf(w, "%s:%d: binary file, has a NUL byte\n", fileName, y+1)
+			return 1
+		}
+		if !utf8.ValidString(row.chars) {
+			fmt.Fprintf(w, "%s:%d: not valid UTF-8\n", fileName, y+1)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// printStartupError says why the editor couldn't start. Without a terminal
+// it points at what can still be done without one
+func printStartupError(w io.Writer, err error) {
+	fmt.Fprintf(w, "kilo: %v\n", err)
+	if errors.Is(err, ErrNoTTY) {
+		fmt.Fprintln(w, "kilo: editing needs a terminal; -check, -script and -version work without one, and -tty edits on another terminal")
+	}
+}
+
+// runScript edits fileName without a terminal, the way ed and sed do, with
+// the commands in scriptName. Each line is what the Ctrl-E prompt takes, and
+// may start with a colon as in vim. Blank lines and ones starting with # are
+// skipped, and q ends the script early, wq after saving. The message each
+// command leaves is written to w with its line number, and a command that
+// fails or changes left unsaved make the exit status 1
+func runScript(fileName, scriptName string, w io.Writer) int {
+	script, err := os.ReadFile(scriptName)
+	if err != nil {
+		fmt.Fprintf(w, "kilo: %v\n", err)
+		return 2
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(w, "kilo: %v\n", err)
+		return 2
+	}
+	defer devNull.Close()
+
+	// a screen nobody sees, and no keys, so a command that prompts for
+	// something gives up as if Esc was pressed
+	cfg := newEditor()
+	cfg.winSize = &unix.Winsize{Row: 24, Col: 80}
+	cfg.in, cfg.out = devNull, devNull
+	cfg.reader = bufio.NewReader(devNull)
+	if fileName != "" {
+		if err := editorOpen(cfg, fileName); err != nil {
+			fmt.Fprintf(w, "kilo: %v\n", err)
+			return 1
+		}
+	}
+
+	status := 0
+	for i, line := range strings.Split(string(script), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), ":")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line == "q" {
+			break
+		}
+		quit := line == "wq"
+		if quit {
+			line = "write"
+		}
+
+		cfg.statusMsg = ""
+		err := editorRunCommand(cfg, line)
+		if cfg.statusMsg != "" {
+			fmt.Fprintf(w, "%s:%d: %s\n", scriptName, i+1, cfg.statusMsg)
+		}
+		if err != nil && !errors.Is(err, ErrExitTerminal) {
+			status = 1
+		}
+		if errors.Is(err, ErrExitTerminal) || quit {
+			break
+		}
+	}
+
+	if cfg.dirty {
+		fmt.Fprintf(w, "kilo: %s: changes not written\n", scriptName)
+		status = 1
+	}
+
+	return status
+}
+
+// printVersion writes the kilo version, the Go version it was built with,
+// and the commit it was built from when the build recorded one
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "kilo %s\n", KILO_VERSION)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	fmt.Fprintf(w, "go: %s\n", info.GoVersion)
+
+	settings := map[string]string{}
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+
+	if revision := settings["vcs.revision"]; revision != "" {
+		if settings["vcs.modified"] == "true" {
+			revision += " (modified)"
+		}
+		fmt.Fprintf(w, "revision: %s\n", revision)
+	}
+}
+
+// isFlagSet reports whether a flag was given on the command line, so that it
+// can win over .kilorc only when it was
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func (rc rcConfig) set(section, key, value string) {
+	if rc[section] == nil {
+		rc[section] = map[string]string{}
+	}
+	rc[section][key] = value
+}
+
+func (rc rcConfig) get(section, key string) string {
+	return rc[section][key]
+}
+
+// getBool stores a true/false setting in value, leaving value alone when the
+// setting is missing or malformed
+func (rc rcConfig) getBool(section, key string, value *bool) error {
+	setting := rc.get(section, key)
+	if setting == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(setting)
+	if err != nil {
+		return fmt.Errorf("%s: expected true or false, got %q", key, setting)
+	}
+
+	*value = b
+	return nil
+}
+
+// getInt is getBool for settings that take a non-negative number
+func (rc rcConfig) getInt(section, key string, value *int) error {
+	setting := rc.get(section, key)
+	if setting == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(setting)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s: expected a number, got %q", key, setting)
+	}
+
+	*value = n
+	return nil
+}
+
+// historyPath is where prompt history is kept between sessions, if
+// `persist_history = true` is set in .kilorc
+func historyPath(cfg *EditorConfig) string {
+	if cfg.rc.get("", "persist_history") != "true" {
+		return ""
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".kilo_history")
+}
+
+// editorLoadHistory reads the history file, where every line is the prompt
+// kind and the input separated by a tab
+func editorLoadHistory(cfg *EditorConfig) {
+	path := historyPath(cfg)
+	if path == "" {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kind, input, ok := strings.Cut(scanner.Text(), "\t")
+		if ok {
+			editorAddHistory(cfg, kind, input)
+		}
+	}
+}
+
+func editorSaveHistory(cfg *EditorConfig) {
+	path := historyPath(cfg)
+	if path == "" {
+		return
+	}
+
+	var buf bytes.Buffer
+	for kind, history := range cfg.history {
+		for _, input := range history {
+			fmt.Fprintf(&buf, "%s\t%s\n", kind, input)
+		}
+	}
+
+	os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// *** Utils
+func isControl(b byte) bool {
+	return b >= 0 && (b < 32 || b == 127)
+}
+
+// wideRunes are the ranges of characters terminals draw two columns wide:
+// the East Asian wide and fullwidth blocks, and most emoji
+var wideRunes = [][2]rune{
+	{0x1100, 0x115F},
+	{0x2329, 0x232A},
+	{0x2E80, 0x303E},
+	{0x3040, 0xA4CF},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE10, 0xFE19},
+	{0xFE30, 0xFE6F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F},
+	{0x1F680, 0x1F6FF},
+	{0x1F900, 0x1F9FF},
+	{0x1FA70, 0x1FAFF},
+	{0x20000, 0x2FFFD},
+	{0x30000, 0x3FFFD},
+}
+
+// stringWidth is how many columns s takes on screen
+func stringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+
+	return width
+}
+
+// runeWidth is how many columns r takes on screen. Combining marks and
+// other invisible characters take none, since they draw over the character
+// before them
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	for _, span := range wideRunes {
+		if r < span[0] {
+			break
+		}
+
+		if r <= span[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// die clears the screen, takes the terminal out of raw mode and only then
+// reports err on stderr. The caller is expected to exit with a failure
+// status straight after, as run does
+func die(cfg *EditorConfig, err error) {
+	reportFailure(cfg.out, os.Stderr, func() { editorRestoreTerminal(cfg) }, "kilo: %v\n", err)
+}
+
+// recoverPanic, deferred, catches a panic and reports it, see reportPanic,
+// then exits with status 2. exit is os.Exit, but for tests
+func recoverPanic(out, stderr io.Writer, undoRaw func(), exit func(int)) {
+	if r := recover(); r != nil {
+		reportPanic(r, out, stderr, undoRaw)
+		exit(2)
+	}
+}
+
+// reportPanic is die for a panic r, reported with the stack
+func reportPanic(r any, out, stderr io.Writer, undoRaw func()) {
+	reportFailure(out, stderr, undoRaw, "kilo: panic: %v\n%s", r, debug.Stack())
+}
+
+// reportFailure clears the screen and puts the terminal back with undoRaw
+// before writing the message to stderr, so that it is neither wiped by a
+// redraw nor mangled by raw output
+func reportFailure(out, stderr io.Writer, undoRaw func(), format string, args ...any) {
+	cleanupScreen(out)
+	undoRaw()
+	fmt.Fprintf(stderr, format, args...)
+}
+
+// editorRestoreTerminal puts the terminal back the way it was before raw
+// mode. Doing it more than once is harmless
+func editorRestoreTerminal(cfg *EditorConfig) error {
+	return restore(int(cfg.in.Fd()), cfg.origTermios)
+}
+
+// isWordByte reports whether b can be part of a word. Bytes of multi-byte
+// UTF-8 sequences count as word bytes so that words are never split
+// inside a rune
+func isWordByte(b byte) bool {
+	return b >= utf8.RuneSelf || b == '_' || unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b))
+}
+
+func isSeparator(c int32) int32 {
+	separators := ",.()+-/*=~%<>[];"
+	if c == SpaceBar || strings.Contains(separators, fmt.Sprintf("%c", c)) {
+		return c
+	}
+	return 0
+}
+
+// *** file i/o
+
+// editorOpen loads fileName into the buffer. A file that doesn't exist yet
+// gives an empty buffer with that name, so saving creates it
+func editorOpen(config *EditorConfig, fileName string) error {
+	info, err := os.Stat(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		editorSetFileName(config, fileName)
+		editorSelectSyntaxHighlight(config)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("opening file %s: %w", fileName, err)
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s: %w", fileName, ErrIsDirectory)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("opening file %s: %w", fileName, err)
+	}
+	defer file.Close()
+
+	if err := editorReadRows(config, file); err != nil {
+		return err
+	}
+
+	editorSetFileName(config, fileName)
+	editorSelectSyntaxHighlight(config)
+	editorApplyModeline(config)
+	editorCheckMixedIndent(config)
+	config.disk = diskStateOf(info)
+
+	return nil
+}
+
+// editorSetFileName names the file the buffer belongs to. The name is kept
+// as given, for showing, and the absolute path for everything that touches
+// the file, so it still finds it if the working directory changes
+func editorSetFileName(cfg *EditorConfig, fileName string) {
+	cfg.fileName = fileName
+	cfg.filePath = fileName
+	if path, err := filepath.Abs(fileName); err == nil {
+		cfg.filePath = path
+	}
+}
+
+// editorOpenTemplate fills the buffer of a file that doesn't exist yet with
+// the contents of template. The buffer is left dirty, as saving is what
+// creates the file. A file that exists is left as it is
+func editorOpenTemplate(cfg *EditorConfig, template string) error {
+	if _, err := os.Stat(cfg.filePath); !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	file, err := os.Open(template)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := editorReadRows(cfg, file); err != nil {
+		return fmt.Errorf("%s: %w", template, err)
+	}
+	cfg.dirty = cfg.numRows > 0
+
+	return nil
+}
+
+// editorReadRows appends every line read from r to the buffer
+func editorReadRows(config *EditorConfig, r io.Reader) error {
+	tail := &lastByteReader{r: r}
+	scanner := bufio.NewScanner(tail)
+	// lines can be far longer than the scanner's default limit of 64KB,
+	// in minified files for example
+	scanner.Buffer(nil, KILO_MAX_LINE)
+	for scanner.Scan() {
+		// the scanner already drops the \r of a \r\n. Any other \r is part
+		// of the line, and shows as ^M
+		editorInsertRow(config, scanner.Text(), config.numRows)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+
+	// the scanner reads "a\nb" and "a\nb\n" as the same two lines, so
+	// remember which one it was to write it back the same way
+	config.noFinalNewline = tail.read && tail.last != '\n'
+
+	if softTabs, width, ok := detectIndent(config.rows); ok {
+		editorSetIndent(config, cmp.Or(width, config.tabWidth), softTabs)
+	}
+
+	return nil
+}
+
+// lastByteReader remembers the last byte that passed through it
+type lastByteReader struct {
+	r    io.Reader
+	last byte
+	read bool
+}
+
+func (l *lastByteReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.last = p[n-1]
+		l.read = true
+	}
+	return n, err
+}
+
+func editorRowsToString(cfg *EditorConfig) string {
+	var b strings.Builder
+	writeRows(cfg, cfg.rows, &b)
+
+	return b.String()
+}
+
+// writeRows writes rows of the buffer to w a row at a time, so it is never
+// held in memory twice, and returns how many bytes it wrote
+func writeRows(cfg *EditorConfig, rows []eRow, w io.Writer) (int, error) {
+	written := 0
+	for i, row := range rows {
+		n, err := io.WriteString(w, row.chars)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if i < len(rows)-1 || !cfg.noFinalNewline {
+			n, err = io.WriteString(w, "\n")
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// progressWriter calls report with the total written so far every time
+// another step bytes have gone through it
+type progressWriter struct {
+	w       io.Writer
+	written int
+	step    int
+	report  func(written int)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if (p.written+n)/p.step > p.written/p.step {
+		p.report(p.written + n)
+	}
+	p.written += n
+
+	return n, err
+}
+
+// diskState is what a stat of the file says about its contents
+type diskState struct {
+	size    int64
+	modTime time.Time
+}
+
+func diskStateOf(info fs.FileInfo) diskState {
+	return diskState{size: info.Size(), modTime: info.ModTime()}
+}
+
+// editorCheckDisk reloads the file when something else has changed it.
+// Unsaved changes are only thrown away if the user says so, otherwise the
+// next save overwrites what is on disk. Either way it asks once per change
+func editorCheckDisk(cfg *EditorConfig) {
+	if cfg.filePath == "" || cfg.writeStdout {
+		return
+	}
+
+	info, err := os.Stat(cfg.filePath)
+	if err != nil {
+		// gone, or being replaced, which the next check will catch
+		return
+	}
+
+	disk := diskStateOf(info)
+	if disk == cfg.disk {
+		return
+	}
+	cfg.disk = disk
+
+	if !editorConfirmDiscard(cfg, fmt.Sprintf("%s changed on disk. Reload", cfg.fileName)) {
+		editorSetStatusMessage(cfg, "Kept your changes, saving will overwrite %s", cfg.fileName)
+		return
+	}
+
+	if err := editorReload(cfg); err != nil {
+		editorSetStatusMessage(cfg, "Can't reload %s", err.Error())
+		return
+	}
+	editorSetStatusMessage(cfg, "Reloaded %s, it changed on disk", cfg.fileName)
+}
+
+// editorConfirmDiscard asks before something throws away unsaved changes,
+// with action saying what, as in "Reload main.go". It is true when there is
+// nothing to lose or the answer is y. Quitting has its own guard, more
+// presses of the quit key, so that it never stops to ask
+func editorConfirmDiscard(cfg *EditorConfig, action string) bool {
+	if !cfg.dirty {
+		return true
+	}
+
+	answer, ok := editorPrompt(cfg, fmt.Sprintf("%s and lose your changes? (y/N)", action))
+	return ok && strings.EqualFold(strings.TrimSpace(answer), "y")
+}
+
+// editorReloadCommand reads the file again, as it is on disk
+func editorReloadCommand(cfg *EditorConfig, _ string) {
+	if cfg.filePath == "" {
+		editorCommandFailed(cfg, "No file to reload")
+		return
+	}
+	if !editorConfirmDiscard(cfg, fmt.Sprintf("Reload %s", cfg.fileName)) {
+		editorCommandFailed(cfg, "Reload aborted")
+		return
+	}
+
+	if err := editorReload(cfg); err != nil {
+		editorCommandFailed(cfg, "Can't reload %s", err.Error())
+		return
+	}
+	if info, err := os.Stat(cfg.filePath); err == nil {
+		cfg.disk = diskStateOf(info)
+	}
+	editorSetStatusMessage(cfg, "Reloaded %s", cfg.fileName)
+}
+
+// editorReload reads the file into the buffer again, keeping the cursor
+// and the view where they were as far as the new contents allow
+func editorReload(cfg *EditorConfig) error {
+	file, err := os.Open(cfg.filePath)
+	if err != nil {
+		return fmt.Errorf("opening file %s: %w", cfg.fileName, err)
+	}
+	defer file.Close()
+
+	cfg.rows = nil
+	cfg.folds = nil
+	cfg.cursors = nil
+	cfg.numRows = 0
+	cfg.noFinalNewline = false
+	cfg.selecting = false
+	cfg.search.savedHL = nil
+	if err := editorReadRows(cfg, file); err != nil {
+		return err
+	}
+	editorApplyModeline(cfg)
+	editorCheckMixedIndent(cfg)
+	cfg.dirty = false
+
+	cfg.cursorY = min(cfg.cursorY, cfg.numRows)
+	if cfg.cursorY < cfg.numRows {
+		cfg.cursorX = min(cfg.cursorX, cfg.rows[cfg.cursorY].size)
+	} else {
+		cfg.cursorX = 0
+	}
+	cfg.rowOff = min(cfg.rowOff, cfg.cursorY)
+
+	return nil
+}
+
+// followState tracks how much of a followed file has been read
+type followState struct {
+	offset  int64
+	modTime time.Time
+}
+
+// editorStartFollow reads the file again from the start, tracking how much
+// of it there is, so editorFollow can pick up where it stops. The cursor
+// goes to the last line, where it follows what is added
+func editorStartFollow(cfg *EditorConfig) {
+	cfg.readOnly = true
+	cfg.follow = &followState{}
+	cfg.rows = nil
+	cfg.folds = nil
+	cfg.cursors = nil
+	cfg.numRows = 0
+	cfg.noFinalNewline = false
+
+	editorFollow(cfg)
+	cfg.cursorY = max(cfg.numRows-1, 0)
+	cfg.cursorX = 0
+}
+
+// editorFollow appends whatever was added to the file since it was last
+// read. When the file shrinks, it was truncated or replaced (by log
+// rotation, say), so it is read again from the start. The cursor moves to
+// the new last line unless the user has moved it away from the end
+func editorFollow(cfg *EditorConfig) {
+	f := cfg.follow
+	info, err := os.Stat(cfg.filePath)
+	if err != nil {
+		// a rotated log can be missing for a moment, try again later
+		return
+	}
+
+	if info.Size() == f.offset && info.ModTime().Equal(f.modTime) {
+		return
+	}
+
+	atBottom := !editorFollowPaused(cfg)
+	if info.Size() < f.offset {
+		cfg.rows = nil
+		cfg.folds = nil
+		cfg.numRows = 0
+		cfg.noFinalNewline = false
+		f.offset = 0
+	}
+
+	file, err := os.Open(cfg.filePath)
+	if err != nil {
+		editorSetStatusMessage(cfg, "Can't follow %s: %s", cfg.fileName, err.Error())
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(f.offset, io.SeekStart); err != nil {
+		editorSetStatusMessage(cfg, "Can't follow %s: %s", cfg.fileName, err.Error())
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		editorSetStatusMessage(cfg, "Can't follow %s: %s", cfg.fileName, err.Error())
+		return
+	}
+
+	f.offset += int64(len(data))
+	f.modTime = info.ModTime()
+
+	// the last line read may have been cut off half way, so finish it
+	text := string(data)
+	if cfg.noFinalNewline && cfg.numRows > 0 {
+		text = cfg.rows[cfg.numRows-1].chars + text
+		editorDelRow(cfg, cfg.numRows-1)
+	}
+
+	if err := editorReadRows(cfg, strings.NewReader(text)); err != nil {
+		editorSetStatusMessage(cfg, "Can't follow %s: %s", cfg.fileName, err.Error())
+	}
+
+	if atBottom {
+		cfg.cursorY = max(cfg.numRows-1, 0)
+		cfg.cursorX = 0
+	}
+
+	cfg.cursorY = min(cfg.cursorY, cfg.numRows)
+	if cfg.cursorY < cfg.numRows {
+		cfg.cursorX = min(cfg.cursorX, cfg.rows[cfg.cursorY].size)
+	} else {
+		cfg.cursorX = 0
+	}
+}
+
+// editorFollowPaused reports whether the user has moved up from the last
+// line, which stops the view jumping to new lines until they come back
+func editorFollowPaused(cfg *EditorConfig) bool {
+	return cfg.cursorY < cfg.numRows-1
+}
+
+// editorSetIndent changes the tab settings and re-renders the rows, since
+// the width of every tab may have changed. A width of 0 is ignored
+func editorSetIndent(cfg *EditorConfig, tabWidth int, softTabs bool) {
+	cfg.softTabs = softTabs
+	if tabWidth == 0 || tabWidth == cfg.tabWidth {
+		return
+	}
+
+	cfg.tabWidth = tabWidth
+	for i := range cfg.rows {
+		editorUpdateRow(cfg, &cfg.rows[i])
+	}
+}
+
+// modeline holds the settings a file asks for in a comment, see
+// parseModeline
+type modeline struct {
+	tabStop     int
+	softTabs    bool
+	setSoftTabs bool
+	fileType    string
+}
+
+// editorApplyModeline applies the settings of a modeline in the first or
+// last KILO_MODELINES rows, over what .kilorc and detectIndent decided
+func editorApplyModeline(cfg *EditorConfig) {
+	rows := cfg.rows
+	if len(rows) > 2*KILO_MODELINES {
+		rows = slices.Concat(rows[:KILO_MODELINES], rows[len(rows)-KILO_MODELINES:])
+	}
+
+	var found modeline
+	var ok bool
+	for _, row := range rows {
+		if found, ok = parseModeline(row.chars); ok {
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+
+	// first, as the filetype brings its own settings
+	editorSetSyntax(cfg, found.fileType)
+
+	softTabs := cfg.softTabs
+	if found.setSoftTabs {
+		softTabs = found.softTabs
+	}
+	editorSetIndent(cfg, found.tabStop, softTabs)
+}
+
+// parseModeline reads a modeline like vim's from a line, most likely a
+// comment:
+//
+//	// kilo: tabstop=4 softtabs filetype=go
+//
+// The options are tabstop=<1-16>, softtabs or nosofttabs, and
+// filetype=<one of HL_DB>. A line with anything else after "kilo:",
+// besides the end of a comment, isn't taken as a modeline at all
+func parseModeline(line string) (modeline, bool) {
+	var m modeline
+	i := strings.Index(line, "kilo:")
+	if i < 0 || (i > 0 && line[i-1] != ' ' && line[i-1] != '\t') {
+		return m, false
+	}
+
+	fields := strings.Fields(line[i+len("kilo:"):])
+	if len(fields) == 0 {
+		return m, false
+	}
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "tabstop":
+			width, err := strconv.Atoi(value)
+			if err != nil || width < 1 || width > KILO_MODELINE_MAX_TAB {
+				return m, false
+			}
+			m.tabStop = width
+		case "softtabs", "nosofttabs":
+			if value != "" {
+				return m, false
+			}
+			m.softTabs, m.setSoftTabs = name == "softtabs", true
+		case "filetype":
+			if !slices.ContainsFunc(HL_DB, func(s editorSyntax) bool { return s.fileType == value }) {
+				return m, false
+			}
+			m.fileType = value
+		case "*/", "-->":
+		default:
+			return m, false
+		}
+	}
+
+	return m, true
+}
+
+// detectIndent guesses how rows are indented from the first
+// KILO_INDENT_SAMPLE indented rows. Whichever of tabs and spaces starts more
+// of them wins; a tie, or no indentation at all, is too ambiguous to call.
+// For spaces, width is the most common step in indentation between one row
+// and the next, or 0 if the indentation never steps in
+func detectIndent(rows []eRow) (softTabs bool, width int, ok bool) {
+	var tabs, spaces, previous, sampled int
+	steps := map[int]int{}
+
+	for _, row := range rows {
+		line := row.chars
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case line[0] == '\t':
+			tabs++
+		case indent > 0:
+			spaces++
+			if indent > previous {
+				steps[indent-previous]++
+			}
+		}
+
+		if line[0] != '\t' {
+			previous = indent
+		}
+
+		if indent > 0 || line[0] == '\t' {
+			sampled++
+			if sampled == KILO_INDENT_SAMPLE {
+				break
+			}
+		}
+	}
+
+	if tabs == spaces {
+		return false, 0, false
+	}
+
+	if tabs > spaces {
+		return false, 0, true
+	}
+
+	for step, count := range steps {
+		if count > steps[width] || (count == steps[width] && step < width) {
+			width = step
+		}
+	}
+
+	return true, width, true
+}
+
+// editorIndentStyle describes the tab settings for the status bar, like
+// `spaces:4` or `tabs:8`
+func editorIndentStyle(cfg *EditorConfig) string {
+	if cfg.softTabs {
+		return fmt.Sprintf("spaces:%d", cfg.tabWidth)
+	}
+
+	return fmt.Sprintf("tabs:%d", cfg.tabWidth)
+}
+
+// editorInsertTab inserts a tab, or with soft tabs enough spaces to reach
+// the next tab stop
+func editorInsertTab(cfg *EditorConfig) {
+	if !cfg.softTabs {
+		editorInsertChar(cfg, '\t')
+		return
+	}
+
+	rx := 0
+	if cfg.cursorY < cfg.numRows {
+		rx = editorCursorXToRowX(cfg, cfg.rows[cfg.cursorY], cfg.cursorX)
+	}
+
+	for n := cfg.tabWidth - rx%cfg.tabWidth; n > 0; n-- {
+		editorInsertChar(cfg, ' ')
+	}
+}
+
+func editorSave(cfg *EditorConfig) {
+	if editorReadOnly(cfg) {
+		return
+	}
+
+	if cfg.writeStdout {
+		cfg.dirty = false
+		editorSetStatusMessage(cfg, "Buffer will be written to stdout on quit")
+		return
+	}
+
+	if cfg.fileName == "" {
+		fileName, ok := editorPromptWith(cfg, "Save as", promptOptions{
+			complete: completePath,
+			history:  "file",
+		})
+		if !ok {
+			editorCommandFailed(cfg, "Save aborted")
+			return
+		}
+
+		if fileName == "" {
+			editorCommandFailed(cfg, "Save aborted: no file name given")
+			return
+		}
+		editorSetFileName(cfg, fileName)
+		editorSelectSyntaxHighlight(cfg)
+	}
+
+	if err := editorFormat(cfg); err != nil {
+		editorCommandFailed(cfg, "Save aborted, formatter failed: %s", err.Error())
+		return
+	}
+
+	// the blank lines are left out of the file, and only go from the
+	// buffer once it is saved, so a failed save changes nothing
+	rows := cfg.rows
+	if cfg.trimBlankLines {
+		rows = rows[:len(rows)-blankLinesAtEnd(rows)]
+	}
+
+	written, err := editorWriteFile(cfg, cfg.filePath, rows)
+	if err != nil {
+		editorCommandFailed(cfg, "Can't save! I/O error: %s", err.Error())
+		return
+	}
+
+	trimmed := 0
+	if cfg.trimBlankLines {
+		trimmed = editorTrimBlankLines(cfg)
+	}
+
+	if trimmed > 0 {
+		editorSetStatusMessage(cfg, "%d bytes, %d lines written to disk, %d blank lines at the end trimmed", written, cfg.numRows, trimmed)
+	} else {
+		editorSetStatusMessage(cfg, "%d bytes, %d lines written to disk", written, cfg.numRows)
+	}
+	cfg.dirty = false
+	cfg.lastSavedTime = cfg.now()
+	if info, err := os.Stat(cfg.filePath); err == nil {
+		cfg.disk = diskStateOf(info)
+	}
+}
+
+// editorTrimBlankLines deletes the blank rows at the end of the buffer, see
+// blankLinesAtEnd, and returns how many went
+func editorTrimBlankLines(cfg *EditorConfig) int {
+	trimmed := blankLinesAtEnd(cfg.rows)
+	if trimmed == 0 {
+		return 0
+	}
+
+	for range trimmed {
+		editorDelRow(cfg, cfg.numRows-1)
+	}
+
+	cfg.dirty = true
+	if cfg.cursorY > cfg.numRows {
+		cfg.cursorY = cfg.numRows
+	}
+	if cfg.cursorY < cfg.numRows && cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
+
+	return trimmed
+}
+
+// blankLinesAtEnd counts the blank rows, empty or all whitespace, at the end
+// of rows but one
+func blankLinesAtEnd(rows []eRow) int {
+	n := 0
+	for len(rows)-n > 1 && strings.TrimSpace(rows[len(rows)-n-1].chars) == "" &&
+		strings.TrimSpace(rows[len(rows)-n-2].chars) == "" {
+		n++
+	}
+
+	return n
+}
+
+// editorWriteFile streams rows of the buffer into a temporary file next to
+// name, which then takes its place, so a failed save leaves the file as it
+// was. A big buffer takes a while, so how much has been written shows as it
+// goes
+func editorWriteFile(cfg *EditorConfig, name string, rows []eRow) (int, error) {
+	// write where a symlink points, rather than replacing the link
+	path := name
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := fs.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".kilo-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	progress := &progressWriter{w: file, step: KILO_SAVE_PROGRESS, report: func(written int) {
+		editorSetStatusMessage(cfg, "Saving %s... %d bytes written", filepath.Base(name), written)
+		editorRefreshScreen(cfg)
+	}}
+	w := bufio.NewWriter(progress)
+	written, err := writeRows(cfg, rows, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	// on disk before it takes the file's place, so a crash can't leave
+	// an empty file where the old one was
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	return written, err
+}
+
+// editorInsertDate types the current time at the cursor, in the layout in
+// args or else the date_format setting
+func editorInsertDate(cfg *EditorConfig, args string) {
+	for _, r := range cfg.now().Format(cmp.Or(args, cfg.dateFormat)) {
+		editorInsertChar(cfg, r)
+	}
+}
+
+// editorSaveCopy writes the buffer to the file named in args, or asked
+// for, leaving the buffer's own name and unsaved changes as they are
+func editorSaveCopy(cfg *EditorConfig, args string) {
+	fileName := args
+	if fileName == "" {
+		var ok bool
+		fileName, ok = editorPromptWith(cfg, "Save a copy as", promptOptions{
+			complete: completePath,
+			history:  "file",
+		})
+		if !ok {
+			editorCommandFailed(cfg, "Save aborted")
+			return
+		}
+
+		if fileName == "" {
+			editorCommandFailed(cfg, "Save aborted: no file name given")
+			return
+		}
+	}
+
+	written, err := editorWriteFile(cfg, fileName, cfg.rows)
+	if err != nil {
+		editorCommandFailed(cfg, "Can't save a copy! I/O error: %s", err.Error())
+		return
+	}
+
+	editorSetStatusMessage(cfg, "%d bytes, %d lines written to %s", written, cfg.numRows, fileName)
+}
+
+// editorFormat runs the buffer through the formatter configured for its
+// filetype, e.g.
+//
+//	[go]
+//	format = gofmt
+//
+// The cursor stays on the same line and column where the new content allows
+func editorFormat(cfg *EditorConfig) error {
+	if cfg.syntax == nil {
+		return nil
+	}
+
+	command := cfg.rc.get(cfg.syntax.fileType, "format")
+	if command == "" {
+		return nil
+	}
+
+	contents := editorRowsToString(cfg)
+	output, err := runShellFilter(command, contents)
+	if err != nil {
+		return err
+	}
+
+	if output == contents {
+		return nil
+	}
+
+	editorReplaceRows(cfg, 0, cfg.numRows-1, splitLines(output))
+
+	return nil
+}
+
+func editorFindCallback(cfg *EditorConfig, query string) {
+	if len(cfg.search.savedHL) > 0 && cfg.search.savedHLLine < cfg.numRows {
+		row := &cfg.rows[cfg.search.savedHLLine]
+		if row.render == cfg.search.savedRender {
+			row.hl = cfg.search.savedHL
+		}
+		cfg.search.savedHL = []uint8{}
+	}
+
+	if query == "" {
+		return
+	}
+
+	if cfg.search.lastMatch == -1 {
+		cfg.search.direction = 1
+	}
+
+	current := cfg.search.lastMatch
+
+	for range cfg.numRows {
+		current += cfg.search.direction
+		if current == -1 {
+			current = cfg.numRows - 1
+		} else if current == cfg.numRows {
+			current = 0
+		}
+
+		row := &cfg.rows[current]
+		if strings.Contains(row.render, query) {
+			cfg.search.lastMatch = current
+			cfg.search.savedHLLine = current
+			cfg.search.savedHL = make([]uint8, len(row.hl))
+			copy(cfg.search.savedHL, row.hl)
+			cfg.search.savedRender = row.render
+
+			index := strings.Index(row.render, query)
+			for i := range query {
+				row.hl[index+i] = HL_MATCH
+			}
+			// put the cursor on the last character of the match
+			_, size := utf8.DecodeLastRuneInString(query)
+			rx := stringWidth(row.render[:index+len(query)-size])
+			editorJumpTo(cfg, current, editorRowXToCursorX(cfg, *row, rx))
+
+			break
+		}
+	}
+}
+
+// editorShiftSearch keeps the saved highlight on the row it came from as
+// rows are inserted or deleted, dropping it if that row is deleted
+func editorShiftSearch(cfg *EditorConfig, at, n int) {
+	if len(cfg.search.savedHL) == 0 || cfg.search.savedHLLine < at {
+		return
+	}
+
+	if n < 0 && cfg.search.savedHLLine == at {
+		cfg.search.savedHL = []uint8{}
+		return
+	}
+
+	cfg.search.savedHLLine += n
+}
+
+func editorSearch(cfg *EditorConfig) {
+	savedCursorX := cfg.cursorX
+	savedCursorY := cfg.cursorY
+	savedColOff := cfg.colOff
+	savedRowOff := cfg.rowOff
+
+	// the previous search may have left its match highlighted
+	editorFindCallback(cfg, "")
+	cfg.search = searchState{lastMatch: -1, direction: 1}
+
+	_, ok := editorPromptWith(cfg, "Search: %s (Use ESC/Arrows/Enter)", promptOptions{
+		callback: func(query string, key int) {
+			if key == ARROW_RIGHT || key == ARROW_DOWN {
+				cfg.search.direction = 1
+			} else if key == ARROW_UP || key == ARROW_LEFT {
+				cfg.search.direction = -1
 			} else {
-				buf.Write([]byte("~"))
+				cfg.search.direction = 1
+				cfg.search.lastMatch = -1
 			}
-		} else {
-			row := cfg.rows[fileRow]
-			length := row.rsize - cfg.colOff
-			if length < 0 {
-				length = 0
+			editorFindCallback(cfg, query)
+		},
+		history: "search",
+	})
+
+	if !ok {
+		cfg.cursorX = savedCursorX
+		cfg.cursorY = savedCursorY
+		cfg.colOff = savedColOff
+		cfg.rowOff = savedRowOff
+		editorFindCallback(cfg, "")
+	} else {
+		// Enter keeps the cursor wherever the search left it, even when
+		// the query was emptied again
+		cfg.search.lastMatch = -1
+		if cfg.cursorY != savedCursorY {
+			cfg.marks[KILO_LAST_MARK] = mark{savedCursorX, savedCursorY}
+		}
+	}
+
+}
+
+// editorPrompt asks for a line of input in the message bar. Enter confirms
+// whatever has been typed, even nothing; ok is false when Esc cancelled
+// the prompt instead
+func editorPrompt(cfg *EditorConfig, prompt string, cb ...callback) (input string, ok bool) {
+	var fn callback = nil
+
+	if len(cb) > 0 {
+		fn = cb[0]
+	}
+
+	return editorPromptWith(cfg, prompt, promptOptions{callback: fn})
+}
+
+// editorPromptWith is editorPrompt with the extras in opts.
+//
+// With completion, the first Tab completes as far as the candidates agree
+// and lists them, further presses cycle through them.
+//
+// With history, Up/Down step through earlier inputs. A callback may want the
+// arrows too (search uses them to move between matches), so once something
+// has been typed they go to the callback unless a recalled entry is showing
+func editorPromptWith(cfg *EditorConfig, prompt string, opts promptOptions) (string, bool) {
+	var buf strings.Builder
+
+	fn, complete := opts.callback, opts.complete
+
+	var candidates []string
+	cycle := 0
+	hint := ""
+
+	history := cfg.history[opts.history]
+	recalled := len(history)
+	draft := ""
+
+	for {
+		editorSetStatusMessage(cfg, "%s: Press esc to exit: %s%s", prompt, buf.String(), hint)
+		editorRefreshScreen(cfg)
+
+		c, err := editorReadKey(cfg)
+		if errors.Is(err, ErrEndOfInput) || c == Ctrl_C && cfg.keymap[Ctrl_C] == ACTION_INTERRUPT {
+			// nothing more is coming to finish the answer with, or Ctrl-C
+			// gives up on it as Esc does, unless it was rebound
+			c = Esc
+		} else if err != nil {
+			continue
+		}
+
+		browsing := recalled != len(history)
+		if (c == ARROW_UP || c == ARROW_DOWN) && opts.history != "" && (fn == nil || buf.Len() == 0 || browsing) {
+			if c == ARROW_UP && recalled > 0 {
+				if !browsing {
+					draft = buf.String()
+				}
+				recalled--
+			} else if c == ARROW_DOWN && browsing {
+				recalled++
+			}
+
+			buf.Reset()
+			if recalled == len(history) {
+				buf.WriteString(draft)
+			} else {
+				buf.WriteString(history[recalled])
+			}
+
+			if fn != nil {
+				fn(buf.String(), 0)
+			}
+			continue
+		}
+
+		if c == TAB && complete != nil {
+			if candidates == nil {
+				candidates = complete(buf.String())
+				cycle = 0
+				hint = ""
+
+				switch len(candidates) {
+				case 0:
+					hint = "  [no match]"
+				case 1:
+					buf.Reset()
+					buf.WriteString(candidates[0])
+					// completing again may go further, into a directory
+					candidates = nil
+				default:
+					buf.Reset()
+					buf.WriteString(commonPrefix(candidates))
+					hint = "  [" + strings.Join(candidates, " ") + "]"
+				}
+				continue
 			}
-			// we do not want to write past the screen
-			if length > int(cfg.winSize.Col) {
-				length = int(cfg.winSize.Col)
+
+			buf.Reset()
+			buf.WriteString(candidates[cycle%len(candidates)])
+			cycle++
+			continue
+		}
+
+		candidates = nil
+		hint = ""
+
+		if c == ENTER {
+			editorSetStatusMessage(cfg, "%s", "")
+			if buf.Len() > 0 {
+				editorAddHistory(cfg, opts.history, buf.String())
 			}
+			return buf.String(), true
+		}
 
-			hl := row.hl
-			currentColor := -1
+		// editing a recalled entry hands the arrows back to the callback
+		if c != ARROW_LEFT && c != ARROW_RIGHT {
+			recalled = len(history)
+		}
 
-			for i, r := range row.render[cfg.colOff : cfg.colOff+length] {
-				if hl[i] == HL_NORMAL {
-					if currentColor != -1 {
-						buf.WriteString("\x1b[39m")
-						currentColor = -1
-					}
-					buf.WriteRune(r)
-				} else {
-					color := editorSyntaxToColor(hl[i])
-					if currentColor != int(color) {
-						buf.WriteString(fmt.Sprintf("\x1b[%dm", color))
-						currentColor = int(color)
-					}
-					buf.WriteRune(r)
-				}
+		if c == Esc {
+			return "", false
+		}
+
+		if c == BACKSPACE && buf.String() != "" {
+			current := buf.String()
+			_, size := utf8.DecodeLastRuneInString(current)
+			buf.Reset()
+			buf.WriteString(current[:len(current)-size])
+			if fn != nil {
+				fn(buf.String(), c)
 			}
-			buf.WriteString("\x1b[39m")
+			continue
+		}
 
-			// if length > 0 {
-			// 	buf.WriteString(row.render[cfg.colOff : cfg.colOff+length])
-			// }
+		// arrows and the other editor keys aren't typed, but the callback
+		// may still want them, as search does to move between matches
+		if c > utf8.MaxRune {
+			if fn != nil {
+				fn(buf.String(), c)
+			}
+			continue
+		}
+
+		if unicode.IsControl(rune(c)) {
+			continue
+		}
+
+		buf.WriteRune(rune(c))
+
+		if fn != nil {
+			fn(buf.String(), c)
 		}
-		buf.Write([]byte("\x1b[K"))
-		buf.Write([]byte("\r\n"))
 	}
 }
 
-// *** Editor manage cursor position
-func editorCursorXToRowX(row eRow, cursorX int) int {
-	rx := 0
+// editorAddHistory records a prompt input, dropping an identical earlier
+// entry so that it moves to the end
+func editorAddHistory(cfg *EditorConfig, kind, input string) {
+	if kind == "" {
+		return
+	}
 
-	for j := 0; j < cursorX; j++ {
-		if row.chars[j] == '\t' {
-			rx += (KILO_TAB_STOP - 1) - (rx % KILO_TAB_STOP)
-		}
-		rx++
+	history := slices.DeleteFunc(cfg.history[kind], func(entry string) bool {
+		return entry == input
+	})
+	history = append(history, input)
+	if len(history) > KILO_HISTORY {
+		history = history[len(history)-KILO_HISTORY:]
 	}
 
-	return rx
+	cfg.history[kind] = history
 }
 
-func editorRowXToCursorX(row eRow, rx int) int {
-	cur_rx := 0
+// completePath lists the files and directories that start with input.
+// Directories get a trailing slash so that completion can carry on into them
+func completePath(input string) []string {
+	dir, base := filepath.Split(input)
 
-	var cx int
+	entries, err := os.ReadDir(cmp.Or(dir, "."))
+	if err != nil {
+		return nil
+	}
 
-	for cx = 0; cx < row.size; cx++ {
-		if row.chars[cx] == '\t' {
-			cur_rx += (KILO_TAB_STOP - 1) - (cur_rx % KILO_TAB_STOP)
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
 		}
-		cur_rx++
 
-		if cur_rx > rx {
-			return cx
+		// hidden files only show up when asked for
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		if entry.IsDir() {
+			name += "/"
 		}
+		matches = append(matches, dir+name)
 	}
 
-	return cx
+	return matches
 }
 
-func editorScroll(cfg *EditorConfig) {
-	cfg.rowX = 0
+func commonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
 
-	if cfg.cursorY < cfg.numRows {
-		cfg.rowX = editorCursorXToRowX(cfg.rows[cfg.cursorY], cfg.cursorX)
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	// the words may agree on the first bytes of different runes
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
 	}
 
-	if cfg.cursorY < cfg.rowOff {
-		cfg.rowOff = cfg.cursorY
+	return prefix
+}
+
+// *** Document
+
+// DocumentVersion is the version of the Document schema. It goes up when a
+// field changes meaning or goes away, not when one is added
+const DocumentVersion = 1
+
+// Document is the state of a buffer as JSON, for tools outside the editor
+// to read or set, and for snapshots in tests
+type Document struct {
+	Version  int      `json:"version"`
+	FileName string   `json:"file_name"`
+	Lines    []string `json:"lines"`
+
+	// Whether the last line ends in a newline when saved
+	FinalNewline bool `json:"final_newline"`
+
+	// Counted from 0, the column in bytes
+	Cursor struct {
+		Row int `json:"row"`
+		Col int `json:"col"`
+	} `json:"cursor"`
+
+	Dirty bool `json:"dirty"`
+
+	// The fileType of the syntax highlighting, empty for none
+	Syntax string `json:"syntax"`
+}
+
+// EncodeDocument writes the buffer as a Document
+func EncodeDocument(cfg *EditorConfig) ([]byte, error) {
+	doc := Document{
+		Version:      DocumentVersion,
+		FileName:     cfg.fileName,
+		Lines:        make([]string, 0, cfg.numRows),
+		FinalNewline: !cfg.noFinalNewline,
+		Dirty:        cfg.dirty,
+	}
+	for _, row := range cfg.rows {
+		doc.Lines = append(doc.Lines, row.chars)
 	}
+	doc.Cursor.Row, doc.Cursor.Col = cfg.cursorY, cfg.cursorX
+	if cfg.syntax != nil {
+		doc.Syntax = cfg.syntax.fileType
+	}
+
+	return json.Marshal(doc)
+}
 
-	if cfg.cursorY >= cfg.rowOff+int(cfg.winSize.Row) {
-		cfg.rowOff = cfg.cursorY - int(cfg.winSize.Row) + 1
+// DecodeDocument replaces the buffer with a Document. A syntax kilo
+// doesn't know is picked from the file name instead, as on opening
+func DecodeDocument(cfg *EditorConfig, data []byte) error {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("decoding document: %w", err)
+	}
+	if doc.Version != DocumentVersion {
+		return fmt.Errorf("decoding document: version %d, want %d", doc.Version, DocumentVersion)
 	}
 
-	if cfg.rowX < cfg.colOff {
-		cfg.colOff = cfg.rowX
+	cfg.rows = nil
+	cfg.folds = nil
+	cfg.numRows = 0
+	cfg.selecting = false
+	cfg.search.savedHL = nil
+	for _, line := range doc.Lines {
+		editorInsertRow(cfg, line, cfg.numRows)
 	}
+	cfg.noFinalNewline = !doc.FinalNewline
 
-	if cfg.rowX >= cfg.colOff+int(cfg.winSize.Col) {
-		cfg.colOff = cfg.rowX - int(cfg.winSize.Col) + 1
+	if doc.FileName != "" {
+		editorSetFileName(cfg, doc.FileName)
+	} else {
+		cfg.fileName, cfg.filePath = "", ""
 	}
+	editorSelectSyntaxHighlight(cfg)
+	editorSetSyntax(cfg, doc.Syntax)
+
+	editorJumpTo(cfg, doc.Cursor.Row, doc.Cursor.Col)
+	cfg.dirty = doc.Dirty
+
+	return nil
 }
 
-func editorRefreshScreen(cfg *EditorConfig) {
-	editorScroll(cfg)
+// *** Commands
+
+// editorCommand runs a named command typed at the Ctrl-E prompt. args is
+// whatever followed the command name, with surrounding spaces removed
+type editorCommand func(cfg *EditorConfig, args string)
+
+var editorCommands = map[string]editorCommand{
+	"tabs-to-spaces": editorTabsToSpaces,
+	"spaces-to-tabs": editorSpacesToTabs,
+	"upper":          editorUpperCase,
+	"lower":          editorLowerCase,
+	"title":          editorTitleCase,
+	"filter":         editorFilter,
+	"date":           editorInsertDate,
+	"align":          editorAlign,
+	"deindent":       editorDeindent,
+	"save-copy":      editorSaveCopy,
+	"write":          editorWriteCommand,
+	"reload":         editorReloadCommand,
+	"quit":           editorQuitCommand,
+	"w":              editorWriteCommand,
+	"replace":        editorReplace,
+	"stats":          editorStats,
+	"cursor-line":    editorToggleCursorLine,
+	"goto":           editorGoToCommand,
+	"guide":          editorToggleGuide,
+	"scrollbar":      editorToggleScrollbar,
+	"indent-guides":  editorToggleIndentGuides,
+	"show-eol":       editorToggleEOL,
+	"fold":           editorFold,
+	"mark":           editorSetMark,
+	"jump":           editorJumpToMark,
+	"split":          editorSplit,
+	"unfold":         editorUnfold,
+}
 
-	var buf bytes.Buffer
+func editorCommandPrompt(cfg *EditorConfig) error {
+	input, ok := editorPromptWith(cfg, "Command", promptOptions{history: "command"})
+	if !ok {
+		return nil
+	}
 
-	// hide cursor
-	buf.Write([]byte("\x1b[?25l"))
-	buf.Write([]byte("\x1b[H"))
+	if strings.TrimSpace(input) == "" {
+		editorSetStatusMessage(cfg, "No command given")
+		return nil
+	}
 
-	editorDrawRows(cfg, &buf)
-	editorDrawStatusBar(cfg, &buf)
-	editorDrawMessageBar(cfg, &buf)
+	// a failure has been shown already, only quitting goes further
+	if err := editorRunCommand(cfg, input); errors.Is(err, ErrExitTerminal) {
+		return err
+	}
+	return nil
+}
 
-	// move cursor
-	buf.Write([]byte(fmt.Sprintf("\x1b[%d;%dH", (cfg.cursorY-cfg.rowOff)+1, (cfg.rowX-cfg.colOff)+1)))
+// editorRunCommand runs one command line, returning why it failed, or
+// ErrExitTerminal if it was quit
+func editorRunCommand(cfg *EditorConfig, input string) error {
+	input = strings.TrimSpace(input)
 
-	// show cursor
-	buf.Write([]byte("\x1b[?25h"))
-	os.Stdout.Write(buf.Bytes())
+	// vim's s/old/new/ and %s/old/new/ spell replace
+	if rest, ok := strings.CutPrefix(strings.TrimPrefix(input, "%"), "s"); ok && rest != "" {
+		if r, _ := utf8.DecodeRuneInString(rest); unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			input = "replace " + rest
+		}
+	}
+
+	cfg.commandErr = nil
+	name, args, _ := strings.Cut(input, " ")
+	if command, ok := editorCommands[name]; ok {
+		command(cfg, strings.TrimSpace(args))
+	} else {
+		editorCommandFailed(cfg, "Unknown command: %s", name)
+	}
+
+	err := cfg.commandErr
+	cfg.commandErr = nil
+	return err
 }
 
-// *** process key presses
-func editorProcessKeyPress(cfg *EditorConfig) error {
-	key, err := editorReadKey()
+// editorCommandFailed shows why something failed, as editorSetStatusMessage
+// does, and also tells editorRunCommand so a script can stop on it
+func editorCommandFailed(cfg *EditorConfig, format string, args ...any) {
+	editorSetStatusMessage(cfg, format, args...)
+	cfg.commandErr = errors.New(cfg.statusMsg)
+}
+
+// editorWriteCommand saves the buffer, as the save key does
+func editorWriteCommand(cfg *EditorConfig, _ string) {
+	editorSave(cfg)
+}
+
+// editorQuitCommand quits as the quit key does, for when there is no key
+// for it, as with flow_control on
+func editorQuitCommand(cfg *EditorConfig, _ string) {
+	cfg.commandErr = editorQuit(cfg)
+}
+
+// editorReplace replaces matches of a regular expression on the selected
+// lines, or every line, given sed style as /old/new/flags where any
+// character can stand in for the slashes. Only the first match on a line is
+// replaced unless the flags have g, and with l old and new are plain text
+// rather than a regular expression and a template using $1 for its groups
+func editorReplace(cfg *EditorConfig, args string) {
+	if editorReadOnly(cfg) {
+		return
+	}
+
+	pattern, replacement, flags, ok := parseReplace(args)
+	if !ok || strings.Trim(flags, "gl") != "" {
+		editorCommandFailed(cfg, "Usage: replace /old/new/[g][l]")
+		return
+	}
+
+	literal := strings.Contains(flags, "l")
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		return fmt.Errorf("processing key press: %w", err)
+		editorCommandFailed(cfg, "Bad pattern: %s", err.Error())
+		return
 	}
 
-	switch key {
-	case ExitCode:
-		if cfg.dirty && quitkeyPresses > 0 {
-			editorSetStatusMessage(cfg, `WARNING!!! File has unsaved changes. Press Ctrl-Q %d more times to quit.`, quitkeyPresses)
-			quitkeyPresses--
-			return nil
+	n := 1
+	if strings.Contains(flags, "g") {
+		n = -1
+	}
+
+	start, end := 0, cfg.numRows-1
+	if y0, _, y1, _, ok := editorSelection(cfg); ok {
+		start, end = y0, y1
+	}
+
+	count := 0
+	for y := start; y <= end; y++ {
+		row := &cfg.rows[y]
+		matches := re.FindAllStringSubmatchIndex(row.chars, n)
+		if len(matches) == 0 {
+			continue
 		}
-		return ErrExitTerminal
-	case ARROW_UP, ARROW_DOWN, ARROW_RIGHT, ARROW_LEFT:
-		editorMoveCursor(key, cfg)
-	case PAGE_DOWN, PAGE_UP:
-		{
-			if key == PAGE_UP {
-				cfg.cursorY = cfg.rowOff
-			} else if key == PAGE_DOWN {
-				cfg.cursorY = cfg.rowOff + int(cfg.winSize.Row) - 1
-			}
 
-			if cfg.cursorY >= cfg.numRows {
-				cfg.cursorY = cfg.numRows
-			}
-			i := cfg.winSize.Row
-			for i != 0 {
-				if key == PAGE_UP {
-					editorMoveCursor(ARROW_UP, cfg)
-				} else {
-					editorMoveCursor(ARROW_DOWN, cfg)
-				}
-				i--
+		var b []byte
+		last := 0
+		for _, m := range matches {
+			b = append(b, row.chars[last:m[0]]...)
+			if literal {
+				b = append(b, replacement...)
+			} else {
+				b = re.ExpandString(b, replacement, row.chars, m)
 			}
+			last = m[1]
 		}
-	case HOME_KEY:
-		if cfg.cursorY < cfg.numRows {
-			cfg.cursorX = cfg.rows[cfg.cursorY].size
-		}
-	case END_KEY:
-		cfg.cursorX = 0
-	case BACKSPACE, Ctrl_H:
-		editorDelChar(cfg)
-	case ENTER:
-		editorInsertNewLine(cfg)
-	case Ctrl_L, Esc:
-		break
-	case Ctrl_S:
-		editorSave(cfg)
-	case Ctrl_F:
-		editorSearch(cfg)
-	default:
-		editorInsertChar(cfg, key)
+		count += len(matches)
+		row.chars = string(b) + row.chars[last:]
+		row.size = len(row.chars)
+		editorUpdateRow(cfg, row)
+		cfg.dirty = true
 	}
 
-	quitkeyPresses = KILO_QUIT_TIMES
-	return nil
+	if cfg.cursorY < cfg.numRows && cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
+	editorSetStatusMessage(cfg, "%d replaced", count)
 }
 
-func editorMoveCursor(key int, cfg *EditorConfig) {
-	var row eRow
-	if cfg.cursorY < cfg.numRows {
-		row = cfg.rows[cfg.cursorY]
+// parseReplace splits /old/new/flags at its delimiter, the first character.
+// A backslash before the delimiter makes it part of old or new, and the
+// closing delimiter may be left off when there are no flags
+func parseReplace(args string) (pattern, replacement, flags string, ok bool) {
+	delimiter, size := utf8.DecodeRuneInString(args)
+	if size == 0 {
+		return "", "", "", false
 	}
 
-	switch key {
-	case ARROW_UP:
-		if cfg.cursorY > 0 {
-			cfg.cursorY--
+	var parts []string
+	var part strings.Builder
+	rest := args[size:]
+	for rest != "" {
+		r, size := utf8.DecodeRuneInString(rest)
+		rest = rest[size:]
+		switch {
+		case r == '\\' && strings.HasPrefix(rest, string(delimiter)):
+			part.WriteRune(delimiter)
+			rest = rest[len(string(delimiter)):]
+		case r == delimiter:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
 		}
-	case ARROW_DOWN:
-		if cfg.cursorY < cfg.numRows {
-			cfg.cursorY++
+	}
+	parts = append(parts, part.String())
+
+	if len(parts) == 2 {
+		parts = append(parts, "")
+	}
+	if len(parts) != 3 || parts[0] == "" {
+		return "", "", "", false
+	}
+
+	return parts[0], parts[1], parts[2], true
+}
+
+// editorTabsToSpaces expands the tabs in the indentation of every row. With
+// the "all" argument tabs after the indentation are expanded too, padding to
+// the next tab stop so columns stay aligned
+func editorTabsToSpaces(cfg *EditorConfig, args string) {
+	leadingOnly := args != "all"
+	editorRetab(cfg, func(line string) string {
+		return expandTabs(line, cfg.tabWidth, leadingOnly)
+	})
+}
+
+// editorSpacesToTabs is the reverse of editorTabsToSpaces: runs of spaces in
+// the indentation (or, with "all", anywhere) that reach a tab stop become tabs
+func editorSpacesToTabs(cfg *EditorConfig, args string) {
+	leadingOnly := args != "all"
+	editorRetab(cfg, func(line string) string {
+		return compressSpaces(line, cfg.tabWidth, leadingOnly)
+	})
+}
+
+// editorAlign pads the selected lines with spaces so that the first
+// delimiter (args, or asked for) in each starts at the same column, as in
+//
+//	name    = kilo
+//	version = 1
+//
+// Lines without the delimiter are left alone
+func editorAlign(cfg *EditorConfig, args string) {
+	if editorReadOnly(cfg) {
+		return
+	}
+
+	start, _, end, _, ok := editorSelection(cfg)
+	if !ok {
+		editorCommandFailed(cfg, "Select the lines to align first")
+		return
+	}
+
+	delimiter := args
+	if delimiter == "" {
+		delimiter, ok = editorPromptWith(cfg, "Align on", promptOptions{history: "align"})
+		if !ok || delimiter == "" {
+			return
 		}
+	}
 
-	case ARROW_LEFT:
-		if cfg.cursorX > 0 {
-			cfg.cursorX--
-		} else if cfg.cursorY > 0 {
-			cfg.cursorY--
-			cfg.cursorX = cfg.rows[cfg.cursorY].size
+	// columns are screen columns, so tabs and wide characters before the
+	// delimiter count for what they take up
+	cols := map[int]int{}
+	widest := 0
+	for y := start; y <= end; y++ {
+		if i := strings.Index(cfg.rows[y].chars, delimiter); i >= 0 {
+			cols[y] = editorCursorXToRowX(cfg, cfg.rows[y], i)
+			widest = max(widest, cols[y])
 		}
+	}
 
-	case ARROW_RIGHT:
-		if cfg.cursorX < row.size {
-			cfg.cursorX++
-		} else if row.size == cfg.cursorX && cfg.cursorY != cfg.numRows {
-			cfg.cursorY++
-			cfg.cursorX = 0
+	for y, col := range cols {
+		row := &cfg.rows[y]
+		if col == widest {
+			continue
 		}
+
+		i := strings.Index(row.chars, delimiter)
+		row.chars = row.chars[:i] + strings.Repeat(" ", widest-col) + row.chars[i:]
+		row.size = len(row.chars)
+		editorUpdateRow(cfg, row)
+		cfg.dirty = true
 	}
 
-	// row could have changed here, arrow left and arrow right
-	// could have altered the row
-	if cfg.cursorY < cfg.numRows {
-		row = cfg.rows[cfg.cursorY]
+	cfg.selecting = false
+	editorSetStatusMessage(cfg, "Aligned %d lines on %s", len(cols), delimiter)
+}
+
+// editorDeindent shifts the selected lines left by the indentation they all
+// share, so a block pasted in from deeper code starts at column 0 but keeps
+// its shape. Blank lines don't count towards what is shared
+func editorDeindent(cfg *EditorConfig, _ string) {
+	if editorReadOnly(cfg) {
+		return
 	}
 
-	if cfg.cursorX > row.size {
-		cfg.cursorX = row.size
+	start, _, end, _, ok := editorSelection(cfg)
+	if !ok {
+		editorCommandFailed(cfg, "Select the lines to deindent first")
+		return
 	}
-}
 
-func editorReadKey() (int, error) {
-	reader := bufio.NewReader(os.Stdin)
-	r, _, err := reader.ReadRune()
-	if err != nil && err != io.EOF {
-		return 0, fmt.Errorf("reading key: %w", err)
+	shared := -1
+	for y := start; y <= end; y++ {
+		if w := editorIndentWidth(cfg, cfg.rows[y]); w >= 0 && (shared < 0 || w < shared) {
+			shared = w
+		}
+	}
+	if shared <= 0 {
+		editorSetStatusMessage(cfg, "Nothing to deindent")
+		return
 	}
 
-	escapeKeys := []rune{1, 4, 5, 6, 7, 8}
+	for y := start; y <= end; y++ {
+		row := &cfg.rows[y]
+		line := removeIndent(row.chars, shared, cfg.tabWidth)
+		removed := row.size - len(line)
 
-	if r == 27 {
-		// read next two runes to complete escape sequence
-		r, _, _ = reader.ReadRune() // r is likely [
-		if r == '[' || r == 'O' {   // an escape sequence, continue
-			r, _, _ = reader.ReadRune()         // sequence
-			if slices.Contains(escapeKeys, r) { // maybe a page up or down
-				next, _, _ := reader.ReadRune() // read next one
-				if next != '~' {                // not a page up or down
-					r = next
-				}
-			}
+		// the selection stays on the same text
+		if cfg.anchorY == y {
+			cfg.anchorX = max(cfg.anchorX-removed, 0)
 		}
+		if cfg.cursorY == y {
+			cfg.cursorX = max(cfg.cursorX-removed, 0)
+		}
+
+		row.chars = line
+		row.size = len(row.chars)
+		editorUpdateRow(cfg, row)
 	}
 
-	switch r {
-	case 'A':
-		return ARROW_UP, nil
-	case 'B':
-		return ARROW_DOWN, nil
-	case 'C':
-		return ARROW_RIGHT, nil
-	case 'D':
-		return ARROW_LEFT, nil
-	case 53:
-		return PAGE_UP, nil
-	case 54:
-		return PAGE_DOWN, nil
-	case 70:
-		return HOME_KEY, nil
-	case 72:
-		return END_KEY, nil
-	case 517:
-		return DEL_KEY, nil
-	default:
-		unicodeValue, _ := strconv.Atoi(fmt.Sprintf("%d", r))
-		return unicodeValue, nil
+	cfg.dirty = true
+	editorSetStatusMessage(cfg, "Deindented %d lines by %d columns", end-start+1, shared)
+}
+
+// removeIndent takes up to cols columns of leading whitespace off line. A
+// tab reaching past cols leaves what is left of it as spaces
+func removeIndent(line string, cols, tabWidth int) string {
+	col := 0
+	for i, r := range line {
+		if col >= cols {
+			return line[i:]
+		}
+
+		switch r {
+		case ' ':
+			col++
+		case '\t':
+			col += tabWidth - col%tabWidth
+			if col > cols {
+				return strings.Repeat(" ", col-cols) + line[i+1:]
+			}
+		default:
+			return line[i:]
+		}
 	}
+
+	return ""
 }
 
-//*** Editor Setup
+func editorRetab(cfg *EditorConfig, convert func(line string) string) {
+	if editorReadOnly(cfg) {
+		return
+	}
 
-func initEditor(fd int, oldState *State) (*EditorConfig, error) {
-	winSize, err := getWindowSize(fd)
-	if err != nil {
-		return nil, fmt.Errorf("getting window size: %w", err)
+	changed := 0
+	for i := range cfg.rows {
+		row := &cfg.rows[i]
+		line := convert(row.chars)
+		if line == row.chars {
+			continue
+		}
+
+		row.chars = line
+		row.size = len(row.chars)
+		editorUpdateRow(cfg, row)
+		changed++
 	}
 
-	config := EditorConfig{
-		origTermios: oldState,
-		winSize:     winSize,
+	if changed > 0 {
+		cfg.dirty = true
 	}
 
-	// We decrement config.winSize.Row so that editorDrawRows() doesn’t try to
-	// draw a line of text at the bottom of the screen
-	config.winSize.Row -= 2
+	if cfg.cursorY < cfg.numRows && cfg.cursorX > cfg.rows[cfg.cursorY].size {
+		cfg.cursorX = cfg.rows[cfg.cursorY].size
+	}
 
-	return &config, nil
+	editorSetStatusMessage(cfg, "Retabbed %d lines", changed)
 }
 
-func getCursorPosition() (rows, cols int) {
-	buf := make([]byte, 1)
-	// The n command (Device Status Report) can be used to query the
-	// terminal for status information. We want to give it an argument
-	// of 6 to ask for the cursor position.
-	os.Stdout.Write([]byte("\x1b[6n"))
-	var s bytes.Buffer
-	var b byte
+func expandTabs(line string, width int, leadingOnly bool) string {
+	var b strings.Builder
+	col := 0
+	leading := true
 
-	// Then we can read the reply from the standard input.
-	// expected structure: `\x1b[24;80R`
-	for b != 'R' {
-		_, err := os.Stdin.Read(buf)
-		if err != nil {
-			break
+	for _, r := range line {
+		if r != ' ' && r != '\t' {
+			leading = false
 		}
 
-		b = buf[0]
-		s.WriteByte(b)
-	}
+		if r == '\t' && (leading || !leadingOnly) {
+			n := width - col%width
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
 
-	// we want to skip the escape sequence byte
-	response := string(s.Bytes()[1 : s.Len()-1])
-	fmt.Sscanf(response, "[%d;%d", &rows, &cols)
+		b.WriteRune(r)
+		col += runeWidth(r)
+	}
 
-	return rows, cols
+	return b.String()
 }
 
-func getWindowSize(fd int) (*unix.Winsize, error) {
-	size, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
-	if err != nil {
-		// we are using the C [Cursor Forward] and B [Cursor Down]
-		// commands
-		os.Stdout.Write([]byte("\x1b[999C\x1b[999B"))
-		rows, cols := getCursorPosition()
-		size = &unix.Winsize{
-			Row: uint16(rows),
-			Col: uint16(cols),
+func compressSpaces(line string, width int, leadingOnly bool) string {
+	var b strings.Builder
+	col := 0
+	spaces := 0
+	leading := true
+
+	for _, r := range line {
+		convert := leading || !leadingOnly
+
+		switch r {
+		case ' ':
+			col++
+			spaces++
+			// outside the indentation a lone space is just a space, even
+			// when it happens to end on a tab stop
+			if col%width == 0 && convert && (leading || spaces > 1) {
+				b.WriteByte('\t')
+				spaces = 0
+			}
+		case '\t':
+			// the tab reaches the same stop with or without the spaces
+			// in front of it
+			if !convert {
+				b.WriteString(strings.Repeat(" ", spaces))
+			}
+			b.WriteByte('\t')
+			spaces = 0
+			col += width - col%width
+		default:
+			b.WriteString(strings.Repeat(" ", spaces))
+			spaces = 0
+			leading = false
+			b.WriteRune(r)
+			col++
 		}
-		return size, nil
-
 	}
-	return size, nil
+
+	b.WriteString(strings.Repeat(" ", spaces))
+
+	return b.String()
 }
 
-func enableRawMode(fd int) (*State, error) {
-	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
-	if err != nil {
-		return nil, err
+// editorToggleCursorLine turns the cursor line highlight on or off for the
+// rest of the session. The cursor_line setting picks the starting state
+func editorToggleCursorLine(cfg *EditorConfig, _ string) {
+	cfg.cursorLine = !cfg.cursorLine
+}
+
+// editorGoToCommand moves the cursor to the line, or line:col, in args
+func editorGoToCommand(cfg *EditorConfig, args string) {
+	lineArg, colArg, hasCol := strings.Cut(args, ":")
+	line, err := strconv.Atoi(strings.TrimSpace(lineArg))
+	col := 0
+	if err == nil && hasCol {
+		col, err = strconv.Atoi(strings.TrimSpace(colArg))
+	}
+	if err != nil || line < 1 || col < 0 {
+		editorCommandFailed(cfg, "Usage: goto <line>[:<col>]")
+		return
 	}
 
-	oldState := State{state{termios: *termios}}
+	editorGoTo(cfg, line, col)
+}
 
-	// This attempts to replicate the behaviour documented for cfmakeraw in
-	// the termios(3) manpage.
-	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
-	termios.Oflag &^= unix.OPOST
-	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
-	termios.Cflag &^= unix.CSIZE | unix.PARENB
-	termios.Cflag |= unix.CS8
-	termios.Cc[unix.VMIN] = 1
-	termios.Cc[unix.VTIME] = 0
-	if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, termios); err != nil {
-		return nil, err
+// editorGoToPrompt asks for a line, or line:col, to go to
+func editorGoToPrompt(cfg *EditorConfig) {
+	input, ok := editorPromptWith(cfg, "Go to line", promptOptions{history: "goto"})
+	if !ok || input == "" {
+		return
 	}
 
-	return &oldState, nil
+	editorGoToCommand(cfg, input)
 }
 
-func restore(fd int, state *State) error {
-	return unix.IoctlSetTermios(fd, ioctlWriteTermios, &state.termios)
+// editorToggleIndentGuides shows or hides the indent guides. The
+// indent_guides setting picks the starting state
+func editorToggleIndentGuides(cfg *EditorConfig, _ string) {
+	cfg.indentGuides = !cfg.indentGuides
 }
 
-func editorSetStatusMessage(cfg *EditorConfig, format string, args ...any) {
-	cfg.statusMsg = fmt.Sprintf(format, args...)
-	cfg.statusMsgTime = time.Now()
+// editorToggleEOL shows or hides the newline marks. The show_eol setting
+// picks the starting state
+func editorToggleEOL(cfg *EditorConfig, _ string) {
+	cfg.showEOL = !cfg.showEOL
 }
 
-// *** Utils
-func isControl(b byte) bool {
-	return b >= 0 && (b < 32 || b == 127)
+// editorToggleScrollbar shows or hides the scrollbar. The scrollbar setting
+// picks the starting state
+func editorToggleScrollbar(cfg *EditorConfig, _ string) {
+	cfg.scrollbar = !cfg.scrollbar
 }
 
-func die(err error) {
-	var buf bytes.Buffer
-	buf.Write([]byte("\x1b[2J"))
-	buf.Write([]byte("\x1b[H"))
-	os.Stdout.Write(buf.Bytes())
-	log.Print(err)
+// editorToggleGuide shows or hides the column guide. The guide setting
+// picks the starting state
+func editorToggleGuide(cfg *EditorConfig, _ string) {
+	cfg.guide = !cfg.guide
 }
 
-func isSeparator(c int32) int32 {
-	separators := ",.()+-/*=~%<>[];"
-	if c == SpaceBar || strings.Contains(separators, fmt.Sprintf("%c", c)) {
-		return c
+// editorStats reports the size of the selection, or of the whole buffer
+func editorStats(cfg *EditorConfig, _ string) {
+	text, ok := editorSelectedText(cfg)
+	what := "Selection"
+	lines := strings.Count(text, "\n") + 1
+	if !ok {
+		text = editorRowsToString(cfg)
+		what = "Buffer"
+		lines = cfg.numRows
 	}
-	return 0
+
+	editorSetStatusMessage(cfg, "%s: %d lines, %d words, %d characters, %d bytes",
+		what, lines, len(strings.Fields(text)), utf8.RuneCountInString(text), len(text))
 }
 
-// *** file i/o
+func editorUpperCase(cfg *EditorConfig, _ string) {
+	editorMapSelection(cfg, strings.ToUpper)
+}
 
-func editorOpen(config *EditorConfig, fileName string) error {
-	file, err := os.Open(fileName)
-	if err != nil {
-		return fmt.Errorf("opening file %s: %w", fileName, err)
-	}
-	defer file.Close()
+func editorLowerCase(cfg *EditorConfig, _ string) {
+	editorMapSelection(cfg, strings.ToLower)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimRight(line, "\r")
-		editorInsertRow(config, line, config.numRows)
-	}
+func editorTitleCase(cfg *EditorConfig, _ string) {
+	editorMapSelection(cfg, titleCase)
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("reading file: %w", err)
-	}
+// titleCase upper-cases the first letter of every word and lower-cases the
+// rest of it
+func titleCase(s string) string {
+	var b strings.Builder
+	inWord := false
 
-	config.fileName = fileName
+	for _, r := range s {
+		if inWord {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToTitle(r))
+		}
+		inWord = unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '\''
+	}
 
-	return nil
+	return b.String()
 }
 
-func editorRowsToString(cfg *EditorConfig) string {
-	var buf bytes.Buffer
-	for _, row := range cfg.rows {
-		buf.WriteString(row.chars)
-		buf.WriteByte('\n')
+// editorFilter pipes the selected lines, or the whole buffer, through a shell
+// command and replaces them with its output. The buffer is left alone if
+// the command fails
+func editorFilter(cfg *EditorConfig, args string) {
+	if editorReadOnly(cfg) {
+		return
 	}
 
-	return buf.String()
-}
+	command := args
+	if command == "" {
+		var ok bool
+		command, ok = editorPromptWith(cfg, "Filter through", promptOptions{history: "filter"})
+		if !ok {
+			return
+		}
 
-func editorSave(cfg *EditorConfig) {
-	if cfg.fileName == "" {
-		cfg.fileName = editorPrompt(cfg, "Save as")
-		if cfg.fileName == "" {
-			editorSetStatusMessage(cfg, "Save aborted")
+		if command == "" {
+			editorCommandFailed(cfg, "Filter aborted: no command given")
 			return
 		}
 	}
 
-	contents := editorRowsToString(cfg)
-	err := os.WriteFile(cfg.fileName, []byte(contents), 0644)
+	start, end := 0, cfg.numRows-1
+	if startY, _, endY, _, ok := editorSelection(cfg); ok {
+		start, end = startY, endY
+	}
+
+	var input strings.Builder
+	for y := start; y <= end; y++ {
+		input.WriteString(cfg.rows[y].chars)
+		input.WriteByte('\n')
+	}
 
+	output, err := runShellFilter(command, input.String())
 	if err != nil {
-		editorSetStatusMessage(cfg, "Can't save! I/O error: %s", err.Error())
+		editorCommandFailed(cfg, "Filter failed: %s", err.Error())
 		return
 	}
 
-	editorSetStatusMessage(cfg, "%d bytes written to disk", len(contents))
-	cfg.dirty = false
+	editorReplaceRows(cfg, start, end, splitLines(output))
+	cfg.selecting = false
+	editorSetStatusMessage(cfg, "Filtered %d lines through %s", end-start+1, command)
 }
 
-func editorFindCallback(cfg *EditorConfig, query string) {
-	if len(savedHL) > 0 {
-		cfg.rows[savedHLLine].hl = savedHL
-		savedHL = []uint8{}
+// runShellFilter runs command through sh with input on its stdin and returns
+// what it printed. When the command fails the error carries the first line
+// of its stderr, if it wrote any
+func runShellFilter(command, input string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		if msg == "" {
+			return "", err
+		}
+		return "", errors.New(msg)
 	}
 
-	if query == "" {
-		return
-	}
+	return stdout.String(), nil
+}
 
-	if lastMatch == -1 {
-		direction = 1
+// splitLines breaks command output into rows. The final newline ends the
+// last row rather than starting an empty one
+func splitLines(output string) []string {
+	if output == "" {
+		return nil
 	}
 
-	current := lastMatch
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
 
-	for range cfg.numRows {
-		current += direction
-		if current == -1 {
-			current = cfg.numRows - 1
-		} else if current == cfg.numRows {
-			current = 0
+/** Syntax Highlighting */
+
+// editorUpdateSyntax colors row.render by the current syntax. Files
+// without one still get their numbers colored, as they always have
+func editorUpdateSyntax(cfg *EditorConfig, row *eRow) {
+	// we do not need to do memset because we created the Go slice with a length
+	// which will initialise all values to the zero value
+
+	flags := HL_HIGHLIGHT_NUMBERS
+	var keywords []string
+	comment, blockStart, blockEnd := "", "", ""
+	if cfg.syntax != nil {
+		flags = cfg.syntax.flags
+		keywords = cfg.syntax.keywords
+		comment = cfg.syntax.singleLineComment
+		if flags&HL_HIGHLIGHT_COMMENTS != 0 {
+			blockStart, blockEnd = cfg.syntax.multiLineCommentStart, cfg.syntax.multiLineCommentEnd
+		}
+	}
+	inComment := row.hlInComment && blockStart != ""
+
+	render := row.render
+	prevSep := true
+	// the quote that opened the string we are in, if any
+	var quote byte
+	i := 0
+	if flags&HL_HIGHLIGHT_KEYS != 0 {
+		if start, end, ok := keySpan(render); ok {
+			fillHL(row.hl[start:end], HL_KEY)
+			i = end
+		}
+	}
+	if flags&HL_HIGHLIGHT_TARGETS != 0 {
+		if end, ok := targetEnd(render); ok {
+			fillHL(row.hl[:end], HL_KEY)
+			i = end
+		}
+	}
+	for i < len(render) {
+		if inComment {
+			end := strings.Index(render[i:], blockEnd)
+			if end < 0 {
+				fillHL(row.hl[i:], HL_COMMENT)
+				break
+			}
+			fillHL(row.hl[i:i+end+len(blockEnd)], HL_COMMENT)
+			i += end + len(blockEnd)
+			inComment = false
+			prevSep = true
+			continue
 		}
 
-		row := &cfg.rows[current]
-		if strings.Contains(row.render, query) {
-			cfg.cursorY = current
-			lastMatch = current
-			savedHLLine = current
-			savedHL = make([]uint8, len(row.hl))
-			copy(savedHL, row.hl)
+		r, size := utf8.DecodeRuneInString(render[i:])
+		prevHL := HL_NORMAL
+		if i > 0 {
+			prevHL = row.hl[i-1]
+		}
 
-			index := strings.Index(row.render, query)
-			for i := range query {
-				row.hl[index+i] = HL_MATCH
+		// variables are expanded inside double quotes but not single ones
+		if flags&HL_HIGHLIGHT_VARIABLES != 0 && quote != '\'' && r == '$' {
+			if n := variableLength(render[i:]); n > 0 {
+				fillHL(row.hl[i:i+n], HL_VARIABLE)
+				i += n
+				prevSep = false
+				continue
+			}
+		}
+		if flags&HL_HIGHLIGHT_MAKE_VARIABLES != 0 && r == '$' {
+			if n := makeVariableLength(render[i:]); n > 0 {
+				fillHL(row.hl[i:i+n], HL_VARIABLE)
+				i += n
+				prevSep = false
+				continue
+			}
+		}
+
+		if quote != 0 {
+			fillHL(row.hl[i:i+size], HL_STRING)
+			if r == '\\' && i+size < len(render) {
+				size = escapeLength(render[i:])
+				fillHL(row.hl[i:i+size], HL_STRING_ESCAPE)
+			} else if r == rune(quote) {
+				quote = 0
 			}
-			cfg.cursorX = editorRowXToCursorX(*row, index+len(query)-1)
-			cfg.rowOff = cfg.numRows
+			i += size
+			prevSep = true
+			continue
+		}
 
+		if flags&HL_HIGHLIGHT_COMMENTS != 0 && comment != "" && strings.HasPrefix(render[i:], comment) {
+			fillHL(row.hl[i:], HL_COMMENT)
 			break
 		}
+		if blockStart != "" && strings.HasPrefix(render[i:], blockStart) {
+			fillHL(row.hl[i:i+len(blockStart)], HL_COMMENT)
+			i += len(blockStart)
+			inComment = true
+			continue
+		}
+
+		// a quote inside a word, like the one in don't, is no string
+		if flags&HL_HIGHLIGHT_STRINGS != 0 && prevSep && (r == '"' || r == '\'') {
+			quote = byte(r)
+			row.hl[i] = HL_STRING
+			i++
+			continue
+		}
+
+		if flags&HL_HIGHLIGHT_NUMBERS != 0 &&
+			(unicode.IsDigit(r) && (prevSep || prevHL == HL_NUMBER) || r == '.' && prevHL == HL_NUMBER) {
+			fillHL(row.hl[i:i+size], HL_NUMBER)
+			i += size
+			prevSep = false
+			continue
+		}
+
+		if prevSep {
+			if keyword := keywordAt(render[i:], keywords); keyword != "" {
+				fillHL(row.hl[i:i+len(keyword)], HL_KEYWORD)
+				i += len(keyword)
+				prevSep = false
+				continue
+			}
+		}
+
+		prevSep = isSeparator(r) != 0
+		i += size
 	}
+
+	row.hlOpenComment = inComment
 }
 
-func editorSearch(cfg *EditorConfig) {
-	savedCursorX := cfg.cursorX
-	savedCursorY := cfg.cursorY
-	savedColOff := cfg.colOff
-	savedRowOff := cfg.rowOff
+// editorSyncHighlight brings the highlighting of the rows before end up to
+// date with the block comments opened and closed above them. An edit only
+// highlights its own row, so a row that started out inside a comment, or
+// outside one, and now doesn't is highlighted again, which can carry on
+// down until a row ends as it did before. Rows from end on wait until they
+// are drawn, so opening a comment near the top of a big file costs a screen
+// of rows rather than the rest of the file
+func editorSyncHighlight(cfg *EditorConfig, end int) {
+	end = min(end, cfg.numRows)
+	start := 0
+	if cfg.hlSyncedEdits == cfg.edits {
+		start = min(cfg.hlSynced, end)
+	}
 
-	r := editorPrompt(cfg, "Search: %s (Use ESC/Arrows/Enter)", func(query string, key int) {
-		if key == ARROW_RIGHT || key == ARROW_DOWN {
-			direction = 1
-		} else if key == ARROW_UP || key == ARROW_LEFT {
-			direction = -1
-		} else {
-			direction = 1
-			lastMatch = -1
+	for y := start; y < end; y++ {
+		row := &cfg.rows[y]
+		inComment := y > 0 && cfg.rows[y-1].hlOpenComment
+		if row.hlInComment == inComment {
+			continue
 		}
-		editorFindCallback(cfg, query)
-	})
 
-	if r == "" {
-		cfg.cursorX = savedCursorX
-		cfg.cursorY = savedCursorY
-		cfg.colOff = savedColOff
-		cfg.rowOff = savedRowOff
-		editorFindCallback(cfg, r)
-	} else {
-		lastMatch = -1
+		row.hlInComment = inComment
+		editorRehighlightRow(cfg, row)
 	}
 
+	if cfg.hlSyncedEdits != cfg.edits || end > cfg.hlSynced {
+		cfg.hlSynced = end
+	}
+	cfg.hlSyncedEdits = cfg.edits
 }
 
-func editorPrompt(cfg *EditorConfig, prompt string, cb ...callback) string {
-	var buf strings.Builder
+// editorRehighlightRow highlights row again as it is, keeping the marks on
+// its control characters, which come from rendering rather than syntax
+func editorRehighlightRow(cfg *EditorConfig, row *eRow) {
+	var controls []int
+	for i, hl := range row.hl {
+		if hl == HL_CONTROL {
+			controls = append(controls, i)
+		}
+	}
 
-	var fn callback = nil
+	clear(row.hl)
+	editorUpdateSyntax(cfg, row)
+	for _, i := range controls {
+		row.hl[i] = HL_CONTROL
+	}
+}
 
-	if len(cb) > 0 {
-		fn = cb[0]
+// escapeLength returns how many bytes the backslash escape s starts with
+// takes: \x and two hex digits, \u and four, \U and eight, up to three octal
+// digits, or else the backslash and one character
+func escapeLength(s string) int {
+	digit := func(c byte) bool { return strings.IndexByte("0123456789abcdefABCDEF", c) >= 0 }
+	start, digits := 2, 0
+	switch s[1] {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		start, digits = 1, 3
+		digit = func(c byte) bool { return c >= '0' && c <= '7' }
+	default:
+		_, size := utf8.DecodeRuneInString(s[1:])
+		return 1 + size
 	}
 
-	for {
-		editorSetStatusMessage(cfg, "%s: Press esc to exit: %s", prompt, buf.String())
-		editorRefreshScreen(cfg)
+	n := start
+	for n < len(s) && n < start+digits && digit(s[n]) {
+		n++
+	}
 
-		c, err := editorReadKey()
-		if err != nil {
+	return n
+}
+
+func fillHL(hl []uint8, color uint8) {
+	for i := range hl {
+		hl[i] = color
+	}
+}
+
+// keywordAt returns the keyword s starts with, if it stands alone there
+func keywordAt(s string, keywords []string) string {
+	for _, keyword := range keywords {
+		if !strings.HasPrefix(s, keyword) {
 			continue
 		}
+		if len(s) == len(keyword) || isSeparator(rune(s[len(keyword)])) != 0 {
+			return keyword
+		}
+	}
 
-		if c == ENTER {
-			if buf.String() != "" {
-				editorSetStatusMessage(cfg, "%s", "")
-				return buf.String()
+	return ""
+}
+
+// keySpan finds the key of a "key: value" line, after any indentation and
+// list item dashes. A # before the colon starts a comment, not a key
+func keySpan(line string) (start, end int, ok bool) {
+	start = len(line) - len(strings.TrimLeft(line, " "))
+	for strings.HasPrefix(line[start:], "- ") || line[start:] == "-" {
+		start += 1 + len(line[start+1:]) - len(strings.TrimLeft(line[start+1:], " "))
+	}
+
+	var quote byte
+	for end = start; end < len(line); end++ {
+		c := line[end]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
 			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (end == start || line[end-1] == ' '):
+			return 0, 0, false
+		case c == ':' && (end+1 == len(line) || line[end+1] == ' '):
+			return start, end, end > start
 		}
+	}
 
-		if c == Esc {
-			return ""
-		}
+	return 0, 0, false
+}
 
-		if c == BACKSPACE && buf.String() != "" {
-			current := buf.String()
-			buf.Reset()
-			buf.WriteString(current[:len(current)-1])
-			fn(buf.String(), c)
-			continue
-		}
+// targetEnd finds where the targets of a Makefile rule line end, at its
+// colon. Lines that start indented or assign a variable, even with :=, are
+// not rules
+func targetEnd(line string) (int, bool) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+		return 0, false
+	}
 
-		if isControl(byte(c)) {
-			continue
+	// colons and equals signs inside $(...) don't count
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '(' || c == '{':
+			depth++
+		case c == ')' || c == '}':
+			depth--
+		case depth > 0:
+		case c == '=' || c == '#':
+			return 0, false
+		case c == ':':
+			if rest := strings.TrimLeft(line[i:], ":"); strings.HasPrefix(rest, "=") {
+				return 0, false
+			}
+			return i, i > 0
 		}
+	}
 
-		buf.WriteRune(rune(c))
+	return 0, false
+}
+
+// makeVariableLength returns how many bytes of the Makefile variable
+// reference s starts with there are: $(NAME), ${NAME} or one character
+// such as $@. It is 0 when the $ doesn't start one
+func makeVariableLength(s string) int {
+	if len(s) < 2 || s[1] == ' ' {
+		return 0
+	}
+	if s[1] != '(' && s[1] != '{' {
+		return 2
+	}
 
-		fn(buf.String(), c)
+	depth := 0
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
 	}
+
+	return len(s)
 }
 
-/** Syntax Highlighting */
+// variableLength returns how many bytes of the variable reference s starts
+// with there are: $NAME, ${...} or a special parameter such as $1 or $?.
+// It is 0 when the $ doesn't start one
+func variableLength(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
 
-func editorUpdateSyntax(row *eRow) {
-	// we do not need to do memset because we created the Go slice with a length
-	// which will initialise all values to the zero value
+	switch c := s[1]; {
+	case c == '{':
+		if end := strings.IndexByte(s, '}'); end >= 0 {
+			return end + 1
+		}
+		return len(s)
+	case c >= '0' && c <= '9' || strings.IndexByte("@*#?$!-", c) >= 0:
+		return 2
+	case c < utf8.RuneSelf && isWordByte(c):
+		n := 2
+		for n < len(s) && s[n] < utf8.RuneSelf && isWordByte(s[n]) {
+			n++
+		}
+		return n
+	}
 
-	prevSep := int32(1)
-	for i, r := range row.render {
-		prevHL := HL_NORMAL
-		if i > 0 {
-			prevHL = row.hl[i-1]
+	return 0
+}
+
+// editorSelectSyntaxHighlight picks the first HL_DB entry with a fileMatch
+// pattern that matches the current file name, and colors the rows again when that changes it
+func editorSelectSyntaxHighlight(cfg *EditorConfig) {
+	prev := cfg.syntax
+	cfg.syntax = nil
+	name := filepath.Base(cfg.fileName)
+	for i := range HL_DB {
+		if slices.ContainsFunc(HL_DB[i].fileMatch, func(pattern string) bool {
+			return fileMatches(pattern, name)
+		}) {
+			cfg.syntax = &HL_DB[i]
+			break
 		}
+	}
 
-		if unicode.IsDigit(r) && (prevSep != 0 || prevHL == HL_NUMBER) || r == '.' && prevHL == HL_NUMBER {
-			row.hl[i] = HL_NUMBER
-			prevSep = 0
-			continue
+	if cfg.syntax != prev {
+		for i := range cfg.rows {
+			editorUpdateRow(cfg, &cfg.rows[i])
+		}
+		if err := editorApplyFileTypeSettings(cfg); err != nil {
+			editorSetStatusMessage(cfg, "Ignoring .kilorc: %s", err.Error())
+		} else {
+			editorCheckMixedIndent(cfg)
+		}
+	}
+}
+
+// editorSetSyntax switches to the HL_DB entry for fileType, and colors the
+// rows again. It reports false, leaving the syntax alone, if there is none
+func editorSetSyntax(cfg *EditorConfig, fileType string) bool {
+	i := slices.IndexFunc(HL_DB, func(s editorSyntax) bool { return s.fileType == fileType })
+	if i < 0 {
+		return false
+	}
+
+	if cfg.syntax != &HL_DB[i] {
+		cfg.syntax = &HL_DB[i]
+		for i := range cfg.rows {
+			editorUpdateRow(cfg, &cfg.rows[i])
+		}
+		if err := editorApplyFileTypeSettings(cfg); err != nil {
+			editorSetStatusMessage(cfg, "Ignoring .kilorc: %s", err.Error())
+		} else {
+			editorCheckMixedIndent(cfg)
 		}
+	}
+
+	return true
+}
 
-		prevSep = isSeparator(r)
+// fileMatches reports whether the base name of a file matches a fileMatch
+// pattern, which is one of
+//
+//	.go         an extension, or the whole name of a dotfile like .bashrc
+//	Dockerfile  the whole name
+//	*.mk        a glob, as understood by filepath.Match, over the whole name
+func fileMatches(pattern, name string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := filepath.Match(pattern, name)
+		return ok
 	}
+	if strings.HasPrefix(pattern, ".") && filepath.Ext(name) == pattern {
+		return true
+	}
+
+	return name == pattern
 }
 
-func editorSyntaxToColor(hl uint8) uint8 {
+func editorSyntaxToColor(cfg *EditorConfig, hl uint8) uint8 {
+	if color, ok := cfg.colors[hl]; ok {
+		return color
+	}
+
 	switch hl {
 	case HL_NUMBER:
 		return ColorRed
 	case HL_MATCH:
 		return ColorBlue
+	case HL_ERROR:
+		return ColorMagenta
+	case HL_WORD:
+		return ColorCyan
+	case HL_COMMENT:
+		return ColorBrightBlack
+	case HL_KEYWORD:
+		return ColorYellow
+	case HL_STRING:
+		return ColorGreen
+	case HL_VARIABLE:
+		return ColorBrightBlue
+	case HL_KEY:
+		return ColorBrightCyan
+	case HL_STRING_ESCAPE:
+		return ColorBrightMagenta
 	default:
 		return ColorWhite
 	}
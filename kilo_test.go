@@ -0,0 +1,3913 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// newTestEditor is an editor on a 24x80 screen that draws to /dev/null and
+// reads its keys from input, holding a row for each of lines
+func newTestEditor(t testing.TB, input string, lines ...string) *EditorConfig {
+	t.Helper()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { devNull.Close() })
+
+	cfg := newEditor()
+	cfg.winSize = &unix.Winsize{Row: 24, Col: 80}
+	cfg.in, cfg.out = devNull, devNull
+	cfg.reader = bufio.NewReader(strings.NewReader(input))
+	for i, line := range lines {
+		editorInsertRow(cfg, line, i)
+	}
+
+	return cfg
+}
+
+// pressKeys processes keys until the input runs out
+func pressKeys(t *testing.T, cfg *EditorConfig) {
+	t.Helper()
+
+	for {
+		if _, err := cfg.reader.Peek(1); err != nil {
+			return
+		}
+		if err := editorProcessKeyPress(cfg); err != nil {
+			t.Fatalf("processing keys: %v", err)
+		}
+	}
+}
+
+// rowsOf is the text of every row of the buffer
+func rowsOf(cfg *EditorConfig) []string {
+	rows := make([]string, 0, cfg.numRows)
+	for _, row := range cfg.rows {
+		rows = append(rows, row.chars)
+	}
+
+	return rows
+}
+
+func assertRows(t *testing.T, cfg *EditorConfig, want ...string) {
+	t.Helper()
+
+	got := rowsOf(cfg)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") || len(got) != len(want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+}
+
+func TestWriteStdoutSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	cfg := newTestEditor(t, "", "first", "second")
+	cfg.writeStdout = true
+	editorSetFileName(cfg, path)
+	cfg.dirty = true
+
+	editorSave(cfg)
+
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("save with -write-stdout touched %s: %v", path, err)
+	}
+	if cfg.dirty {
+		t.Error("buffer still dirty after save")
+	}
+
+	// quitting writes the buffer, and nothing of the screen, to stdout
+	screen, err := os.Create(filepath.Join(t.TempDir(), "screen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = screen
+	cfg.origTermios = &State{}
+	var stdout bytes.Buffer
+	if err := editorExit(cfg, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "first\nsecond\n" {
+		t.Errorf("stdout = %q, want only the buffer", stdout.String())
+	}
+
+	// and says so when it can't, as when the pipe has gone
+	closed, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if err := editorExit(cfg, closed); err == nil {
+		t.Error("writing to a closed stdout succeeded")
+	}
+}
+
+func TestRetab(t *testing.T) {
+	lines := []string{"\tone", "        two", "  \tthree", "x\ty"}
+	spaces := strings.Repeat(" ", KILO_TAB_STOP)
+
+	cfg := newTestEditor(t, "", lines...)
+	editorTabsToSpaces(cfg, "")
+	assertRows(t, cfg, spaces+"one", spaces+"two", spaces+"three", "x\ty")
+
+	cfg = newTestEditor(t, "", lines...)
+	editorSpacesToTabs(cfg, "")
+	assertRows(t, cfg, "\tone", "\ttwo", "\tthree", "x\ty")
+
+	cfg = newTestEditor(t, "", lines...)
+	editorTabsToSpaces(cfg, "all")
+	assertRows(t, cfg, spaces+"one", spaces+"two", spaces+"three", "x"+spaces[1:]+"y")
+}
+
+func TestJoinLines(t *testing.T) {
+	tests := []struct {
+		name string
+		rc   string
+		want string
+	}{
+		{"default", "", "first second"},
+		{"quoted", `join_separator = ", "`, "first, second"},
+		{"empty", "join_separator =", "firstsecond"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", "first", "    second", "third")
+			rc, err := parseRC(strings.NewReader(tt.rc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.rc = rc
+			if err := editorApplySettings(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			editorJoinLines(cfg)
+
+			assertRows(t, cfg, tt.want, "third")
+			if cfg.cursorX != len("first") {
+				t.Errorf("cursorX = %d, want the join point %d", cfg.cursorX, len("first"))
+			}
+		})
+	}
+}
+
+func TestProjectRC(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("home/.kilorc", "tab_width = 8\nguide = true\n[go]\nformat = gofmt\n")
+	write("home/code/project/.kilorc", "tab_width = 2\n[go]\nformat = goimports\nlsp = ./evil\n")
+	write("home/code/project/.git/HEAD", "ref: refs/heads/main\n")
+	write("home/code/project/cmd/tool/main.go", "package main\n")
+	// above the project's root, so not the project's
+	write("home/code/.kilorc", "guide = false\n")
+	home := filepath.Join(root, "home")
+
+	tests := []struct {
+		name string
+		dir  string
+		want map[string]string
+	}{
+		// the project's settings win, the user's fill in the rest, but
+		// its commands are ignored
+		{"in project", "home/code/project/cmd/tool", map[string]string{"tab_width": "2", "guide": "true", "format": "gofmt", "lsp": ""}},
+		{"project root", "home/code/project", map[string]string{"tab_width": "2", "guide": "true", "format": "gofmt", "lsp": ""}},
+		// home's own .kilorc is only read as the user's
+		{"home", "home", map[string]string{"tab_width": "8", "guide": "true", "format": "gofmt", "lsp": ""}},
+	}
+
+	check := func(name, dir string, want map[string]string) {
+		t.Helper()
+		rc, err := loadRCFiles(home, filepath.Join(root, dir))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := map[string]string{"tab_width": rc.get("", "tab_width"), "guide": rc.get("", "guide"), "format": rc.get("go", "format"), "lsp": rc.get("go", "lsp")}
+		if !maps.Equal(got, want) {
+			t.Errorf("%s: settings %v, want %v", name, got, want)
+		}
+	}
+	for _, tt := range tests {
+		check(tt.name, tt.dir, tt.want)
+	}
+
+	// unless the user trusts it
+	write("home/.kilorc", "tab_width = 8\nguide = true\ntrusted_projects = /elsewhere, ~/code\n[go]\nformat = gofmt\n")
+	check("trusted", "home/code/project/cmd/tool", map[string]string{"tab_width": "2", "guide": "true", "format": "goimports", "lsp": "./evil"})
+	write("home/.kilorc", "tab_width = 8\nguide = true\ntrusted_projects = ~/code/proj\n[go]\nformat = gofmt\n")
+	check("prefix of the name", "home/code/project", map[string]string{"tab_width": "2", "guide": "true", "format": "gofmt", "lsp": ""})
+
+	// outside home, a .kilorc above a directory without .git is nobody's
+	// project, as in a shared /tmp
+	write("tmp/.kilorc", "tab_width = 3\n")
+	write("tmp/x/notes.txt", "hi\n")
+	check("shared directory", "tmp/x", map[string]string{"tab_width": "8", "guide": "true", "format": "gofmt", "lsp": ""})
+
+	// nor is one somebody else put there
+	if os.Getuid() == 0 {
+		if err := os.Chown(filepath.Join(root, "home/code/project/.kilorc"), 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		check("not owned", "home/code/project", map[string]string{"tab_width": "8", "guide": "true", "format": "gofmt", "lsp": ""})
+	}
+
+	// and the user can turn the project's off
+	write("home/.kilorc", "tab_width = 8\nproject_rc = false\n")
+	rc, err := loadRCFiles(home, filepath.Join(root, "home/code/project"))
+	if err != nil || rc.get("", "tab_width") != "8" {
+		t.Errorf("with project_rc off, tab_width = %q, %v, want 8", rc.get("", "tab_width"), err)
+	}
+}
+
+func TestCaseTransforms(t *testing.T) {
+	transforms := []struct {
+		name      string
+		transform editorCommand
+		word      string
+		selection []string
+	}{
+		{"upper", editorUpperCase, "say HELLO there", []string{"one TWO THREE", "FOUR five"}},
+		{"lower", editorLowerCase, "say hello there", []string{"one two three", "four five"}},
+		{"title", editorTitleCase, "say Hello there", []string{"one Two Three", "Four five"}},
+	}
+
+	for _, tt := range transforms {
+		t.Run(tt.name+" word", func(t *testing.T) {
+			cfg := newTestEditor(t, "", "say hElLo there")
+			cfg.cursorX = 6
+			tt.transform(cfg, "")
+			assertRows(t, cfg, tt.word)
+		})
+
+		t.Run(tt.name+" selection", func(t *testing.T) {
+			cfg := newTestEditor(t, "", "one tWo three", "fOUr five")
+			cfg.selecting = true
+			cfg.anchorY, cfg.anchorX = 0, 4
+			cfg.cursorY, cfg.cursorX = 1, 4
+			tt.transform(cfg, "")
+			assertRows(t, cfg, tt.selection...)
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cfg := newTestEditor(t, "", "keep", "shout this", "and this", "keep")
+	cfg.selecting = true
+	cfg.anchorY, cfg.cursorY = 1, 2
+
+	editorFilter(cfg, "tr a-z A-Z")
+
+	assertRows(t, cfg, "keep", "SHOUT THIS", "AND THIS", "keep")
+	if !cfg.dirty {
+		t.Error("buffer not dirty after filtering")
+	}
+}
+
+func TestFormatOnSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	cfg := newTestEditor(t, "", "package main", "func main() {}")
+	cfg.rc = rcConfig{"go": {"format": "tr a-z A-Z"}}
+	editorSetFileName(cfg, path)
+	editorSelectSyntaxHighlight(cfg)
+
+	editorSave(cfg)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PACKAGE MAIN\nFUNC MAIN() {}\n"; string(data) != want {
+		t.Errorf("saved %q, want %q", data, want)
+	}
+	assertRows(t, cfg, "PACKAGE MAIN", "FUNC MAIN() {}")
+}
+
+func TestFormatOnSaveFailing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	cfg := newTestEditor(t, "", "package main")
+	cfg.rc = rcConfig{"go": {"format": "false"}}
+	editorSetFileName(cfg, path)
+	editorSelectSyntaxHighlight(cfg)
+
+	editorSave(cfg)
+
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a failed format still saved: %v", err)
+	}
+	assertRows(t, cfg, "package main")
+}
+
+func TestPromptCompletesPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"notes.txt", "main.go", "main_test.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// relative paths keep the test's directory name out of the typing
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	cfg := newTestEditor(t, "no\t\r")
+	got, ok := editorPromptWith(cfg, "Save as", promptOptions{complete: completePath})
+	if !ok || got != "notes.txt" {
+		t.Errorf("prompt = %q, %v, want %q", got, ok, "notes.txt")
+	}
+
+	// two matches only go as far as they agree
+	cfg = newTestEditor(t, "ma\t\r")
+	got, _ = editorPromptWith(cfg, "Save as", promptOptions{complete: completePath})
+	if got != "main" {
+		t.Errorf("prompt = %q, want the common prefix %q", got, "main")
+	}
+}
+
+func TestPromptHistory(t *testing.T) {
+	cfg := newTestEditor(t, "first\rsecond\r\x1b[A\x1b[A\r", "first line", "second line")
+	opts := promptOptions{history: "search"}
+
+	for _, want := range []string{"first", "second", "first"} {
+		got, ok := editorPromptWith(cfg, "Search", opts)
+		if !ok || got != want {
+			t.Errorf("prompt = %q, %v, want %q", got, ok, want)
+		}
+	}
+}
+
+func TestPromptWithoutCallback(t *testing.T) {
+	cfg := newTestEditor(t, "ab\x7f\x7f\x7fcd\x7fe\r")
+
+	got, ok := editorPrompt(cfg, "Name")
+	if !ok || got != "ce" {
+		t.Errorf("prompt = %q, %v, want %q", got, ok, "ce")
+	}
+
+	// Backspace takes a whole character, not the last byte of é
+	cfg = newTestEditor(t, "caf\u00e9\x7f\x7fe\r")
+	got, ok = editorPrompt(cfg, "Name")
+	if !ok || got != "cae" {
+		t.Errorf("prompt = %q, %v, want %q", got, ok, "cae")
+	}
+}
+
+func TestPromptEmptyAndCancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		wantOK bool
+	}{
+		{"empty", "\r", true},
+		{"typed then emptied", "a\x7f\r", true},
+		{"escape", "abc\x1b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, tt.input)
+			got, ok := editorPrompt(cfg, "Name")
+			if got != "" || ok != tt.wantOK {
+				t.Errorf("prompt = %q, %v, want \"\", %v", got, ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPromptCancelIsNotEmpty(t *testing.T) {
+	callers := []struct {
+		name   string
+		run    func(cfg *EditorConfig)
+		cancel string
+		empty  string
+	}{
+		{"save as", editorSave, "Save aborted", "Save aborted: no file name given"},
+		{"filter", func(cfg *EditorConfig) { editorFilter(cfg, "") }, "", "Filter aborted: no command given"},
+		{"command", func(cfg *EditorConfig) { editorCommandPrompt(cfg) }, "", "No command given"},
+	}
+
+	for _, tt := range callers {
+		t.Run(tt.name+" cancelled", func(t *testing.T) {
+			cfg := newTestEditor(t, "\x1b", "text")
+			tt.run(cfg)
+			if cfg.statusMsg == tt.empty {
+				t.Errorf("cancelling reads as empty input: %q", cfg.statusMsg)
+			}
+			if tt.cancel != "" && cfg.statusMsg != tt.cancel {
+				t.Errorf("status = %q, want %q", cfg.statusMsg, tt.cancel)
+			}
+		})
+
+		t.Run(tt.name+" empty", func(t *testing.T) {
+			cfg := newTestEditor(t, "\r", "text")
+			tt.run(cfg)
+			if cfg.statusMsg != tt.empty {
+				t.Errorf("status = %q, want %q", cfg.statusMsg, tt.empty)
+			}
+		})
+	}
+}
+
+func TestParseCursorPosition(t *testing.T) {
+	tests := []struct {
+		response   string
+		rows, cols int
+		ok         bool
+	}{
+		{"\x1b[24;80R", 24, 80, true},
+		{"[24;80R", 24, 80, true},
+		{"\x1b[24;80", 24, 80, true},
+		{"\x1b[24R", 0, 0, false},
+		{"\x1b[0;80R", 0, 0, false},
+		{"\x1b[a;bR", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		rows, cols, err := parseCursorPosition(tt.response)
+		if (err == nil) != tt.ok || rows != tt.rows || cols != tt.cols {
+			t.Errorf("parseCursorPosition(%q) = %d, %d, %v", tt.response, rows, cols, err)
+		}
+	}
+}
+
+func TestGetCursorPositionSlowReply(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	// the reply arrives in pieces, as it can over a slow link
+	go func() {
+		for _, part := range []string{"\x1b[", "24;", "80", "R"} {
+			w.WriteString(part)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	rows, cols, err := getCursorPosition(r, devNull)
+	if err != nil || rows != 24 || cols != 80 {
+		t.Errorf("getCursorPosition = %d, %d, %v, want 24, 80", rows, cols, err)
+	}
+}
+
+// decodeEscape decodes seq as if it had followed an Esc
+func decodeEscape(seq string) (key int, rest string) {
+	reader := bufio.NewReader(strings.NewReader(seq))
+	key = editorDecodeEscape(reader)
+	left, _ := io.ReadAll(reader)
+
+	return key, string(left)
+}
+
+func TestDecodeEscape(t *testing.T) {
+	tests := []struct {
+		seq  string
+		key  int
+		rest string
+	}{
+		{"[A", ARROW_UP, ""},
+		{"[B", ARROW_DOWN, ""},
+		{"[C", ARROW_RIGHT, ""},
+		{"[D", ARROW_LEFT, ""},
+		{"OA", ARROW_UP, ""},
+		{"[3~", DEL_KEY, ""},
+		{"[3~x", DEL_KEY, "x"},
+
+		// unknown or cut short sequences are a plain Esc
+		{"[99~", Esc, ""},
+		{"[", Esc, ""},
+		{"[12", Esc, ""},
+		{"OZ", Esc, ""},
+
+		// a runaway sequence is given up on after 16 parameter bytes
+		{"[" + strings.Repeat("1", 20) + "~", Esc, "111~"},
+
+		// Alt sends an Esc before the key
+		{"x", ALT_KEY | 'x', ""},
+		{"X1", ALT_KEY | 'X', "1"},
+		{"\u00e9", ALT_KEY | '\u00e9', ""},
+
+		// not a sequence, so the byte is left for the next key
+		{"\x1b[A", Esc, "\x1b[A"},
+		{"\r", Esc, "\r"},
+		{"", Esc, ""},
+	}
+
+	for _, tt := range tests {
+		key, rest := decodeEscape(tt.seq)
+		if key != tt.key || rest != tt.rest {
+			t.Errorf("Esc %q = %d, rest %q, want %d, rest %q", tt.seq, key, rest, tt.key, tt.rest)
+		}
+	}
+}
+
+func TestBareEsc(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cfg := newTestEditor(t, "")
+	cfg.in, cfg.reader = r, bufio.NewReader(r)
+
+	// nothing follows the Esc, so it isn't kept waiting for a sequence
+	w.WriteString("\x1b")
+	if key, err := editorReadKey(cfg); key != Esc || err != nil {
+		t.Errorf("bare Esc read as %d, %v, want Esc", key, err)
+	}
+
+	w.WriteString("\x1bx")
+	if key, err := editorReadKey(cfg); key != ALT_KEY|'x' || err != nil {
+		t.Errorf("Alt-x read as %d, %v, want ALT_KEY|'x'", key, err)
+	}
+
+	// the rest of a sequence arriving a moment later still belongs to it
+	go func() {
+		w.WriteString("\x1b")
+		time.Sleep(KILO_ESC_TIMEOUT / 5)
+		w.WriteString("[A")
+	}()
+	if key, err := editorReadKey(cfg); key != ARROW_UP || err != nil {
+		t.Errorf("split up arrow read as %d, %v, want ARROW_UP", key, err)
+	}
+}
+
+func TestDecodeTerminalVariants(t *testing.T) {
+	variants := map[int][]string{
+		HOME_KEY:  {"[1~", "[7~", "[H", "OH"},
+		END_KEY:   {"[4~", "[8~", "[F", "OF"},
+		PAGE_UP:   {"[5~", "[5;5~"},
+		PAGE_DOWN: {"[6~", "[6;5~"},
+	}
+
+	for want, seqs := range variants {
+		for _, seq := range seqs {
+			if key, _ := decodeEscape(seq); key != want {
+				t.Errorf("Esc %q = %d, want %d", seq, key, want)
+			}
+		}
+	}
+}
+
+func TestDecodeShiftArrows(t *testing.T) {
+	tests := []struct {
+		seq string
+		key int
+	}{
+		{"[1;2A", SHIFT_ARROW_UP},
+		{"[1;2B", SHIFT_ARROW_DOWN},
+		{"[1;2C", SHIFT_ARROW_RIGHT},
+		{"[1;2D", SHIFT_ARROW_LEFT},
+	}
+
+	for _, tt := range tests {
+		if key, _ := decodeEscape(tt.seq); key != tt.key {
+			t.Errorf("Esc %q = %d, want %d", tt.seq, key, tt.key)
+		}
+	}
+}
+
+func TestShiftArrowSelects(t *testing.T) {
+	cfg := newTestEditor(t, "\x1b[1;2C\x1b[1;2C\x1b[1;2B", "hello", "world")
+	pressKeys(t, cfg)
+
+	startY, startX, endY, endX, ok := editorSelection(cfg)
+	if !ok || startY != 0 || startX != 0 || endY != 1 || endX != 2 {
+		t.Errorf("selection = (%d,%d)-(%d,%d) %v, want (0,0)-(1,2)", startY, startX, endY, endX, ok)
+	}
+}
+
+func TestParseKeyName(t *testing.T) {
+	tests := []struct {
+		name string
+		key  int
+		ok   bool
+	}{
+		{"ctrl-b", Ctrl_B, true},
+		{"Ctrl-B", Ctrl_B, true},
+		{"PageUp", PAGE_UP, true},
+		{"F1", F1_KEY, true},
+		{"ctrl-/", Ctrl_Slash, true},
+		{"g", 'g', true},
+		{"G", 'G', true},
+		{"é", 'é', true},
+		{"alt-x", ALT_KEY | 'x', true},
+		{"Alt-X", ALT_KEY | 'X', true},
+		{"alt-", 0, false},
+		{"alt-xy", 0, false},
+		{"ctrl-1", 0, false},
+		{"hyper-x", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		key, ok := parseKeyName(tt.name)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("parseKeyName(%q) = %d, %v, want %d, %v", tt.name, key, ok, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestRemappedKey(t *testing.T) {
+	cfg := newTestEditor(t, "\x0bGg", "first", "second", "third")
+	cfg.rc = rcConfig{"keys": {"ctrl-k": "delete-line", "G": "join-lines"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	pressKeys(t, cfg)
+
+	// Ctrl-K deletes the first line and G joins the other two, while g is
+	// still typed, at the join
+	assertRows(t, cfg, "secondg third")
+}
+
+func TestRemappedSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	cfg := newTestEditor(t, "x\x04")
+	if err := editorOpen(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	cfg.rc = rcConfig{"keys": {"ctrl-s": "none", "ctrl-d": "save"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cfg.keymap[Ctrl_S]; ok {
+		t.Error("ctrl-s is still bound")
+	}
+	if help := editorStartupHelp(cfg); !strings.HasPrefix(help, "HELP: ctrl-d = save |") {
+		t.Errorf("startup help = %q", help)
+	}
+
+	pressKeys(t, cfg)
+
+	if got, _ := os.ReadFile(path); string(got) != "x\n" {
+		t.Errorf("saved %q, want %q", got, "x\n")
+	}
+	if cfg.dirty {
+		t.Error("buffer is dirty after ctrl-d")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	// the terminal would take ctrl-s and ctrl-q, leaving no way to save
+	// or quit
+	cfg := newTestEditor(t, "", "text")
+	cfg.rc = rcConfig{"": {"flow_control": "true"}}
+	if err := editorApplySettings(cfg); err == nil || !strings.Contains(err.Error(), "bind save") {
+		t.Errorf("flow_control with the default keys = %v", err)
+	}
+	if cfg.flowControl {
+		t.Error("flow_control is on without keys to save and quit")
+	}
+
+	// with other keys for them it is fine, and they are the ones named
+	cfg.rc = rcConfig{"": {"flow_control": "true"}, "keys": {"ctrl-d": "save", "ctrl-k": "quit"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorApplySettings(cfg); err != nil || !cfg.flowControl {
+		t.Fatalf("flow_control with save and quit rebound = %v, %v", err, cfg.flowControl)
+	}
+	if help := editorStartupHelp(cfg); !strings.HasPrefix(help, "HELP: ctrl-d = save | ctrl-k = quit |") {
+		t.Errorf("startup help = %q", help)
+	}
+	editorInterrupt(cfg)
+	if cfg.statusMsg != "Use ctrl-k to quit" {
+		t.Errorf("Ctrl-C says %q", cfg.statusMsg)
+	}
+}
+
+func TestQuitCommand(t *testing.T) {
+	cfg := newTestEditor(t, "\x05quit\r", "text")
+	if err := editorProcessKeyPress(cfg); !errors.Is(err, ErrExitTerminal) {
+		t.Errorf("quit = %v, want ErrExitTerminal", err)
+	}
+
+	// unsaved changes need it repeated, as the quit key does
+	cfg = newTestEditor(t, strings.Repeat("\x05quit\r", KILO_QUIT_TIMES+1), "text")
+	cfg.dirty = true
+	for range KILO_QUIT_TIMES {
+		if err := editorProcessKeyPress(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := editorProcessKeyPress(cfg); !errors.Is(err, ErrExitTerminal) {
+		t.Errorf("last quit = %v, want ErrExitTerminal", err)
+	}
+}
+
+func TestUnboundControlKey(t *testing.T) {
+	// NUL and an unbound F1 are dropped, and Ctrl-C doesn't insert itself
+	// either, but Ctrl-V Ctrl-C inserts it
+	cfg := newTestEditor(t, "a\x03\x00\x1bOPb\x16\x03", "")
+	delete(cfg.keymap, F1_KEY)
+	pressKeys(t, cfg)
+
+	assertRows(t, cfg, "ab\x03")
+}
+
+func TestCtrlC(t *testing.T) {
+	// it says how to quit, and leaves the buffer alone
+	cfg := newTestEditor(t, "\x03", "text")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "text")
+	if cfg.dirty || cfg.statusMsg != "Use ctrl-q to quit" {
+		t.Errorf("dirty = %v, message %q", cfg.dirty, cfg.statusMsg)
+	}
+
+	// it drops a selection
+	cfg = newTestEditor(t, "\x02\x1b[C\x03", "text")
+	pressKeys(t, cfg)
+	if cfg.selecting {
+		t.Error("still selecting after Ctrl-C")
+	}
+
+	// and gives up on a prompt, as Esc does, so the next key is typed
+	cfg = newTestEditor(t, "\x05upper\x03x", "text")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "xtext")
+
+	// or it can be bound to something else
+	cfg = newTestEditor(t, "\x03", "text")
+	cfg.rc = rcConfig{"keys": {"ctrl-c": "quit"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorProcessKeyPress(cfg); !errors.Is(err, ErrExitTerminal) {
+		t.Errorf("Ctrl-C bound to quit returned %v", err)
+	}
+
+	// and then it leaves prompts alone too
+	cfg = newTestEditor(t, "\x05upper\x03\r", "text")
+	cfg.rc = rcConfig{"keys": {"ctrl-c": "quit"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "TEXT")
+}
+
+func TestControlCharacterCaret(t *testing.T) {
+	cfg := newTestEditor(t, "", "a\x01b\x7f")
+	row := &cfg.rows[0]
+
+	if row.render != "a^Ab^?" {
+		t.Errorf("render = %q, want %q", row.render, "a^Ab^?")
+	}
+	for i, hl := range row.hl {
+		control := i == 1 || i == 2 || i == 4 || i == 5
+		if (hl == HL_CONTROL) != control {
+			t.Errorf("hl[%d] = %d, control = %v", i, hl, control)
+		}
+	}
+}
+
+func TestFinalNewline(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		rows    []string
+	}{
+		{"without", "a\nb", []string{"a", "b"}},
+		{"with", "a\nb\n", []string{"a", "b"}},
+		{"blank last line", "a\nb\n\n", []string{"a", "b", ""}},
+		{"only a newline", "\n", []string{""}},
+		{"empty", "", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := newTestEditor(t, "")
+			if err := editorOpen(cfg, path); err != nil {
+				t.Fatal(err)
+			}
+
+			assertRows(t, cfg, tt.rows...)
+			if cfg.numRows != len(tt.rows) {
+				t.Errorf("numRows = %d, want %d", cfg.numRows, len(tt.rows))
+			}
+			if got := editorRowsToString(cfg); got != tt.content {
+				t.Errorf("saved as %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.go")
+	cfg := newTestEditor(t, "")
+	if err := editorOpen(cfg, path); err != nil {
+		t.Fatalf("editorOpen = %v, want nil", err)
+	}
+
+	if cfg.numRows != 0 || cfg.fileName != path {
+		t.Errorf("numRows = %d, fileName = %q, want an empty buffer for %q", cfg.numRows, cfg.fileName, path)
+	}
+	if cfg.syntax == nil {
+		t.Error("syntax was not picked from the name")
+	}
+
+	// saving creates the file
+	editorInsertRow(cfg, "package main", 0)
+	editorSave(cfg)
+	if got, err := os.ReadFile(path); err != nil || string(got) != "package main\n" {
+		t.Errorf("saved %q, %v", got, err)
+	}
+}
+
+func TestOpenDirectory(t *testing.T) {
+	cfg := newTestEditor(t, "")
+	err := editorOpen(cfg, t.TempDir())
+	if !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("editorOpen = %v, want ErrIsDirectory", err)
+	}
+
+	if cfg.numRows != 0 || cfg.fileName != "" {
+		t.Errorf("numRows = %d, fileName = %q, want an empty, unnamed buffer", cfg.numRows, cfg.fileName)
+	}
+}
+
+// interruptedReader fails its first read with EINTR, as a read cut short by
+// a signal does, and reads from r after that
+type interruptedReader struct {
+	r           io.Reader
+	interrupted bool
+}
+
+func (ir *interruptedReader) Read(p []byte) (int, error) {
+	if !ir.interrupted {
+		ir.interrupted = true
+		return 0, unix.EINTR
+	}
+
+	return ir.r.Read(p)
+}
+
+func TestTransientReadIsRetried(t *testing.T) {
+	cfg := newTestEditor(t, "")
+	cfg.reader = bufio.NewReader(&interruptedReader{r: strings.NewReader("x")})
+
+	err := editorProcessKeyPress(cfg)
+	if !errors.Is(err, ErrTransientRead) {
+		t.Fatalf("first key press = %v, want ErrTransientRead", err)
+	}
+
+	// the loop carries on, and the key is there on the next read
+	if err := editorProcessKeyPress(cfg); err != nil {
+		t.Fatalf("second key press = %v", err)
+	}
+	assertRows(t, cfg, "x")
+}
+
+func TestEndOfInput(t *testing.T) {
+	cfg := newTestEditor(t, "x", "first")
+
+	if err := editorProcessKeyPress(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the input runs out, the loop is told to stop rather than
+	// reading NULs
+	err := editorProcessKeyPress(cfg)
+	if !errors.Is(err, ErrEndOfInput) {
+		t.Fatalf("key press after the input ran out = %v, want ErrEndOfInput", err)
+	}
+	assertRows(t, cfg, "xfirst")
+
+	// a prompt left waiting for the rest of an answer gives up on it
+	cfg = newTestEditor(t, "abc")
+	if answer, ok := editorPrompt(cfg, "Save as"); ok {
+		t.Errorf("prompt answered %q at the end of the input", answer)
+	}
+}
+
+// panickingReader panics the first time a key is read
+type panickingReader struct{}
+
+func (panickingReader) Read(p []byte) (int, error) {
+	panic("reading a key")
+}
+
+func TestPanicRestoresTerminal(t *testing.T) {
+	cfg := newTestEditor(t, "", "first")
+	cfg.reader = bufio.NewReader(panickingReader{})
+
+	var screen, stderr bytes.Buffer
+	var restored bool
+	status := -1
+	func() {
+		// as run does
+		defer recoverPanic(&screen, &stderr, func() {
+			if !strings.HasSuffix(screen.String(), "\x1b[2J\x1b[H\x1b[?25h") {
+				t.Error("terminal restored before the screen was cleaned up")
+			}
+			if stderr.Len() > 0 {
+				t.Error("panic reported before the terminal was restored")
+			}
+			restored = true
+		}, func(code int) { status = code })
+
+		editorRefreshScreen(cfg)
+		editorProcessKeyPress(cfg)
+		t.Fatal("the key press didn't panic")
+	}()
+
+	if !restored {
+		t.Error("terminal was not restored")
+	}
+	if status != 2 {
+		t.Errorf("exit status %d, want 2", status)
+	}
+	if !strings.Contains(stderr.String(), "kilo: panic: reading a key") {
+		t.Errorf("stderr = %q, want the panic", stderr.String())
+	}
+}
+
+func TestQuitWarning(t *testing.T) {
+	cfg := newTestEditor(t, "", "first")
+	// with two keys bound to quit the warning names the lower one
+	cfg.rc = rcConfig{"keys": {"ctrl-d": "quit"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	editorSetQuitTimes(cfg, 2)
+	cfg.dirty = true
+
+	for want := 2; want > 0; want-- {
+		if err := editorDoAction(cfg, ACTION_QUIT); err != nil {
+			t.Fatalf("quit with %d presses to go = %v", want, err)
+		}
+		msg := fmt.Sprintf("Press ctrl-d %d more times", want)
+		if !strings.Contains(cfg.statusMsg, msg) {
+			t.Errorf("status = %q, want %q", cfg.statusMsg, msg)
+		}
+	}
+
+	// any other key starts the count again
+	cfg.reader = bufio.NewReader(strings.NewReader("\x1b[C"))
+	pressKeys(t, cfg)
+	if cfg.quitPresses != 2 {
+		t.Errorf("quitPresses = %d after another key, want 2", cfg.quitPresses)
+	}
+
+	for range 2 {
+		editorDoAction(cfg, ACTION_QUIT)
+	}
+	if err := editorDoAction(cfg, ACTION_QUIT); !errors.Is(err, ErrExitTerminal) {
+		t.Errorf("third quit = %v, want ErrExitTerminal", err)
+	}
+}
+
+// hasMatch reports whether row y still carries a search highlight
+func hasMatch(cfg *EditorConfig, y int) bool {
+	return bytes.IndexByte(cfg.rows[y].hl, HL_MATCH) >= 0
+}
+
+func TestIndependentSearches(t *testing.T) {
+	// Ctrl-F foo, then on to the next match
+	a := newTestEditor(t, "\x06foo\x1b[B\r", "foo", "bar", "foo")
+	b := newTestEditor(t, "\x06foo\r", "bar", "foo")
+
+	pressKeys(t, a)
+	pressKeys(t, b)
+	if a.cursorY != 2 {
+		t.Errorf("first editor on row %d, want 2", a.cursorY)
+	}
+	// the first editor's search doesn't carry over to the second
+	if b.cursorY != 1 {
+		t.Errorf("second editor on row %d, want 1", b.cursorY)
+	}
+
+	// a new search starts from scratch, and doesn't leave the last match
+	// highlighted
+	a.reader = bufio.NewReader(strings.NewReader("\x06bar\r"))
+	pressKeys(t, a)
+	if a.cursorY != 1 {
+		t.Errorf("new search on row %d, want 1", a.cursorY)
+	}
+	if hasMatch(a, 2) {
+		t.Error("old match still highlighted")
+	}
+}
+
+func TestStats(t *testing.T) {
+	cfg := newTestEditor(t, "", "héllo world", "", "foo bar baz")
+
+	editorStats(cfg, "")
+	want := "Buffer: 3 lines, 5 words, 25 characters, 26 bytes"
+	if cfg.statusMsg != want {
+		t.Errorf("status = %q, want %q", cfg.statusMsg, want)
+	}
+
+	// from the é to just before baz
+	cfg.selecting = true
+	cfg.anchorY, cfg.anchorX = 0, 1
+	cfg.cursorY, cfg.cursorX = 2, 8
+	editorStats(cfg, "")
+	want = "Selection: 3 lines, 4 words, 20 characters, 21 bytes"
+	if cfg.statusMsg != want {
+		t.Errorf("status = %q, want %q", cfg.statusMsg, want)
+	}
+}
+
+func TestRulerOnTabbedLine(t *testing.T) {
+	cfg := newTestEditor(t, "", "\tx := 1", "")
+	cfg.cursorX = 2
+	editorScroll(cfg)
+
+	want := "Ln 1/2, Col 10"
+	if got := editorRuler(cfg); got != want {
+		t.Errorf("editorRuler = %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	editorDrawStatusBar(cfg, &buf)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("status bar %q doesn't show %q", buf.String(), want)
+	}
+
+	cfg.selecting = true
+	cfg.anchorY, cfg.anchorX = 0, 0
+	want = "Ln 1/2, Col 10 (2 selected)"
+	if got := editorRuler(cfg); got != want {
+		t.Errorf("editorRuler = %q, want %q", got, want)
+	}
+}
+
+func TestDetectIndent(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		softTabs bool
+		width    int
+		ok       bool
+	}{
+		{"two spaces", []string{"a:", "  b:", "    c: 1", "  d: 2", "", "e:", "  f: 3"}, true, 2, true},
+		{"four spaces", []string{"def f():", "    if x:", "        return 1", "    return 2"}, true, 4, true},
+		{"tabs", []string{"func f() {", "\tif x {", "\t\treturn", "\t}", "}"}, false, 0, true},
+		{"no indentation", []string{"a", "b", "", "c"}, false, 0, false},
+		{"as many of each", []string{"\ta", "  b"}, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", tt.lines...)
+			softTabs, width, ok := detectIndent(cfg.rows)
+			if softTabs != tt.softTabs || width != tt.width || ok != tt.ok {
+				t.Errorf("detectIndent = %v, %d, %v, want %v, %d, %v",
+					softTabs, width, ok, tt.softTabs, tt.width, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScrollOff(t *testing.T) {
+	lines := make([]string, 100)
+	cfg := newTestEditor(t, "", lines...)
+	cfg.scrollOff = 3
+	height := editorTextRows(cfg)
+
+	check := func() {
+		t.Helper()
+		editorScroll(cfg)
+		above := cfg.cursorY - cfg.rowOff
+		below := cfg.rowOff + height - 1 - cfg.cursorY
+		if above < min(3, cfg.cursorY) || below < min(3, cfg.numRows-cfg.cursorY) {
+			t.Fatalf("cursor on row %d with rowOff %d: %d rows above it and %d below",
+				cfg.cursorY, cfg.rowOff, above, below)
+		}
+	}
+
+	// down to the line past the end, where the cursor goes to add a line
+	for cfg.cursorY < cfg.numRows {
+		editorMoveCursor(ARROW_DOWN, cfg)
+		check()
+	}
+	// the end of the file leaves no room for a margin
+	if want := cfg.numRows + 1 - height; cfg.rowOff != want {
+		t.Errorf("rowOff at the end = %d, want %d", cfg.rowOff, want)
+	}
+
+	for cfg.cursorY > 0 {
+		editorMoveCursor(ARROW_UP, cfg)
+		check()
+	}
+	if cfg.rowOff != 0 {
+		t.Errorf("rowOff at the top = %d, want 0", cfg.rowOff)
+	}
+}
+
+// screenRows splits what editorDrawRows wrote into the screen rows, each of
+// which starts by moving the cursor to its first column
+func screenRows(drawn string) []string {
+	return regexp.MustCompile(`\x1b\[\d+;1H`).Split(drawn, -1)[1:]
+}
+
+func TestCursorLine(t *testing.T) {
+	cfg := newTestEditor(t, "", "func f() {", "\treturn", "}")
+	cfg.cursorLine = true
+	cfg.cursorY = 1
+	editorScroll(cfg)
+
+	var buf bytes.Buffer
+	editorDrawRows(cfg, &buf)
+	lines := screenRows(buf.String())
+
+	for y, line := range lines {
+		highlighted := strings.Contains(line, CursorLineBackground)
+		if highlighted != (y == cfg.cursorY) {
+			t.Errorf("screen row %d %q: highlighted = %v", y, line, highlighted)
+		}
+	}
+
+	// the background ends with the line, and doesn't run on into the next
+	line := lines[cfg.cursorY]
+	if i, j := strings.LastIndex(line, "\x1b[49m"), strings.LastIndex(line, CursorLineBackground); i < j {
+		t.Errorf("cursor line %q doesn't go back to the default background", line)
+	}
+}
+
+func TestTypeMultiByte(t *testing.T) {
+	// a 3-byte character between two others, then one of 2 and one of 4
+	cfg := newTestEditor(t, "a€bé😀", "")
+	pressKeys(t, cfg)
+
+	assertRows(t, cfg, "a€bé😀")
+	if want := len("a€bé😀"); cfg.cursorX != want {
+		t.Errorf("cursorX = %d, want %d", cfg.cursorX, want)
+	}
+}
+
+func TestReadKeyMultiByte(t *testing.T) {
+	cfg := newTestEditor(t, "€\x1b[A")
+
+	key, err := editorReadKey(cfg)
+	if err != nil || key != '€' {
+		t.Errorf("editorReadKey = %q, %v, want '€'", key, err)
+	}
+	key, err = editorReadKey(cfg)
+	if err != nil || key != ARROW_UP {
+		t.Errorf("editorReadKey = %d, %v, want ARROW_UP", key, err)
+	}
+}
+
+func TestWideCharacters(t *testing.T) {
+	cfg := newTestEditor(t, "", "a中文b", "\t日x")
+
+	tests := []struct {
+		y, cursorX int
+		rowX       int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		// 中 and 文 are 3 bytes each and 2 columns each
+		{0, 4, 3},
+		{0, 7, 5},
+		{0, 8, 6},
+		{1, 1, 8},
+		{1, 4, 10},
+	}
+
+	for _, tt := range tests {
+		cfg.cursorY, cfg.cursorX = tt.y, tt.cursorX
+		editorScroll(cfg)
+		if cfg.rowX != tt.rowX {
+			t.Errorf("row %d, cursorX %d: rowX = %d, want %d", tt.y, tt.cursorX, cfg.rowX, tt.rowX)
+		}
+		if got := editorRowXToCursorX(cfg, cfg.rows[tt.y], tt.rowX); got != tt.cursorX {
+			t.Errorf("row %d, rowX %d: cursorX = %d, want %d", tt.y, tt.rowX, got, tt.cursorX)
+		}
+	}
+
+	// moving right steps over the whole character
+	cfg.cursorY, cfg.cursorX = 0, 1
+	editorMoveCursor(ARROW_RIGHT, cfg)
+	if cfg.cursorX != 4 {
+		t.Errorf("cursorX after moving right = %d, want 4", cfg.cursorX)
+	}
+}
+
+func TestWideCharacterBeforeTab(t *testing.T) {
+	// 中 takes two columns, so the tab after it only needs six to reach
+	// the tab stop
+	line := "中\tx"
+	want := "中      x"
+
+	cfg := newTestEditor(t, "", line)
+	if cfg.rows[0].render != want {
+		t.Errorf("render = %q, want %q", cfg.rows[0].render, want)
+	}
+
+	// the cursor on x is where x was drawn
+	cfg.cursorX = len("中\t")
+	editorScroll(cfg)
+	if cfg.rowX != KILO_TAB_STOP {
+		t.Errorf("rowX on x = %d, want %d", cfg.rowX, KILO_TAB_STOP)
+	}
+	if got := editorRowXToCursorX(cfg, cfg.rows[0], KILO_TAB_STOP); got != cfg.cursorX {
+		t.Errorf("cursorX at column %d = %d, want %d", KILO_TAB_STOP, got, cfg.cursorX)
+	}
+
+	if got := expandTabs(line, KILO_TAB_STOP, false); got != want {
+		t.Errorf("expandTabs = %q, want %q", got, want)
+	}
+}
+
+func TestMoveCursor(t *testing.T) {
+	// row 4 is the line past the end, where new lines are added
+	lines := []string{"hello", "", "hi", "world!"}
+
+	tests := []struct {
+		name  string
+		y, x  int
+		key   int
+		wantY int
+		wantX int
+	}{
+		{"up at the top", 0, 2, ARROW_UP, 0, 2},
+		{"left at the start", 0, 0, ARROW_LEFT, 0, 0},
+		{"right at the end of a line", 0, 5, ARROW_RIGHT, 1, 0},
+		{"left at the start of a line", 3, 0, ARROW_LEFT, 2, 2},
+		{"right on an empty line", 1, 0, ARROW_RIGHT, 2, 0},
+		{"left onto an empty line", 2, 0, ARROW_LEFT, 1, 0},
+		{"up onto an empty line", 2, 2, ARROW_UP, 1, 0},
+		{"up onto a shorter line", 3, 6, ARROW_UP, 2, 2},
+		{"right at the end of the buffer", 3, 6, ARROW_RIGHT, 4, 0},
+		{"down at the end of the buffer", 3, 6, ARROW_DOWN, 4, 0},
+		{"down on the line past the end", 4, 0, ARROW_DOWN, 4, 0},
+		{"right on the line past the end", 4, 0, ARROW_RIGHT, 4, 0},
+		{"left from the line past the end", 4, 0, ARROW_LEFT, 3, 6},
+		{"up from the line past the end", 4, 0, ARROW_UP, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", lines...)
+			cfg.cursorY, cfg.cursorX = tt.y, tt.x
+			editorMoveCursor(tt.key, cfg)
+			if cfg.cursorY != tt.wantY || cfg.cursorX != tt.wantX {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", cfg.cursorY, cfg.cursorX, tt.wantY, tt.wantX)
+			}
+		})
+	}
+}
+
+func TestMoveCursorKeepsColumn(t *testing.T) {
+	cfg := newTestEditor(t, "", "\tx = 1", "        y = 2", "ab\tc", "日本語d", "\t\tdeep")
+	cfg.cursorX = 1 // after the tab, in column 8
+
+	// each stop is on the character under the column of the one before,
+	// or at the end of a line too short to reach it
+	for _, wantX := range []int{8, 3, 10, 0} {
+		editorMoveCursor(ARROW_DOWN, cfg)
+		if cfg.cursorX != wantX {
+			t.Errorf("on row %d %q cursorX = %d, want %d", cfg.cursorY, cfg.rows[cfg.cursorY].chars, cfg.cursorX, wantX)
+		}
+	}
+
+	// and back up from column 16, which is past the end of every line above
+	cfg.cursorX = 2
+	editorMoveCursor(ARROW_UP, cfg)
+	if cfg.cursorX != 10 {
+		t.Errorf("moving up onto %q cursorX = %d, want its end", cfg.rows[cfg.cursorY].chars, cfg.cursorX)
+	}
+}
+
+func TestBackspaceAtEdges(t *testing.T) {
+	tests := []struct {
+		name         string
+		y, x         int
+		wantY, wantX int
+		want         []string
+	}{
+		{"start of the file", 0, 0, 0, 0, []string{"one", "two"}},
+		{"line past the end", 2, 0, 1, 3, []string{"one", "two"}},
+		{"start of a line", 1, 0, 0, 3, []string{"onetwo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", "one", "two")
+			cfg.cursorY, cfg.cursorX = tt.y, tt.x
+
+			editorDelChar(cfg)
+
+			assertRows(t, cfg, tt.want...)
+			if cfg.cursorY != tt.wantY || cfg.cursorX != tt.wantX {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", cfg.cursorY, cfg.cursorX, tt.wantY, tt.wantX)
+			}
+			if changed := len(tt.want) != 2; cfg.dirty != changed {
+				t.Errorf("dirty = %v, want %v", cfg.dirty, changed)
+			}
+		})
+	}
+
+	// and again from there, which now deletes
+	cfg := newTestEditor(t, "", "one", "two")
+	cfg.cursorY = cfg.numRows
+	editorDelChar(cfg)
+	editorDelChar(cfg)
+	assertRows(t, cfg, "one", "tw")
+}
+
+func TestEnterAtEdges(t *testing.T) {
+	tests := []struct {
+		name         string
+		y, x         int
+		wantY, wantX int
+		want         []string
+	}{
+		{"start of the file", 0, 0, 1, 0, []string{"", "one", "two"}},
+		{"start of a line", 1, 0, 2, 0, []string{"one", "", "two"}},
+		{"middle of a line", 1, 1, 2, 0, []string{"one", "t", "wo"}},
+		{"end of the last line", 1, 3, 2, 0, []string{"one", "two", ""}},
+		{"line past the end", 2, 0, 3, 0, []string{"one", "two", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", "one", "two")
+			cfg.cursorY, cfg.cursorX = tt.y, tt.x
+
+			editorInsertNewLine(cfg)
+
+			assertRows(t, cfg, tt.want...)
+			if cfg.cursorY != tt.wantY || cfg.cursorX != tt.wantX {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", cfg.cursorY, cfg.cursorX, tt.wantY, tt.wantX)
+			}
+			if !cfg.dirty {
+				t.Error("buffer not dirty after Enter")
+			}
+		})
+	}
+}
+
+func TestTypePastTheEnd(t *testing.T) {
+	// the cursor goes down onto the line past the end, and typing makes it
+	// the last line, leaving the others as they were
+	cfg := newTestEditor(t, "\x1b[B\x1b[B\x1b[Bx", "a", "b")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "a", "b", "x")
+	if cfg.cursorY != 2 || cfg.cursorX != 1 {
+		t.Errorf("cursor at (%d, %d), want (2, 1)", cfg.cursorY, cfg.cursorX)
+	}
+
+	// and in an empty buffer too
+	cfg = newTestEditor(t, "x")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "x")
+}
+
+func FuzzOpenRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"\n",
+		"a\nb",
+		"a\nb\n",
+		strings.Repeat("x", 200_000) + "\nshort\n",
+		"nul\x00in the\x00middle\n\x00\n",
+		"lone\rreturn\n",
+		"\r",
+		"crlf\r\nlines\r\n",
+		"héllo 😀 中文\n",
+		"bad \xff\xfe utf-8\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz.txt")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+
+		// the file comes back as it was, except that a \r before a line
+		// break goes with the break
+		content := string(data)
+		lines := strings.Split(content, "\n")
+		if content == "" || strings.HasSuffix(content, "\n") {
+			lines = lines[:len(lines)-1]
+		}
+		for i, line := range lines {
+			lines[i] = strings.TrimSuffix(line, "\r")
+		}
+		want := strings.Join(lines, "\n")
+		if strings.HasSuffix(content, "\n") {
+			want += "\n"
+		}
+
+		if cfg.numRows != len(lines) || len(cfg.rows) != cfg.numRows {
+			t.Errorf("numRows = %d with %d rows, want %d", cfg.numRows, len(cfg.rows), len(lines))
+		}
+
+		got := editorRowsToString(cfg)
+		if got != want {
+			t.Errorf("round trip = %q, want %q", got, want)
+		}
+		if utf8.Valid(data) && !utf8.ValidString(got) {
+			t.Errorf("valid UTF-8 %q came back invalid as %q", data, got)
+		}
+
+		// drawing every row mustn't choke on whatever the file holds
+		for cfg.rowOff = 0; cfg.rowOff < cfg.numRows; cfg.rowOff += editorTextRows(cfg) {
+			var buf bytes.Buffer
+			editorDrawRows(cfg, &buf)
+		}
+	})
+}
+
+func TestPrintVersion(t *testing.T) {
+	var out bytes.Buffer
+	printVersion(&out)
+
+	if !strings.HasPrefix(out.String(), "kilo "+KILO_VERSION+"\n") {
+		t.Errorf("printVersion = %q, want it to start with the version", out.String())
+	}
+	// test binaries carry build info, so the Go version is there too
+	if !strings.Contains(out.String(), "go: go1.") {
+		t.Errorf("printVersion = %q, want the Go version", out.String())
+	}
+}
+
+func TestNoTTY(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	_, err = enableRawMode(int(r.Fd()))
+	if !errors.Is(err, ErrNoTTY) {
+		t.Fatalf("enableRawMode on a pipe = %v, want ErrNoTTY", err)
+	}
+
+	var out bytes.Buffer
+	printStartupError(&out, err)
+	if !strings.Contains(out.String(), "-check, -script and -version") {
+		t.Errorf("message = %q, want it to suggest what works without a terminal", out.String())
+	}
+
+	// other failures don't get the suggestion
+	out.Reset()
+	printStartupError(&out, os.ErrNotExist)
+	if out.String() != "kilo: file does not exist\n" {
+		t.Errorf("message = %q", out.String())
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"text.go":    "package main\n\nfunc main() {}\n",
+		"binary.bin": "\x7fELF\x02\x01\x00\x00",
+		"latin1.txt": "caf\xe9\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		report string
+	}{
+		{"text.go", 0, ""},
+		{"binary.bin", 1, "binary.bin:1: binary file"},
+		{"latin1.txt", 1, "latin1.txt:1: not valid UTF-8"},
+		{"missing.txt", 1, "no such file"},
+		{"", 1, "is a directory"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		status := checkFile(filepath.Join(dir, tt.name), &out)
+		if status != tt.status || !strings.Contains(out.String(), tt.report) {
+			t.Errorf("checkFile(%q) = %d, %q, want %d, %q", tt.name, status, out.String(), tt.status, tt.report)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		message string
+	}{
+		// the first match on each line, or with g every one
+		{"%s/a/A/", []string{"A.b a.b", "x/A/x"}, "2 replaced"},
+		{"%s/a/A/g", []string{"A.b A.b", "x/A/x"}, "3 replaced"},
+		// a regular expression, unless l makes it plain text
+		{"replace /a.b/X/g", []string{"X X", "x/a/x"}, "2 replaced"},
+		{"replace /./_/gl", []string{"a_b a_b", "x/a/x"}, "2 replaced"},
+		{"replace |(a)\\.b|[$1]|g", []string{"[a] [a]", "x/a/x"}, "2 replaced"},
+		{"replace |.|$|l", []string{"a$b a.b", "x/a/x"}, "1 replaced"},
+		// an escaped delimiter is part of the pattern
+		{"s/\\/a\\//-/", []string{"a.b a.b", "x-x"}, "1 replaced"},
+		{"s/z/y/", []string{"a.b a.b", "x/a/x"}, "0 replaced"},
+		{"s/a/b/q", []string{"a.b a.b", "x/a/x"}, "Usage: replace /old/new/[g][l]"},
+		{"s/(/b/", []string{"a.b a.b", "x/a/x"}, "Bad pattern"},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestEditor(t, "", "a.b a.b", "x/a/x")
+		editorRunCommand(cfg, tt.command)
+		assertRows(t, cfg, tt.want...)
+		if !strings.HasPrefix(cfg.statusMsg, tt.message) {
+			t.Errorf("%s: message %q, want %q", tt.command, cfg.statusMsg, tt.message)
+		}
+		if dirty := tt.message != "0 replaced" && strings.HasSuffix(tt.message, "replaced"); cfg.dirty != dirty {
+			t.Errorf("%s: dirty = %v, want %v", tt.command, cfg.dirty, dirty)
+		}
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(file, []byte("foo := 1\nfmt.Println(foo)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "rename.kilo")
+	lines := []string{
+		"# rename foo",
+		":%s/foo/bar/",
+		"",
+		"replace |Print(ln)|Fprint$1|",
+		"frobnicate",
+		":w",
+		":q",
+		"upper",
+	}
+	if err := os.WriteFile(script, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if status := runScript(file, script, &out); status != 1 {
+		t.Errorf("runScript = %d, want 1 for the unknown command", status)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bar := 1\nfmt.Fprintln(bar)\n"; string(got) != want {
+		t.Errorf("saved %q, want %q", got, want)
+	}
+
+	// each command's message comes with its line of the script
+	for _, want := range []string{"rename.kilo:2: 2 replaced", "rename.kilo:4: 1 replaced", "rename.kilo:5: Unknown command: frobnicate", "rename.kilo:6: 27 bytes"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report %q doesn't say %q", out.String(), want)
+		}
+	}
+
+	// a command that fails, or changes left unsaved, fail the script too
+	failures := []struct {
+		name     string
+		fileName string
+		lines    []string
+		want     string
+	}{
+		{"bad pattern", file, []string{"replace /(/x/"}, "fail.kilo:1: Bad pattern"},
+		// with no file to save to, save asks for one, and nobody answers
+		{"failed save", "", []string{"date", "w"}, "fail.kilo:2: Save aborted"},
+		{"not written", file, []string{"upper"}, "fail.kilo: changes not written"},
+	}
+	for _, tt := range failures {
+		script := filepath.Join(dir, "fail.kilo")
+		if err := os.WriteFile(script, []byte(strings.Join(tt.lines, "\n")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		out.Reset()
+		if status := runScript(tt.fileName, script, &out); status != 1 {
+			t.Errorf("%s: runScript = %d, want 1", tt.name, status)
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: report %q doesn't say %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestSplitLocation(t *testing.T) {
+	dir := t.TempDir()
+	colons := filepath.Join(dir, "odd:12")
+	if err := os.WriteFile(colons, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		arg       string
+		fileName  string
+		line, col int
+	}{
+		{"main.go", "main.go", 0, 0},
+		{"main.go:42", "main.go", 42, 0},
+		{"main.go:42:10", "main.go", 42, 10},
+		{"dir/main.go:7:", "dir/main.go:7:", 0, 0},
+		{"main.go:0", "main.go:0", 0, 0},
+		{"main.go:x", "main.go:x", 0, 0},
+		{":42", ":42", 0, 0},
+		// a file that exists keeps its whole name
+		{colons, colons, 0, 0},
+		{colons + ":3", colons, 3, 0},
+	}
+
+	for _, tt := range tests {
+		fileName, line, col := splitLocation(tt.arg)
+		if fileName != tt.fileName || line != tt.line || col != tt.col {
+			t.Errorf("splitLocation(%q) = %q, %d, %d, want %q, %d, %d",
+				tt.arg, fileName, line, col, tt.fileName, tt.line, tt.col)
+		}
+	}
+}
+
+func TestOpenAtLocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc main() {\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName, line, col := splitLocation(path + ":3:6")
+	cfg := newTestEditor(t, "")
+	if err := editorOpen(cfg, fileName); err != nil {
+		t.Fatal(err)
+	}
+	editorGoTo(cfg, line, col)
+
+	if cfg.cursorY != 2 || cfg.cursorX != 5 {
+		t.Errorf("cursor at (%d, %d), want (2, 5)", cfg.cursorY, cfg.cursorX)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestEditor(t, "")
+	if err := editorOpen(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	editorStartFollow(cfg)
+
+	appendLog := func(s string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		editorFollow(cfg)
+	}
+
+	// a line can arrive in pieces
+	appendLog("three\nfou")
+	appendLog("r\n")
+	assertRows(t, cfg, "one", "two", "three", "four")
+	if cfg.cursorY != 3 {
+		t.Errorf("cursor on row %d, want the last one", cfg.cursorY)
+	}
+
+	// moving up pauses following
+	cfg.cursorY = 1
+	appendLog("five\n")
+	assertRows(t, cfg, "one", "two", "three", "four", "five")
+	if cfg.cursorY != 1 {
+		t.Errorf("cursor on row %d after pausing, want 1", cfg.cursorY)
+	}
+
+	// a rotated log is read from the start again
+	if err := os.WriteFile(path, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	editorFollow(cfg)
+	assertRows(t, cfg, "new")
+}
+
+// drawnRows is the screen rows of the text area, with the escape sequences
+// taken out
+func drawnRows(cfg *EditorConfig) []string {
+	var buf bytes.Buffer
+	editorScroll(cfg)
+	editorDrawRows(cfg, &buf)
+
+	rows := screenRows(buf.String())
+	sgr := regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	for i, row := range rows {
+		rows[i] = sgr.ReplaceAllString(row, "")
+	}
+
+	return rows
+}
+
+func TestFoldRoundTrip(t *testing.T) {
+	lines := []string{"func f() {", "\tif x {", "\t\ty()", "\t}", "}", "z"}
+	cfg := newTestEditor(t, "", lines...)
+	before := drawnRows(cfg)
+
+	// folding from inside a block folds the block it is in
+	cfg.cursorY = 2
+	editorFold(cfg, "")
+	if want := []fold{{1, 2}}; !slices.Equal(cfg.folds, want) {
+		t.Fatalf("folds = %v, want %v", cfg.folds, want)
+	}
+
+	// an outer fold swallows the inner one
+	cfg.cursorY = 0
+	editorFold(cfg, "")
+	if want := []fold{{0, 3}}; !slices.Equal(cfg.folds, want) {
+		t.Fatalf("folds = %v, want %v", cfg.folds, want)
+	}
+
+	drawn := drawnRows(cfg)
+	if !strings.HasPrefix(drawn[0], "func f() { +-- 3 lines") || drawn[1] != "}" || drawn[2] != "z" {
+		t.Errorf("folded screen starts %q", drawn[:3])
+	}
+
+	// the cursor steps over the folded block
+	editorMoveCursor(ARROW_DOWN, cfg)
+	if cfg.cursorY != 4 {
+		t.Errorf("cursor on row %d after moving down, want 4", cfg.cursorY)
+	}
+	editorMoveCursor(ARROW_UP, cfg)
+	if cfg.cursorY != 0 {
+		t.Errorf("cursor on row %d after moving up, want 0", cfg.cursorY)
+	}
+
+	editorUnfold(cfg, "")
+	if len(cfg.folds) != 0 {
+		t.Errorf("folds = %v after unfolding", cfg.folds)
+	}
+	assertRows(t, cfg, lines...)
+	if after := drawnRows(cfg); !slices.Equal(after, before) {
+		t.Errorf("unfolded screen = %q, want %q", after, before)
+	}
+
+	cfg.cursorY = 1
+	editorFold(cfg, "")
+	cfg.cursorY = 0
+	editorFold(cfg, "")
+	cfg.cursorY = 4
+	editorUnfold(cfg, "all")
+	if len(cfg.folds) != 0 {
+		t.Errorf("folds = %v after unfolding all", cfg.folds)
+	}
+}
+
+func TestSplitPanes(t *testing.T) {
+	lines := make([]string, 60)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("row %d %s", i, strings.Repeat("x", 50))
+	}
+	cfg := newTestEditor(t, "", lines...)
+	editorSplit(cfg, "")
+
+	// the left pane is active and goes down the file, the right one stays
+	// at the top
+	cfg.cursorY = 40
+	editorScroll(cfg)
+	leftTop := cfg.rowOff
+
+	var buf bytes.Buffer
+	editorDrawRows(cfg, &buf)
+
+	sgr := regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	moves := regexp.MustCompile(`\x1b\[(\d+);(\d+)H`)
+	drawn := buf.String()
+	for _, m := range moves.FindAllStringSubmatchIndex(drawn, -1) {
+		y, _ := strconv.Atoi(drawn[m[2]:m[3]])
+		x, _ := strconv.Atoi(drawn[m[4]:m[5]])
+		end := len(drawn)
+		if next := moves.FindStringIndex(drawn[m[1]:]); next != nil {
+			end = m[1] + next[0]
+		}
+		text := sgr.ReplaceAllString(drawn[m[1]:end], "")
+
+		// below the text area is the status bar
+		if y > editorTextRows(cfg) {
+			continue
+		}
+
+		switch x {
+		case 1:
+			want := lines[leftTop+y-1][:39]
+			if text != want {
+				t.Errorf("left pane row %d = %q, want %q", y, text, want)
+			}
+		case 40:
+			if text != "│" {
+				t.Errorf("separator row %d = %q", y, text)
+			}
+		case 41:
+			want := lines[y-1][:40]
+			if text != want {
+				t.Errorf("right pane row %d = %q, want %q", y, text, want)
+			}
+		default:
+			t.Errorf("row %d drawn from column %d", y, x)
+		}
+	}
+}
+
+func TestSplitKeepsActiveView(t *testing.T) {
+	cfg := newTestEditor(t, "", "func f() {", "\tif x {", "\t\ty()", "\t}", "\treturn", "}")
+	editorSplit(cfg, "")
+
+	// the other pane is left inside the block, which this one folds
+	cfg.cursorY = 2
+	editorOtherPane(cfg)
+	cfg.cursorY, cfg.cursorX = 1, 1
+	editorFold(cfg, "")
+	cfg.cursorY, cfg.cursorX = 4, 1
+
+	editorScroll(cfg)
+	rowX := cfg.rowX
+	var buf bytes.Buffer
+	editorDrawRows(cfg, &buf)
+
+	// drawing the other pane leaves this one's column and the fold alone
+	if cfg.rowX != rowX {
+		t.Errorf("rowX = %d after drawing, want %d", cfg.rowX, rowX)
+	}
+	if len(cfg.folds) != 1 {
+		t.Errorf("folds = %v after drawing, want the fold kept", cfg.folds)
+	}
+	if cfg.cursorY != 4 || cfg.cursorX != 1 {
+		t.Errorf("cursor at (%d, %d) after drawing, want (4, 1)", cfg.cursorY, cfg.cursorX)
+	}
+}
+
+func TestWordHighlight(t *testing.T) {
+	cfg := newTestEditor(t, "", "count := 0", "count++ // counter", "\tx := count")
+	cfg.wordHighlight = true
+	cfg.cursorY, cfg.cursorX = 0, 2
+
+	word := editorCursorWord(cfg)
+	if word != "count" {
+		t.Fatalf("editorCursorWord = %q, want count", word)
+	}
+
+	want := [][][2]int{
+		// the occurrence under the cursor isn't highlighted
+		nil,
+		// counter is another word
+		{{0, 5}},
+		// after the tab
+		{{13, 18}},
+	}
+	for y := range cfg.numRows {
+		if got := editorRowWordMatches(cfg, y, word); !slices.Equal(got, want[y]) {
+			t.Errorf("row %d matches = %v, want %v", y, got, want[y])
+		}
+	}
+
+	var buf bytes.Buffer
+	editorScroll(cfg)
+	editorDrawRows(cfg, &buf)
+	rows := screenRows(buf.String())
+	if !strings.Contains(rows[2], "\x1b[36mcount") {
+		t.Errorf("row 2 drawn as %q, want count highlighted", rows[2])
+	}
+	if strings.Contains(rows[0], "\x1b[36m") {
+		t.Errorf("row 0 drawn as %q, want nothing highlighted", rows[0])
+	}
+
+	// between a space and punctuation there is no word to highlight
+	cfg.cursorX = 6
+	if word := editorCursorWord(cfg); word != "" {
+		t.Errorf("editorCursorWord on a space = %q", word)
+	}
+}
+
+func TestSmartHome(t *testing.T) {
+	// Home three times from the end of an indented line
+	cfg := newTestEditor(t, "", "    return nil")
+	cfg.smartHome = true
+	cfg.cursorX = 14
+
+	for _, want := range []int{4, 0, 4} {
+		cfg.reader = bufio.NewReader(strings.NewReader("\x1b[H"))
+		pressKeys(t, cfg)
+		if cfg.cursorX != want {
+			t.Errorf("cursorX = %d, want %d", cfg.cursorX, want)
+		}
+	}
+
+	// without it Home always goes to the start of the line
+	cfg.smartHome = false
+	cfg.cursorX = 14
+	cfg.reader = bufio.NewReader(strings.NewReader("\x1b[H"))
+	pressKeys(t, cfg)
+	if cfg.cursorX != 0 {
+		t.Errorf("cursorX = %d without smart home, want 0", cfg.cursorX)
+	}
+}
+
+func TestQuotedInsert(t *testing.T) {
+	// Ctrl-V Ctrl-A, then Ctrl-V Tab with soft tabs on
+	cfg := newTestEditor(t, "x\x16\x01\x16\ty", "")
+	cfg.softTabs = true
+	pressKeys(t, cfg)
+
+	assertRows(t, cfg, "x\x01\ty")
+	if row := &cfg.rows[0]; !strings.HasPrefix(row.render, "x^A") {
+		t.Errorf("render = %q, want the Ctrl-A as ^A", row.render)
+	}
+}
+
+func TestFitPath(t *testing.T) {
+	path := "/home/zoë/projects/données/文档/résumé.txt"
+
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{60, path},
+		{20, ".../文档/résumé.txt"},
+		{12, "résumé.txt"},
+		{8, "résumé.…"},
+	}
+
+	for _, tt := range tests {
+		got := fitPath(path, tt.width)
+		if got != tt.want {
+			t.Errorf("fitPath(%d) = %q, want %q", tt.width, got, tt.want)
+		}
+		if !utf8.ValidString(got) || stringWidth(got) > tt.width {
+			t.Errorf("fitPath(%d) = %q is %d columns", tt.width, got, stringWidth(got))
+		}
+	}
+}
+
+func TestStatusBarLongPath(t *testing.T) {
+	for _, cols := range []uint16{80, 40, 24} {
+		cfg := newTestEditor(t, "", "text")
+		cfg.winSize.Col = cols
+		cfg.fileName = "/home/zoë/" + strings.Repeat("données/", 10) + "文档.txt"
+		// with everything else the bar can say as well
+		cfg.noFinalNewline, cfg.dirty, cfg.overwrite, cfg.readOnly = true, true, true, true
+
+		var buf bytes.Buffer
+		editorDrawStatusBar(cfg, &buf)
+		bar := regexp.MustCompile(`\x1b\[[0-9;]*m|\r\n`).ReplaceAllString(buf.String(), "")
+
+		if !utf8.ValidString(bar) {
+			t.Errorf("%d columns: status bar %q isn't valid UTF-8", cols, bar)
+		}
+		if w := stringWidth(bar); w > int(cols) {
+			t.Errorf("%d columns: status bar %q is %d wide", cols, bar, w)
+		}
+		if !strings.Contains(bar, "文档") {
+			t.Errorf("%d columns: status bar %q lost the file's name", cols, bar)
+		}
+	}
+}
+
+func TestRelativeNumbers(t *testing.T) {
+	lines := make([]string, 12)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i+1)
+	}
+
+	tests := []struct {
+		name     string
+		absolute bool
+		want     []string
+	}{
+		{"relative", false, []string{"4", "3", "2", "1", "0", "1", "2", "3", "4", "5", "6", "7"}},
+		// the cursor's line shows its own number
+		{"with line numbers", true, []string{"4", "3", "2", "1", "5", "1", "2", "3", "4", "5", "6", "7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", lines...)
+			cfg.relativeNumbers = true
+			cfg.lineNumbers = tt.absolute
+			cfg.cursorY = 4
+
+			drawn := drawnRows(cfg)
+			for y, want := range tt.want {
+				fields := strings.Fields(drawn[y])
+				if len(fields) == 0 || fields[0] != want {
+					t.Errorf("screen row %d = %q, want it numbered %s", y, drawn[y], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMarks(t *testing.T) {
+	cfg := newTestEditor(t, "", "one", "two", "three", "four", "five")
+
+	cfg.cursorY, cfg.cursorX = 2, 1
+	editorSetMark(cfg, "x")
+	cfg.cursorY, cfg.cursorX = 4, 0
+
+	editorJumpToMark(cfg, "x")
+	if cfg.cursorY != 2 || cfg.cursorX != 1 {
+		t.Errorf("cursor at (%d, %d) after jumping to x, want (2, 1)", cfg.cursorY, cfg.cursorX)
+	}
+
+	// the jump left a mark to go back to
+	editorJumpToMark(cfg, "")
+	if cfg.cursorY != 4 || cfg.cursorX != 0 {
+		t.Errorf("cursor at (%d, %d) after jumping back, want (4, 0)", cfg.cursorY, cfg.cursorX)
+	}
+
+	// a line added above moves the mark down with its line
+	cfg.cursorY, cfg.cursorX = 0, 0
+	cfg.reader = bufio.NewReader(strings.NewReader("zero\r"))
+	pressKeys(t, cfg)
+	editorJumpToMark(cfg, "x")
+	if cfg.cursorY != 3 || cfg.rows[cfg.cursorY].chars != "three" {
+		t.Errorf("cursor on row %d after inserting above the mark, want 3", cfg.cursorY)
+	}
+
+	// and the mark goes with its line
+	editorDelRow(cfg, 3)
+	if _, ok := cfg.marks["x"]; ok {
+		t.Errorf("mark x = %v after deleting its line", cfg.marks["x"])
+	}
+}
+
+func TestSearchThenInsertAbove(t *testing.T) {
+	// find foo, then add a line at the top of the file
+	cfg := newTestEditor(t, "\x06foo\r\x1b[A\x1b[Hnew\r", "a", "foo bar", "b")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "new", "a", "foo bar", "b")
+	if !hasMatch(cfg, 2) {
+		t.Fatal("match no longer highlighted after inserting above it")
+	}
+
+	// the next search puts back the highlight of the line the match is
+	// on now, and only that one
+	cfg.reader = bufio.NewReader(strings.NewReader("\x06\x1b"))
+	pressKeys(t, cfg)
+	for y := range cfg.numRows {
+		row := &cfg.rows[y]
+		if hasMatch(cfg, y) || len(row.hl) != len(row.render) {
+			t.Errorf("row %d %q has hl %v", y, row.render, row.hl)
+		}
+	}
+}
+
+func TestSearchKeepsRowOffInRange(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	cfg := newTestEditor(t, "", lines...)
+	height := editorTextRows(cfg)
+
+	for _, query := range []string{"line 98", "line 3", "line 50", "line 0"} {
+		cfg.search = searchState{lastMatch: -1, direction: 1}
+		editorFindCallback(cfg, query)
+
+		// straight after the jump, before anything scrolls
+		if cfg.rowOff < 0 || cfg.rowOff >= cfg.numRows {
+			t.Errorf("%s: rowOff = %d, want it in [0, %d)", query, cfg.rowOff, cfg.numRows)
+		}
+		if cfg.cursorY < cfg.rowOff || cfg.cursorY >= cfg.rowOff+height {
+			t.Errorf("%s: match on row %d is off the screen from rowOff %d", query, cfg.cursorY, cfg.rowOff)
+		}
+	}
+}
+
+func TestJumpCentersFarRow(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	cfg := newTestEditor(t, "", lines...)
+	height := editorTextRows(cfg)
+
+	// a far row ends up in the middle of the screen
+	editorGoTo(cfg, 81, 1)
+	editorScroll(cfg)
+	if cfg.cursorY != 80 || cfg.rowOff != 80-height/2 {
+		t.Errorf("cursor on row %d, rowOff %d after going to line 81, want 80, %d", cfg.cursorY, cfg.rowOff, 80-height/2)
+	}
+
+	// one already on the screen doesn't scroll it
+	editorGoTo(cfg, 75, 1)
+	editorScroll(cfg)
+	if cfg.rowOff != 80-height/2 {
+		t.Errorf("rowOff = %d after going to a line on the screen, want %d", cfg.rowOff, 80-height/2)
+	}
+
+	// nor does a row near the top, which can't be centered
+	cfg.search = searchState{lastMatch: -1, direction: 1}
+	editorFindCallback(cfg, "line 3")
+	editorScroll(cfg)
+	if cfg.cursorY != 3 || cfg.rowOff != 0 {
+		t.Errorf("cursor on row %d, rowOff %d after searching, want 3, 0", cfg.cursorY, cfg.rowOff)
+	}
+}
+
+// stepWriter calls step before every write, to see what has happened by then
+type stepWriter struct {
+	step func(p []byte)
+}
+
+func (w stepWriter) Write(p []byte) (int, error) {
+	w.step(p)
+	return len(p), nil
+}
+
+func TestReportFailureOrder(t *testing.T) {
+	var steps []string
+	screen := stepWriter{func(p []byte) { steps = append(steps, "screen") }}
+	stderr := stepWriter{func(p []byte) { steps = append(steps, string(p)) }}
+
+	reportFailure(screen, stderr, func() { steps = append(steps, "restore") }, "kilo: %v\n", ErrIsDirectory)
+
+	want := []string{"screen", "restore", "kilo: " + ErrIsDirectory.Error() + "\n"}
+	if !slices.Equal(steps, want) {
+		t.Errorf("steps = %q, want %q", steps, want)
+	}
+}
+
+func TestDie(t *testing.T) {
+	dir := t.TempDir()
+	screen, err := os.Create(filepath.Join(dir, "screen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stderr = saved }(os.Stderr)
+	os.Stderr = stderr
+
+	// /dev/null isn't a terminal, so restoring it fails quietly
+	cfg := newTestEditor(t, "")
+	cfg.origTermios = &State{}
+	cfg.out = screen
+	die(cfg, errors.New("reading file: too long"))
+
+	if got, _ := os.ReadFile(screen.Name()); !strings.Contains(string(got), "\x1b[2J") {
+		t.Errorf("screen = %q, want it cleared", got)
+	}
+	if got, _ := os.ReadFile(stderr.Name()); string(got) != "kilo: reading file: too long\n" {
+		t.Errorf("stderr = %q", got)
+	}
+}
+
+func TestEditorOnPTY(t *testing.T) {
+	ptmx, tty := openPTY(t)
+	if err := unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 24, Col: 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := enableRawMode(int(tty.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restore(int(tty.Fd()), state)
+
+	cfg, err := initEditor(tty, tty, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.winSize.Row != 24 || cfg.winSize.Col != 80 {
+		t.Errorf("window size %dx%d, want the pty's 24x80", cfg.winSize.Row, cfg.winSize.Col)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- editorLoop(cfg) }()
+
+	// whatever the editor draws, as the other side of the pty sees it
+	var mu sync.Mutex
+	var screen bytes.Buffer
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf)
+			mu.Lock()
+			screen.Write(buf[:n])
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			found := strings.Contains(screen.String(), want)
+			mu.Unlock()
+			if found {
+				return
+			}
+		}
+		t.Fatalf("the editor never drew %q", want)
+	}
+
+	// the typed key comes back drawn on the first row
+	if _, err := ptmx.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("\x1b[1;1Hx")
+
+	// and Ctrl-Q, past the unsaved changes warnings, quits
+	if _, err := ptmx.Write([]byte(strings.Repeat("\x11", KILO_QUIT_TIMES+1))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("editorLoop = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the editor didn't quit")
+	}
+	assertRows(t, cfg, "x")
+}
+
+func TestQuitCleansUpScreen(t *testing.T) {
+	for _, writeStdout := range []bool{false, true} {
+		screen, err := os.Create(filepath.Join(t.TempDir(), "screen"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := newTestEditor(t, "\x11", "text")
+		cfg.origTermios = &State{}
+		cfg.out = screen
+		cfg.writeStdout = writeStdout
+		editorRefreshScreen(cfg)
+		if err := editorProcessKeyPress(cfg); !errors.Is(err, ErrExitTerminal) {
+			t.Fatalf("Ctrl-Q returned %v, want ErrExitTerminal", err)
+		}
+
+		var stdout bytes.Buffer
+		editorExit(cfg, &stdout)
+
+		// the last frame is cleared away and the cursor left showing
+		drawn, _ := os.ReadFile(screen.Name())
+		if !bytes.HasSuffix(drawn, []byte("\x1b[2J\x1b[H\x1b[?25h")) {
+			t.Errorf("write-stdout %v: screen ends %q, want it cleaned up", writeStdout, drawn[max(len(drawn)-20, 0):])
+		}
+		if want := map[bool]string{false: "", true: "text\n"}[writeStdout]; stdout.String() != want {
+			t.Errorf("write-stdout %v: stdout = %q, want %q", writeStdout, stdout.String(), want)
+		}
+	}
+}
+
+// chdir changes the working directory for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestOpenRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "src", "notes.txt")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, dir)
+
+	cfg := newTestEditor(t, "")
+	if err := editorOpen(cfg, filepath.Join("src", "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(cfg.filePath) || cfg.fileName != filepath.Join("src", "notes.txt") {
+		t.Errorf("filePath = %q, fileName = %q, want an absolute path shown as given", cfg.filePath, cfg.fileName)
+	}
+
+	// saving after the working directory changed still finds the file
+	chdir(t, filepath.Join(dir, "src"))
+	cfg.reader = bufio.NewReader(strings.NewReader("new "))
+	pressKeys(t, cfg)
+	editorSave(cfg)
+	if got, _ := os.ReadFile(path); string(got) != "new old\n" {
+		t.Errorf("file holds %q after saving, want %q", got, "new old\n")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "src")); err == nil {
+		t.Error("saved to a path relative to the new working directory")
+	}
+}
+
+// assertHL checks that every byte of the first occurrence of text in row y
+// is colored hl
+func assertHL(t *testing.T, cfg *EditorConfig, y int, text string, hl uint8) {
+	t.Helper()
+
+	row := cfg.rows[y]
+	at := strings.Index(row.render, text)
+	if at < 0 {
+		t.Fatalf("row %d %q doesn't hold %q", y, row.render, text)
+	}
+	for i := at; i < at+len(text); i++ {
+		if row.hl[i] != hl {
+			t.Errorf("%q in row %d: hl[%d] = %d, want %d", text, y, i, row.hl[i], hl)
+			return
+		}
+	}
+}
+
+func TestShellSyntax(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		`for f in "$HOME/a b" 'no $x'; do`,
+		`  if [ ${#f} -gt 10 ]; then echo $1 # done?`,
+		`  fi`,
+		`done`,
+	)
+	editorSetFileName(cfg, "run.sh")
+	editorSelectSyntaxHighlight(cfg)
+
+	if cfg.syntax == nil || cfg.syntax.fileType != "sh" {
+		t.Fatalf("syntax = %v, want sh", cfg.syntax)
+	}
+	assertHL(t, cfg, 0, "for", HL_KEYWORD)
+	assertHL(t, cfg, 0, " f ", HL_NORMAL)
+	assertHL(t, cfg, 0, "$HOME", HL_VARIABLE)
+	assertHL(t, cfg, 0, `/a b"`, HL_STRING)
+	assertHL(t, cfg, 0, `'no $x'`, HL_STRING)
+	assertHL(t, cfg, 0, "do", HL_KEYWORD)
+	assertHL(t, cfg, 1, "if", HL_KEYWORD)
+	assertHL(t, cfg, 1, "${#f}", HL_VARIABLE)
+	assertHL(t, cfg, 1, "10", HL_NUMBER)
+	assertHL(t, cfg, 1, "then", HL_KEYWORD)
+	assertHL(t, cfg, 1, "echo", HL_NORMAL)
+	assertHL(t, cfg, 1, "$1", HL_VARIABLE)
+	assertHL(t, cfg, 1, "# done?", HL_COMMENT)
+	assertHL(t, cfg, 2, "fi", HL_KEYWORD)
+	assertHL(t, cfg, 3, "done", HL_KEYWORD)
+}
+
+func TestGoStringsAndComments(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		`s := "http://x"`,
+		`// "not a string"`,
+		`q := "say \"hi\" // still" + 'x' // done`,
+	)
+	editorSetFileName(cfg, "main.go")
+	editorSelectSyntaxHighlight(cfg)
+
+	// strings, comments and escaped quotes are worked out in the one scan,
+	// so whichever starts first wins
+	assertHL(t, cfg, 0, `"http://x"`, HL_STRING)
+	assertHL(t, cfg, 1, `// "not a string"`, HL_COMMENT)
+	assertHL(t, cfg, 2, `hi`, HL_STRING)
+	assertHL(t, cfg, 2, ` // still"`, HL_STRING)
+	assertHL(t, cfg, 2, ` + `, HL_NORMAL)
+	assertHL(t, cfg, 2, `'x'`, HL_STRING)
+	assertHL(t, cfg, 2, `// done`, HL_COMMENT)
+}
+
+func TestBlockComments(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("x := %d", i)
+	}
+	lines[1] = "a := 1 /* starts"
+	lines[2] = "still"
+	lines[3] = `ends */ b := "/*"`
+	cfg := newTestEditor(t, "", lines...)
+	editorSetFileName(cfg, "main.go")
+	editorSelectSyntaxHighlight(cfg)
+	editorSyncHighlight(cfg, cfg.numRows)
+
+	assertHL(t, cfg, 1, "a := ", HL_NORMAL)
+	assertHL(t, cfg, 1, "/* starts", HL_COMMENT)
+	assertHL(t, cfg, 2, "still", HL_COMMENT)
+	assertHL(t, cfg, 3, "ends */", HL_COMMENT)
+	// the /* in a string opens nothing
+	assertHL(t, cfg, 3, `"/*"`, HL_STRING)
+	assertHL(t, cfg, 4, "x := ", HL_NORMAL)
+
+	// opening a comment is carried down as far as is drawn
+	cfg.cursorY, cfg.cursorX = 5, 0
+	editorInsertChar(cfg, '/')
+	editorInsertChar(cfg, '*')
+	drawnRows(cfg)
+	bottom := editorTextRows(cfg)
+	for y := 5; y < bottom; y++ {
+		assertHL(t, cfg, y, cfg.rows[y].chars[:1], HL_COMMENT)
+	}
+	// and the rest waits until it is drawn
+	if cfg.rows[bottom].hlInComment {
+		t.Errorf("row %d, off the screen, highlighted already", bottom)
+	}
+	cfg.cursorY = cfg.numRows - 1
+	drawnRows(cfg)
+	assertHL(t, cfg, cfg.numRows-1, "x := 99", HL_COMMENT)
+
+	// closing it again undoes that, without touching the comment above
+	cfg.cursorY, cfg.cursorX = 5, 2
+	editorInsertChar(cfg, '*')
+	editorInsertChar(cfg, '/')
+	drawnRows(cfg)
+	assertHL(t, cfg, 5, "/**/", HL_COMMENT)
+	assertHL(t, cfg, 6, "x := ", HL_NORMAL)
+	cfg.cursorY = cfg.numRows - 1
+	drawnRows(cfg)
+	assertHL(t, cfg, 99, "x := ", HL_NORMAL)
+	assertHL(t, cfg, 2, "still", HL_COMMENT)
+}
+
+func TestStringEscapes(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		`s := "a\nb"`,
+		`t := "\x41\u00e9\101\"q\\" + '\t'`,
+		`u := "\xg"`,
+	)
+	editorSetFileName(cfg, "main.go")
+	editorSelectSyntaxHighlight(cfg)
+
+	assertHL(t, cfg, 0, `"a`, HL_STRING)
+	assertHL(t, cfg, 0, `\n`, HL_STRING_ESCAPE)
+	assertHL(t, cfg, 0, `b"`, HL_STRING)
+	assertHL(t, cfg, 1, `\x41\u00e9\101\"`, HL_STRING_ESCAPE)
+	assertHL(t, cfg, 1, `q`, HL_STRING)
+	assertHL(t, cfg, 1, `\\`, HL_STRING_ESCAPE)
+	assertHL(t, cfg, 1, ` + `, HL_NORMAL)
+	assertHL(t, cfg, 1, `\t`, HL_STRING_ESCAPE)
+	// \x without its digits is only as long as it is
+	assertHL(t, cfg, 2, `\x`, HL_STRING_ESCAPE)
+	assertHL(t, cfg, 2, `g"`, HL_STRING)
+}
+
+func TestYAMLSyntax(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		`# settings`,
+		`name: "kilo: editor"`,
+		`ports:`,
+		`  - 8080`,
+		`  - host: example.com # public`,
+		`    tls: yes`,
+		`note: don't panic`,
+	)
+	editorSetFileName(cfg, "config.yaml")
+	editorSelectSyntaxHighlight(cfg)
+
+	assertHL(t, cfg, 0, "# settings", HL_COMMENT)
+	assertHL(t, cfg, 1, "name", HL_KEY)
+	assertHL(t, cfg, 1, `"kilo: editor"`, HL_STRING)
+	assertHL(t, cfg, 2, "ports", HL_KEY)
+	assertHL(t, cfg, 3, "- ", HL_NORMAL)
+	assertHL(t, cfg, 3, "8080", HL_NUMBER)
+	assertHL(t, cfg, 4, "host", HL_KEY)
+	assertHL(t, cfg, 4, "example.com ", HL_NORMAL)
+	assertHL(t, cfg, 4, "# public", HL_COMMENT)
+	assertHL(t, cfg, 5, "tls", HL_KEY)
+	assertHL(t, cfg, 5, "yes", HL_KEYWORD)
+	assertHL(t, cfg, 6, "don't panic", HL_NORMAL)
+}
+
+func TestMakefileSyntax(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		`CC := gcc # compiler`,
+		`SRCS = main.c \`,
+		`    util.c`,
+		`$(BIN): $(SRCS:.c=.o)`,
+		"\t$(CC) -o $@ $^",
+		`    echo "spaces"`,
+	)
+	editorSetFileName(cfg, filepath.Join("src", "Makefile"))
+	editorSelectSyntaxHighlight(cfg)
+
+	if cfg.syntax == nil || cfg.syntax.fileType != "make" {
+		t.Fatalf("syntax = %v, want make", cfg.syntax)
+	}
+	assertHL(t, cfg, 0, "CC := gcc ", HL_NORMAL)
+	assertHL(t, cfg, 0, "# compiler", HL_COMMENT)
+	assertHL(t, cfg, 3, "$(BIN)", HL_KEY)
+	assertHL(t, cfg, 3, "$(SRCS:.c=.o)", HL_VARIABLE)
+	assertHL(t, cfg, 4, "$(CC)", HL_VARIABLE)
+	assertHL(t, cfg, 4, "$@", HL_VARIABLE)
+	assertHL(t, cfg, 4, "$^", HL_VARIABLE)
+	assertHL(t, cfg, 5, `"spaces"`, HL_STRING)
+
+	for y := range cfg.numRows {
+		_, end, ok := editorRecipeIndent(cfg, y)
+		if want := y == 5; ok != want || ok && end != 4 {
+			t.Errorf("row %d: editorRecipeIndent = %d, %v, want %v", y, end, ok, want)
+		}
+	}
+}
+
+func TestMixedIndent(t *testing.T) {
+	dir := t.TempDir()
+	lines := []string{
+		"def f(x):",
+		"\tif x:",
+		"\t    return 1", // a tab and then a tab's worth of spaces
+		"  \treturn 2",   // spaces before a tab
+		"\t  # lined up", // fewer spaces after the tab are alignment
+		"        pass",
+	}
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	for _, name := range []string{"mixed.py", "mixed.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// on for python only
+	cfg := newTestEditor(t, "")
+	cfg.rc = rcConfig{"": {"tab_width": "4"}, "python": {"mixed_indent": "true"}}
+	if err := editorApplySettings(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorOpen(cfg, filepath.Join(dir, "mixed.py")); err != nil {
+		t.Fatal(err)
+	}
+
+	// opening the file checks it
+	if want := "2 lines mix tabs and spaces in their indentation, the first is line 3"; cfg.statusMsg != want {
+		t.Errorf("message %q, want %q", cfg.statusMsg, want)
+	}
+	// the whole indentation is marked, in screen columns
+	ends := map[int]int{2: 8, 3: 4}
+	for y := range cfg.numRows {
+		_, end, ok := editorMixedIndent(cfg, y)
+		if want, mixed := ends[y]; ok != mixed || end != want {
+			t.Errorf("row %d: editorMixedIndent = %d, %v, want %d, %v", y, end, ok, want, mixed)
+		}
+	}
+
+	cfg = newTestEditor(t, "")
+	cfg.rc = rcConfig{"": {"tab_width": "4"}, "python": {"mixed_indent": "true"}}
+	if err := editorApplySettings(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorOpen(cfg, filepath.Join(dir, "mixed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := editorMixedIndent(cfg, 2); ok || cfg.statusMsg != "" {
+		t.Errorf("mixed indentation reported for a text file: %q", cfg.statusMsg)
+	}
+
+	// as do making it python and reading it again
+	editorSetSyntax(cfg, "python")
+	if !strings.HasPrefix(cfg.statusMsg, "2 lines mix") {
+		t.Errorf("after switching to python, message %q", cfg.statusMsg)
+	}
+	cfg.statusMsg = ""
+	if err := editorReload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cfg.statusMsg, "2 lines mix") {
+		t.Errorf("after reloading, message %q", cfg.statusMsg)
+	}
+}
+
+func TestSelectSyntaxByName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		fileType string
+	}{
+		{"main.go", "go"},
+		{"/src/Dockerfile", "dockerfile"},
+		{"Dockerfile.dev", "dockerfile"},
+		{"web.dockerfile", "dockerfile"},
+		{"Makefile", "make"},
+		{"rules.mk", "make"},
+		{"/home/me/.bashrc", "sh"},
+		{"Dockerfiles", ""},
+		{"notes.txt", ""},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestEditor(t, "")
+		editorSetFileName(cfg, tt.fileName)
+		editorSelectSyntaxHighlight(cfg)
+
+		got := ""
+		if cfg.syntax != nil {
+			got = cfg.syntax.fileType
+		}
+		if got != tt.fileType {
+			t.Errorf("%s: fileType = %q, want %q", tt.fileName, got, tt.fileType)
+		}
+	}
+}
+
+func TestGuide(t *testing.T) {
+	sgr := regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	// guideAt is the screen column the guide is drawn at on each row
+	guideAt := func(cfg *EditorConfig) []int {
+		var buf bytes.Buffer
+		editorScroll(cfg)
+		editorDrawRows(cfg, &buf)
+
+		var at []int
+		for _, row := range screenRows(buf.String())[:cfg.numRows] {
+			before, _, ok := strings.Cut(row, GuideBackground)
+			if !ok {
+				at = append(at, -1)
+				continue
+			}
+			at = append(at, len(sgr.ReplaceAllString(before, "")))
+		}
+		return at
+	}
+
+	cfg := newTestEditor(t, "", "short", strings.Repeat("x", 30))
+	cfg.lineNumbers = true
+	cfg.guideColumn = 10
+	if got := guideAt(cfg); !slices.Equal(got, []int{-1, -1}) {
+		t.Errorf("guide drawn at %v while off", got)
+	}
+
+	// after the two columns of line numbers, on the text and past it alike
+	cfg.guide = true
+	if got := guideAt(cfg); !slices.Equal(got, []int{11, 11}) {
+		t.Errorf("guide drawn at %v, want 11", got)
+	}
+
+	// scrolled right, it moves left with the text
+	cfg.winSize.Col = 15
+	cfg.cursorY, cfg.cursorX = 1, 20
+	if got := guideAt(cfg); cfg.colOff != 8 || !slices.Equal(got, []int{3, 3}) {
+		t.Errorf("with colOff %d guide drawn at %v, want 3", cfg.colOff, got)
+	}
+
+	// and goes when it is scrolled off
+	cfg.cursorX = 29
+	if got := guideAt(cfg); !slices.Equal(got, []int{-1, -1}) {
+		t.Errorf("with colOff %d guide drawn at %v, want none", cfg.colOff, got)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	cfg := newTestEditor(t, "", "fits", "just fits", "too long by 3", "\tlong")
+	cfg.maxLineLength = 9
+
+	var buf bytes.Buffer
+	editorScroll(cfg)
+	editorDrawRows(cfg, &buf)
+
+	// the text drawn on the overflow background on each row
+	escape := regexp.MustCompile(`^\x1b\[[0-9;?]*[a-zA-Z]`)
+	want := []string{"", "", "by 3", "ong"}
+	for y, row := range screenRows(buf.String())[:cfg.numRows] {
+		var flagged strings.Builder
+		overflow := false
+		for row != "" {
+			if seq := escape.FindString(row); seq != "" {
+				if seq == OverflowBackground {
+					overflow = true
+				} else if strings.HasPrefix(seq, "\x1b[4") && strings.HasSuffix(seq, "m") {
+					overflow = false
+				}
+				row = row[len(seq):]
+				continue
+			}
+			if overflow {
+				flagged.WriteByte(row[0])
+			}
+			row = row[1:]
+		}
+		if got := flagged.String(); got != want[y] {
+			t.Errorf("row %d: %q flagged, want %q", y, got, want[y])
+		}
+	}
+}
+
+// changeOnDisk rewrites path as some other program would, a second later
+// so the change shows even where file times are coarse
+func changeOnDisk(t *testing.T, path, contents string) {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadChangedOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gen.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+		cfg.cursorY, cfg.cursorX = 1, 2
+
+		// nothing changed yet
+		editorIdle(cfg)
+		assertRows(t, cfg, "one", "two", "three")
+
+		changeOnDisk(t, path, "one\nTWO!\n")
+		editorIdle(cfg)
+		assertRows(t, cfg, "one", "TWO!")
+		if cfg.dirty || cfg.cursorY != 1 || cfg.cursorX != 2 {
+			t.Errorf("dirty = %v, cursor at %d:%d, want a clean buffer at 1:2", cfg.dirty, cfg.cursorY, cfg.cursorX)
+		}
+	})
+
+	t.Run("extra cursors", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("foo foo foo foo\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := newTestEditor(t, "\x0e\x0e\x0e")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+		pressKeys(t, cfg)
+		if len(cfg.cursors) != 3 {
+			t.Fatalf("cursors = %v, want 3", cfg.cursors)
+		}
+
+		// they'd be past the end of the shorter line
+		changeOnDisk(t, path, "foo\n")
+		editorIdle(cfg)
+		cfg.reader = bufio.NewReader(strings.NewReader("\x7f"))
+		pressKeys(t, cfg)
+		assertRows(t, cfg, "foo")
+		if len(cfg.cursors) != 0 {
+			t.Errorf("cursors = %v after reloading", cfg.cursors)
+		}
+	})
+
+	for _, tt := range []struct {
+		answer string
+		want   []string
+	}{
+		{"n\r", []string{"mine"}},
+		{"y\r", []string{"theirs"}},
+	} {
+		t.Run("dirty "+strings.TrimSpace(tt.answer), func(t *testing.T) {
+			if err := os.WriteFile(path, []byte("base\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := newTestEditor(t, tt.answer)
+			if err := editorOpen(cfg, path); err != nil {
+				t.Fatal(err)
+			}
+			editorDelRow(cfg, 0)
+			editorInsertRow(cfg, "mine", 0)
+			cfg.dirty = true
+
+			changeOnDisk(t, path, "theirs\n")
+			editorIdle(cfg)
+			assertRows(t, cfg, tt.want...)
+
+			// the same change isn't asked about twice
+			cfg.reader = bufio.NewReader(strings.NewReader("y\r"))
+			editorIdle(cfg)
+			assertRows(t, cfg, tt.want...)
+		})
+	}
+}
+
+func TestOpenTemplate(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "header.txt")
+	if err := os.WriteFile(template, []byte("// Copyright\n\npackage main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("new file", func(t *testing.T) {
+		path := filepath.Join(dir, "new.go")
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+		if err := editorOpenTemplate(cfg, template); err != nil {
+			t.Fatal(err)
+		}
+		assertRows(t, cfg, "// Copyright", "", "package main")
+		if !cfg.dirty {
+			t.Error("buffer from a template isn't dirty")
+		}
+
+		editorSave(cfg)
+		if got, _ := os.ReadFile(path); string(got) != "// Copyright\n\npackage main\n" {
+			t.Errorf("saved %q", got)
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		path := filepath.Join(dir, "old.go")
+		if err := os.WriteFile(path, []byte("package old\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+		if err := editorOpenTemplate(cfg, template); err != nil {
+			t.Fatal(err)
+		}
+		assertRows(t, cfg, "package old")
+	})
+
+	t.Run("missing template", func(t *testing.T) {
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, filepath.Join(dir, "other.go")); err != nil {
+			t.Fatal(err)
+		}
+		if err := editorOpenTemplate(cfg, filepath.Join(dir, "nope")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("err = %v, want fs.ErrNotExist", err)
+		}
+		if cfg.numRows != 0 || cfg.dirty {
+			t.Errorf("numRows = %d, dirty = %v, want an empty clean buffer", cfg.numRows, cfg.dirty)
+		}
+	})
+}
+
+func TestSaveStreamsRows(t *testing.T) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\twith a tab", i)
+	}
+	path := filepath.Join(t.TempDir(), "big.txt")
+	cfg := newTestEditor(t, "", lines...)
+	editorSetFileName(cfg, path)
+
+	editorSave(cfg)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(lines, "\n") + "\n"; string(data) != want {
+		t.Errorf("saved %d bytes that differ from the buffer's %d", len(data), len(want))
+	}
+	if want := fmt.Sprintf("%d bytes, 1000 lines written to disk", len(data)); cfg.statusMsg != want {
+		t.Errorf("status %q, want %q", cfg.statusMsg, want)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var reports []int
+	var buf bytes.Buffer
+	p := &progressWriter{w: &buf, step: 10, report: func(n int) { reports = append(reports, n) }}
+
+	for _, chunk := range []string{"12345", "678", "90123456789012", "3", "4567890"} {
+		io.WriteString(p, chunk)
+	}
+
+	// once for each write that passes a multiple of 10, with the total so far
+	if !slices.Equal(reports, []int{22, 30}) || buf.Len() != 30 {
+		t.Errorf("reports = %v after writing %d bytes", reports, buf.Len())
+	}
+}
+
+func TestWriteRowsMatchesString(t *testing.T) {
+	tests := []struct {
+		name           string
+		lines          []string
+		noFinalNewline bool
+	}{
+		{"empty", nil, false},
+		{"lines", []string{"a", "", "\tb"}, false},
+		{"no final newline", []string{"a", "b"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", tt.lines...)
+			cfg.noFinalNewline = tt.noFinalNewline
+
+			var buf bytes.Buffer
+			n, err := writeRows(cfg, cfg.rows, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := editorRowsToString(cfg); buf.String() != want || n != len(want) {
+				t.Errorf("streamed %q (%d bytes), want %q", buf.String(), n, want)
+			}
+		})
+	}
+}
+
+func TestSaveReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run.sh")
+	if err := os.WriteFile(path, []byte("old\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.sh")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestEditor(t, "", "new")
+	editorSetFileName(cfg, link)
+	editorSave(cfg)
+
+	if got, _ := os.ReadFile(path); string(got) != "new\n" {
+		t.Errorf("file holds %q, want %q", got, "new\n")
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("link replaced by the save: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0o755 {
+		t.Errorf("mode after save = %v, want 0755", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("save left %d files behind, want 2", len(entries))
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    []string
+	}{
+		{"true", []string{"Kilo editor -- version " + KILO_VERSION}},
+		{"false", nil},
+		{`"  hello  "`, []string{"  hello  "}},
+		{"keys", []string{"Kilo editor -- version " + KILO_VERSION, "ctrl-s   save", "ctrl-q   quit", "ctrl-f   find", "ctrl-e   command"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			cfg := newTestEditor(t, "")
+			cfg.rc = rcConfig{"": {"welcome": tt.setting}}
+			if err := editorApplySettings(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			var shown []string
+			for _, row := range drawnRows(cfg) {
+				if text := strings.TrimSpace(strings.TrimPrefix(row, "~")); text != "" {
+					shown = append(shown, text)
+				}
+			}
+			want := make([]string, len(tt.want))
+			for i, line := range tt.want {
+				want[i] = strings.TrimSpace(line)
+			}
+			if !slices.Equal(shown, want) {
+				t.Errorf("shown %q, want %q", shown, want)
+			}
+		})
+	}
+}
+
+func TestHelp(t *testing.T) {
+	screen, err := os.CreateTemp(t.TempDir(), "screen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Close()
+
+	// F1 opens it, down scrolls a line and q closes it again
+	cfg := newTestEditor(t, "\x1bOP\x1b[Bqx", "text")
+	cfg.out = screen
+	cfg.winSize.Row = 7
+	cfg.rc = rcConfig{"keys": {"ctrl-d": "delete-line"}}
+	if err := editorBindKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorProcessKeyPress(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	drawn, err := os.ReadFile(screen.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := strings.Split(string(drawn), "\x1b[?25l")[1:]
+	if len(frames) != 2 {
+		t.Fatalf("help drawn %d times, want 2", len(frames))
+	}
+	first, second := frames[0], frames[1]
+	for _, want := range []string{"Keys", "ctrl-d       delete-line", "ctrl-/       help"} {
+		if !strings.Contains(first+second, want) {
+			t.Errorf("help doesn't list %q", want)
+		}
+	}
+	if !strings.Contains(first, "Help: lines 1-5") || !strings.Contains(second, "Help: lines 2-6") {
+		t.Errorf("help didn't scroll down a line")
+	}
+
+	// the key after q is for the buffer again
+	if err := editorProcessKeyPress(cfg); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, cfg, "xtext")
+}
+
+func TestHelpNarrow(t *testing.T) {
+	cfg := newTestEditor(t, "")
+	cfg.winSize.Col = 10
+
+	var buf bytes.Buffer
+	editorDrawHelp(cfg, &buf, []string{"ctrl-é  déplacer", "日本語のヘルプ"}, 0)
+	shown := regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`).ReplaceAllString(buf.String(), "\n")
+	if !utf8.ValidString(shown) {
+		t.Fatalf("help %q isn't valid UTF-8", shown)
+	}
+	for _, line := range strings.Split(shown, "\n") {
+		if w := stringWidth(strings.TrimSuffix(line, "\r")); w > 10 {
+			t.Errorf("help line %q is %d columns, want at most 10", line, w)
+		}
+	}
+	for _, want := range []string{"ctrl-é  d…", "日本語の…"} {
+		if !strings.Contains(shown, want) {
+			t.Errorf("help %q doesn't show %q", shown, want)
+		}
+	}
+}
+
+func TestMessageBarLongMessage(t *testing.T) {
+	cfg := newTestEditor(t, "")
+	cfg.winSize.Col = 20
+	editorSetStatusMessage(cfg, "%s", strings.Repeat("日本", 10))
+
+	var buf bytes.Buffer
+	editorDrawMessageBar(cfg, &buf)
+
+	shown := strings.TrimPrefix(buf.String(), "\x1b[K")
+	if !utf8.ValidString(shown) || stringWidth(shown) > 20 || !strings.HasSuffix(shown, "…") {
+		t.Errorf("shown %q (%d columns), want valid UTF-8 in 20 columns ending in …", shown, stringWidth(shown))
+	}
+	if want := strings.Repeat("日本", 4) + "日…"; shown != want {
+		t.Errorf("shown %q, want %q", shown, want)
+	}
+
+	// an old message is gone
+	cfg.statusMsgTime = time.Now().Add(-KILO_MESSAGE_TIMEOUT)
+	buf.Reset()
+	editorDrawMessageBar(cfg, &buf)
+	if buf.String() != "\x1b[K" {
+		t.Errorf("expired message drawn as %q", buf.String())
+	}
+}
+
+func TestSavedIndicator(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := newTestEditor(t, "", "text")
+	cfg.now = func() time.Time { return now }
+	cfg.showSaved = true
+	editorSetFileName(cfg, filepath.Join(t.TempDir(), "notes.txt"))
+
+	statusBar := func() string {
+		var buf bytes.Buffer
+		editorDrawStatusBar(cfg, &buf)
+		return buf.String()
+	}
+
+	if bar := statusBar(); strings.Contains(bar, "saved") {
+		t.Errorf("status bar %q says saved before any save", bar)
+	}
+
+	editorSave(cfg)
+	now = now.Add(12*time.Second + 300*time.Millisecond)
+	if bar := statusBar(); !strings.Contains(bar, "saved 12s ago | ") {
+		t.Errorf("status bar %q doesn't say saved 12s ago", bar)
+	}
+
+	// it gives way to the file name on a narrow screen
+	cfg.winSize.Col = 50
+	if bar := statusBar(); strings.Contains(bar, "saved") || !strings.Contains(bar, "notes.txt") {
+		t.Errorf("narrow status bar %q", bar)
+	}
+
+	for elapsed, want := range map[time.Duration]string{
+		0:                "saved just now",
+		59 * time.Second: "saved 59s ago",
+		90 * time.Second: "saved 1m ago",
+		3 * time.Hour:    "saved 3h ago",
+	} {
+		if got := savedAgo(elapsed); got != want {
+			t.Errorf("savedAgo(%v) = %q, want %q", elapsed, got, want)
+		}
+	}
+}
+
+func TestViewMode(t *testing.T) {
+	lines := []string{"one", "two", "three", "four"}
+
+	// Typing, Enter, Tab, Backspace and Ctrl-K change nothing
+	cfg := newTestEditor(t, "xyz\r\t\x7f\x0b", lines...)
+	cfg.view, cfg.readOnly = true, true
+	pressKeys(t, cfg)
+	assertRows(t, cfg, lines...)
+	if cfg.dirty {
+		t.Error("buffer is dirty in view mode")
+	}
+
+	// / searches, G goes to the end, g back to the start and :3 to line 3
+	cfg = newTestEditor(t, "/thr\r", lines...)
+	cfg.view, cfg.readOnly = true, true
+	pressKeys(t, cfg)
+	if cfg.cursorY != 2 || cfg.cursorX != 2 {
+		t.Errorf("cursor at %d,%d after searching, want 2,2", cfg.cursorY, cfg.cursorX)
+	}
+
+	for _, tt := range []struct {
+		keys string
+		y    int
+	}{
+		{"G", 3},
+		{"Gg", 0},
+		{":3\r", 2},
+		{"jj", 2},
+		{"Gk", 2},
+	} {
+		cfg := newTestEditor(t, tt.keys, lines...)
+		cfg.view, cfg.readOnly = true, true
+		pressKeys(t, cfg)
+		if cfg.cursorY != tt.y {
+			t.Errorf("%q: cursor on line %d, want %d", tt.keys, cfg.cursorY, tt.y)
+		}
+	}
+}
+
+func TestSaveCopy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestEditor(t, "")
+	if err := editorOpen(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	editorInsertChar(cfg, 'x')
+
+	// the name is asked for when the command doesn't give one
+	copyPath := filepath.Join(dir, "copy.txt")
+	cfg.reader = bufio.NewReader(strings.NewReader(copyPath + "\r"))
+	editorSaveCopy(cfg, "")
+
+	if got, _ := os.ReadFile(copyPath); string(got) != "xold\n" {
+		t.Errorf("copy holds %q, want %q", got, "xold\n")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "old\n" {
+		t.Errorf("file holds %q, want it left alone", got)
+	}
+	if cfg.fileName != path || !cfg.dirty {
+		t.Errorf("fileName = %q, dirty = %v after saving a copy, want %q, true", cfg.fileName, cfg.dirty, path)
+	}
+}
+
+func TestConfirmDiscard(t *testing.T) {
+	actions := map[string]func(cfg *EditorConfig){
+		"reload command":  func(cfg *EditorConfig) { editorRunCommand(cfg, "reload") },
+		"changed on disk": editorCheckDisk,
+	}
+	tests := []struct {
+		dirty  bool
+		answer string
+		lost   bool
+	}{
+		{true, "y\r", true},
+		{true, "n\r", false},
+		{true, "\x1b", false},
+		// with nothing to lose there is nothing to ask
+		{false, "", true},
+	}
+
+	for name, action := range actions {
+		for _, tt := range tests {
+			path := filepath.Join(t.TempDir(), "file.txt")
+			if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := newTestEditor(t, tt.answer)
+			if err := editorOpen(cfg, path); err != nil {
+				t.Fatal(err)
+			}
+			if tt.dirty {
+				editorInsertChar(cfg, 'x')
+			}
+			if err := os.WriteFile(path, []byte("new on disk\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			before := rowsOf(cfg)
+			action(cfg)
+			if tt.lost {
+				assertRows(t, cfg, "new on disk")
+			} else if got := rowsOf(cfg); !slices.Equal(got, before) {
+				t.Errorf("%s, answer %q: rows = %q, want %q kept", name, tt.answer, got, before)
+			}
+			if cfg.dirty == tt.lost {
+				t.Errorf("%s, answer %q: dirty = %v", name, tt.answer, cfg.dirty)
+			}
+		}
+	}
+}
+
+func TestTrimBlankLines(t *testing.T) {
+	content := "first\n\nlast\n\n  \n\n"
+	for _, trim := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "file.txt")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := newTestEditor(t, "")
+		cfg.trimBlankLines = trim
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+		cfg.cursorY = cfg.numRows
+		editorSave(cfg)
+
+		// the three at the end go down to one, the one between lines stays
+		want := content
+		if trim {
+			want = "first\n\nlast\n\n"
+		}
+		if got, _ := os.ReadFile(path); string(got) != want {
+			t.Errorf("trim %v: saved %q, want %q", trim, got, want)
+		}
+		if trim && (cfg.cursorY != cfg.numRows || !strings.HasSuffix(cfg.statusMsg, "2 blank lines at the end trimmed")) {
+			t.Errorf("cursor on row %d of %d, message %q", cfg.cursorY, cfg.numRows, cfg.statusMsg)
+		}
+	}
+
+	// a save that fails leaves the buffer as it was
+	dir := filepath.Join(t.TempDir(), "gone")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestEditor(t, "")
+	cfg.trimBlankLines = true
+	if err := editorOpen(cfg, filepath.Join(dir, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"text", "", ""} {
+		editorInsertRow(cfg, line, cfg.numRows)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	editorSave(cfg)
+	if !strings.HasPrefix(cfg.statusMsg, "Can't save") {
+		t.Fatalf("saving into a missing directory: %q", cfg.statusMsg)
+	}
+	assertRows(t, cfg, "text", "", "")
+}
+
+func TestModeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		tabWidth int
+		softTabs bool
+		fileType string
+	}{
+		{"first.txt", "# kilo: tabstop=4 softtabs filetype=sh\necho hi\n", 4, true, "sh"},
+		{"last.c", "int x;\n" + strings.Repeat("\n", 20) + "/* kilo: tabstop=2 */\n", 2, false, "c"},
+		{"malformed.txt", "// kilo: tabstop=4 wrap\n", KILO_TAB_STOP, false, ""},
+		{"too-wide.txt", "// kilo: tabstop=100\n", KILO_TAB_STOP, false, ""},
+		{"middle.txt", strings.Repeat("x\n", 10) + "kilo: tabstop=4\n" + strings.Repeat("x\n", 10), KILO_TAB_STOP, false, ""},
+		{"word.txt", "mykilo: tabstop=4\n", KILO_TAB_STOP, false, ""},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := newTestEditor(t, "")
+		if err := editorOpen(cfg, path); err != nil {
+			t.Fatal(err)
+		}
+
+		fileType := ""
+		if cfg.syntax != nil {
+			fileType = cfg.syntax.fileType
+		}
+		if cfg.tabWidth != tt.tabWidth || cfg.softTabs != tt.softTabs || fileType != tt.fileType {
+			t.Errorf("%s: tabWidth = %d, softTabs = %v, fileType = %q, want %d, %v, %q",
+				tt.name, cfg.tabWidth, cfg.softTabs, fileType, tt.tabWidth, tt.softTabs, tt.fileType)
+		}
+	}
+}
+
+func TestInsertDate(t *testing.T) {
+	cfg := newTestEditor(t, "", "Released ")
+	cfg.now = func() time.Time { return time.Date(2024, 3, 9, 14, 5, 0, 0, time.UTC) }
+	cfg.cursorX = cfg.rows[0].size
+
+	editorInsertDate(cfg, "")
+	assertRows(t, cfg, "Released 2024-03-09")
+
+	cfg.rc = rcConfig{"": {"date_format": "Jan 2, 2006 15:04"}}
+	if err := editorApplySettings(cfg); err != nil {
+		t.Fatal(err)
+	}
+	editorInsertChar(cfg, ' ')
+	editorInsertDate(cfg, "")
+	assertRows(t, cfg, "Released 2024-03-09 Mar 9, 2024 14:05")
+
+	// a layout given to the command wins
+	editorInsertDate(cfg, " 15h")
+	assertRows(t, cfg, "Released 2024-03-09 Mar 9, 2024 14:05 14h")
+}
+
+func TestOverwrite(t *testing.T) {
+	// Insert turns overwrite on, typing replaces "ab" and then runs past
+	// the end of the line, and Insert again goes back to inserting
+	cfg := newTestEditor(t, "\x1b[2~xyzw\x1b[2~\x1b[D!", "ab")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "xyz!w")
+
+	cfg = newTestEditor(t, "\x1b[2~\x1b[C\u00e9", "a\u00fcb")
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "a\u00e9b")
+	if !cfg.overwrite {
+		t.Error("overwrite is off after one Insert")
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	cfg := newTestEditor(t, "", "package main", "", "func main() {}")
+	editorSetFileName(cfg, "main.txt")
+	editorSetSyntax(cfg, "go")
+	cfg.noFinalNewline = true
+	editorGoTo(cfg, 3, 6)
+	editorInsertChar(cfg, 'x')
+
+	data, err := EncodeDocument(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestEditor(t, "", "something else")
+	if err := DecodeDocument(loaded, data); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, loaded, "package main", "", "func xmain() {}")
+	if loaded.fileName != "main.txt" || loaded.syntax == nil || loaded.syntax.fileType != "go" {
+		t.Errorf("fileName = %q, syntax = %v, want main.txt with go syntax", loaded.fileName, loaded.syntax)
+	}
+	if loaded.cursorY != 2 || loaded.cursorX != 6 || !loaded.dirty || !loaded.noFinalNewline {
+		t.Errorf("cursor at %d,%d, dirty = %v, noFinalNewline = %v, want 2,6, true, true",
+			loaded.cursorY, loaded.cursorX, loaded.dirty, loaded.noFinalNewline)
+	}
+
+	again, err := EncodeDocument(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Errorf("round trip changed the document:\n%s\n%s", data, again)
+	}
+
+	if err := DecodeDocument(loaded, []byte(`{"version": 99}`)); err == nil {
+		t.Error("a document of another version was loaded")
+	}
+}
+
+// TestDrawGolden draws buffers on a small screen and compares what is sent
+// to the terminal, escape sequences and all, with testdata/draw. Run with
+// -update to write the files again after a change meant to alter them
+func TestDrawGolden(t *testing.T) {
+	long := "// " + strings.Repeat("0123456789", 6)
+	numbered := make([]string, 30)
+	for i := range numbered {
+		numbered[i] = fmt.Sprintf("line %d", i+1)
+	}
+
+	tests := []struct {
+		name     string
+		fileName string
+		lines    []string
+		cursorY  int
+		cursorX  int
+	}{
+		{"plain", "notes.txt", []string{"Hello, world", "", "second paragraph"}, 0, 0},
+		{"tabs", "notes.txt", []string{"a:", "\tb", "\t\tc\td"}, 2, 0},
+		{"go", "main.go", []string{"package main", "", "// say hi", "func main() {", "\tfmt.Println(\"hi\", 42)", "}"}, 5, 0},
+		{"clamped", "notes.txt", []string{long, "short"}, 1, 0},
+		{"scrolled-right", "notes.txt", []string{long, "short"}, 0, 50},
+		{"scrolled-down", "notes.txt", numbered, 20, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestEditor(t, "", tt.lines...)
+			cfg.winSize = &unix.Winsize{Row: 10, Col: 30}
+			editorSetFileName(cfg, tt.fileName)
+			editorSelectSyntaxHighlight(cfg)
+			cfg.cursorY, cfg.cursorX = tt.cursorY, tt.cursorX
+			editorScroll(cfg)
+
+			var buf bytes.Buffer
+			editorDrawRows(cfg, &buf)
+
+			// a quoted line per screen row keeps the file readable and
+			// every byte in it
+			var got strings.Builder
+			for _, row := range regexp.MustCompile(`(?:\x1b\[\d+;1H)`).Split(buf.String(), -1) {
+				fmt.Fprintf(&got, "%q\n", row)
+			}
+
+			path := filepath.Join("testdata", "draw", tt.name+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(got.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got.String() != string(want) {
+				t.Errorf("drawn rows differ from %s:\ngot:\n%s\nwant:\n%s", path, got.String(), want)
+			}
+		})
+	}
+}
+
+func TestMultipleCursors(t *testing.T) {
+	lines := []string{"foo := 1", "bar(foo, foo)", "food", "foo"}
+
+	// Ctrl-N twice adds cursors in the next two foos, skipping food, and
+	// what is typed goes in at all three
+	cfg := newTestEditor(t, "\x0e\x0ex", lines...)
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "xfoo := 1", "bar(xfoo, xfoo)", "food", "foo")
+	if want := []mark{{5, 1}, {11, 1}}; !slices.Equal(cfg.cursors, want) {
+		t.Errorf("cursors = %v, want %v", cfg.cursors, want)
+	}
+
+	// Backspace deletes at every cursor, and an arrow key drops the extras
+	cfg.reader = bufio.NewReader(strings.NewReader("\x7f\x1b[Cy"))
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "fyoo := 1", "bar(foo, foo)", "food", "foo")
+	if len(cfg.cursors) != 0 {
+		t.Errorf("cursors = %v after an arrow key", cfg.cursors)
+	}
+
+	// adding wraps around the end of the buffer, and stops at the cursors
+	// there already
+	cfg = newTestEditor(t, "", lines...)
+	cfg.cursorY = 3
+	for range 4 {
+		editorAddCursor(cfg)
+	}
+	if want := []mark{{0, 0}, {4, 1}, {9, 1}}; !slices.Equal(cfg.cursors, want) {
+		t.Errorf("cursors = %v, want %v", cfg.cursors, want)
+	}
+
+	// a Backspace that joins the word to the one before it leaves the
+	// last cursor ahead of where the word now starts
+	cfg = newTestEditor(t, "\x0e\x7f\x0e", "ab foo", "foo")
+	cfg.cursorX = 3
+	pressKeys(t, cfg)
+	assertRows(t, cfg, "abfoo", "foo")
+}
+
+func TestAlign(t *testing.T) {
+	cfg := newTestEditor(t, "", "[kilo]", "name = kilo", "version = 1", "\tx = 2", "no delimiter", "after = 3")
+	cfg.selecting = true
+	cfg.anchorY, cfg.anchorX = 1, 0
+	cfg.cursorY, cfg.cursorX = 4, 0
+
+	editorAlign(cfg, "=")
+	// the tab takes up 8 columns, so x's = is the furthest along
+	assertRows(t, cfg, "[kilo]", "name      = kilo", "version   = 1", "\tx = 2", "no delimiter", "after = 3")
+	if !cfg.dirty {
+		t.Error("buffer isn't dirty after aligning")
+	}
+
+	// aligned lines stay as they are
+	cfg.dirty = false
+	cfg.selecting = true
+	editorAlign(cfg, "=")
+	if cfg.dirty {
+		t.Error("aligning again changed the buffer")
+	}
+}
+
+func TestDeindent(t *testing.T) {
+	cfg := newTestEditor(t, "",
+		"func f() {",
+		"\t\tif x {",
+		"\t\t\ty()",
+		"",
+		"\t\t}",
+		"}",
+	)
+	cfg.tabWidth = 4
+	for i := range cfg.rows {
+		editorUpdateRow(cfg, &cfg.rows[i])
+	}
+	cfg.selecting = true
+	cfg.anchorY, cfg.anchorX = 1, 3
+	cfg.cursorY, cfg.cursorX = 4, 3
+
+	editorDeindent(cfg, "")
+	// the blank line doesn't pull the shared indentation down to nothing
+	assertRows(t, cfg, "func f() {", "if x {", "\ty()", "", "}", "}")
+	if !cfg.dirty || !cfg.selecting {
+		t.Errorf("dirty %v, selecting %v after deindenting", cfg.dirty, cfg.selecting)
+	}
+	if cfg.anchorX != 1 || cfg.cursorX != 1 {
+		t.Errorf("selection ends at %d and %d, want 1 and 1", cfg.anchorX, cfg.cursorX)
+	}
+
+	// spaces and a tab that spans the shared indentation
+	cfg = newTestEditor(t, "", "      a", "\tb", "")
+	cfg.selecting = true
+	cfg.cursorY = 2
+	editorDeindent(cfg, "")
+	assertRows(t, cfg, "a", "  b", "")
+
+	cfg.dirty = false
+	cfg.selecting = true
+	cfg.anchorY, cfg.cursorY = 0, 1
+	editorDeindent(cfg, "")
+	if cfg.dirty {
+		t.Error("deindenting a block at column 0 changed the buffer")
+	}
+}
+
+func TestFileTypeSettings(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rc := rcConfig{
+		"":       {"tab_width": "8", "soft_tabs": "false", "color_string": "92"},
+		"python": {"tab_width": "4", "soft_tabs": "true", "color_comment": "95"},
+	}
+
+	tests := []struct {
+		path     string
+		tabWidth int
+		softTabs bool
+	}{
+		// the python section wins over the global settings
+		{write("new.py", "print(1)\n"), 4, true},
+		// the global settings stand for other files
+		{write("notes.txt", "text\n"), 8, false},
+		// and the file's own indentation over both
+		{write("tabs.py", "if x:\n\ty()\n\tz()\n"), 4, false},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestEditor(t, "")
+		cfg.rc = rc
+		if err := editorApplySettings(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := editorOpen(cfg, tt.path); err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.tabWidth != tt.tabWidth || cfg.softTabs != tt.softTabs {
+			t.Errorf("%s: tabWidth = %d, softTabs = %v, want %d, %v",
+				filepath.Base(tt.path), cfg.tabWidth, cfg.softTabs, tt.tabWidth, tt.softTabs)
+		}
+
+		if got := editorSyntaxToColor(cfg, HL_STRING); got != 92 {
+			t.Errorf("%s: string color = %d, want 92", filepath.Base(tt.path), got)
+		}
+		want := uint8(ColorBrightBlack)
+		if cfg.syntax != nil && cfg.syntax.fileType == "python" {
+			want = 95
+		}
+		if got := editorSyntaxToColor(cfg, HL_COMMENT); got != want {
+			t.Errorf("%s: comment color = %d, want %d", filepath.Base(tt.path), got, want)
+		}
+	}
+}
+
+func TestBackspaceIndentLevel(t *testing.T) {
+	tests := []struct {
+		line     string
+		cursorX  int
+		softTabs bool
+		want     string
+	}{
+		// back to the tab stop before, a whole level or what is left of one
+		{"        x", 8, true, "    x"},
+		{"      x", 6, true, "    x"},
+		{"   x", 3, true, "x"},
+		// past the indentation, or with hard tabs, one character at a time
+		{"    ab", 6, true, "    a"},
+		{"    x", 4, false, "   x"},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestEditor(t, "\x7f", tt.line)
+		editorSetIndent(cfg, 4, tt.softTabs)
+		cfg.cursorX = tt.cursorX
+		pressKeys(t, cfg)
+		assertRows(t, cfg, tt.want)
+	}
+}
+
+func TestScrollbar(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = strings.Repeat("x", 100)
+	}
+	cfg := newTestEditor(t, "", lines...)
+	cfg.scrollbar = true
+	height := editorTextRows(cfg)
+
+	// thumbAt is the screen rows drawn with the thumb
+	thumbAt := func() []int {
+		var buf bytes.Buffer
+		editorScroll(cfg)
+		editorDrawRows(cfg, &buf)
+
+		var at []int
+		for y, row := range screenRows(buf.String()) {
+			if strings.Contains(row, ScrollbarThumb) {
+				at = append(at, y)
+			}
+		}
+		return at
+	}
+	rows := func(start, end int) []int {
+		var r []int
+		for y := start; y < end; y++ {
+			r = append(r, y)
+		}
+		return r
+	}
+
+	size := height * height / len(lines)
+	if got, want := thumbAt(), rows(0, size); !slices.Equal(got, want) {
+		t.Errorf("at the top thumb drawn at %v, want %v", got, want)
+	}
+
+	// halfway down the file, halfway down the screen
+	cfg.cursorY = 50 + height/2
+	cfg.rowOff = 50
+	start := 50 * height / len(lines)
+	if got, want := thumbAt(), rows(start, start+size); !slices.Equal(got, want) {
+		t.Errorf("with rowOff %d thumb drawn at %v, want %v", cfg.rowOff, got, want)
+	}
+
+	// at the end it reaches the bottom
+	cfg.cursorY = 99
+	if got, want := thumbAt(), rows(height-size, height); !slices.Equal(got, want) {
+		t.Errorf("with rowOff %d thumb drawn at %v, want %v", cfg.rowOff, got, want)
+	}
+
+	// the text gives up its last column to the scrollbar
+	if got, want := len(drawnRows(cfg)[0]), int(cfg.winSize.Col); got != want {
+		t.Errorf("row drawn %d wide, want %d", got, want)
+	}
+	cfg.cursorX = 100
+	editorScroll(cfg)
+	if want := 100 - int(cfg.winSize.Col) + 2; cfg.colOff != want {
+		t.Errorf("colOff = %d, want %d", cfg.colOff, want)
+	}
+}
+
+func TestTextRows(t *testing.T) {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("row %d", i)
+	}
+
+	tests := []struct {
+		rows  uint16
+		split bool
+		want  int
+	}{
+		{24, false, 22},
+		{24, true, 22},
+		{3, false, 1},
+		{3, true, 1},
+		{2, false, 0},
+		{1, false, 0},
+		{0, true, 0},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestEditor(t, "\x1b[6~", lines...)
+		cfg.winSize.Row = tt.rows
+		if tt.split {
+			editorSplit(cfg, "")
+		}
+		if got := editorTextRows(cfg); got != tt.want {
+			t.Errorf("%d rows, split %v: editorTextRows = %d, want %d", tt.rows, tt.split, got, tt.want)
+			continue
+		}
+
+		// the text is drawn on just those rows, with the status bar after
+		var buf bytes.Buffer
+		editorScroll(cfg)
+		editorDrawRows(cfg, &buf)
+		if got := len(screenRows(buf.String())) - 1; got != tt.want {
+			t.Errorf("%d rows, split %v: drew %d rows of text, want %d", tt.rows, tt.split, got, tt.want)
+		}
+
+		// and a page is that many rows
+		pressKeys(t, cfg)
+		if want := max(2*tt.want-1, 0); cfg.cursorY != want {
+			t.Errorf("%d rows, split %v: page down went to row %d, want %d", tt.rows, tt.split, cfg.cursorY, want)
+		}
+	}
+}
+
+func TestIndentGuides(t *testing.T) {
+	cfg := newTestEditor(t, "", "func f() {", "\tif x {", "\t\ty()"+strings.Repeat("x", 30), "        }")
+
+	// guidesAt is the screen columns of the guides on each row
+	guidesAt := func() [][]int {
+		var at [][]int
+		for _, row := range drawnRows(cfg)[:cfg.numRows] {
+			var cols []int
+			for col, r := range []rune(row) {
+				if r == '│' {
+					cols = append(cols, col)
+				}
+			}
+			at = append(at, cols)
+		}
+		return at
+	}
+	equal := func(a, b [][]int) bool {
+		return slices.EqualFunc(a, b, func(x, y []int) bool { return slices.Equal(x, y) })
+	}
+
+	if got := guidesAt(); !equal(got, [][]int{nil, nil, nil, nil}) {
+		t.Errorf("guides drawn at %v while off", got)
+	}
+
+	// one at each tab stop of the indentation, tabs and spaces alike
+	cfg.indentGuides = true
+	if got, want := guidesAt(), [][]int{nil, {0}, {0, 8}, {0}}; !equal(got, want) {
+		t.Errorf("guides drawn at %v, want %v", got, want)
+	}
+
+	// scrolled right they stay on the text's tab stops
+	cfg.winSize.Col = 20
+	cfg.cursorY, cfg.cursorX = 2, 8
+	if got, want := guidesAt(), [][]int{nil, nil, {5}, nil}; cfg.colOff != 3 || !equal(got, want) {
+		t.Errorf("with colOff %d guides drawn at %v, want %v", cfg.colOff, got, want)
+	}
+}
+
+func TestShowEOL(t *testing.T) {
+	cfg := newTestEditor(t, "", "ab", "", "\tx", "last")
+	if got := drawnRows(cfg)[:cfg.numRows]; strings.Contains(strings.Join(got, ""), EOLMarker) {
+		t.Errorf("rows %q have newline marks while off", got)
+	}
+
+	// after the text, past the tab, and the last line's says whether the
+	// file ends in a newline
+	cfg.showEOL = true
+	want := []string{"ab¶", "¶", "        x¶", "last¶"}
+	if got := drawnRows(cfg)[:cfg.numRows]; !slices.Equal(got, want) {
+		t.Errorf("rows %q, want %q", got, want)
+	}
+	cfg.noFinalNewline = true
+	want[3] = "last[no newline]"
+	if got := drawnRows(cfg)[:cfg.numRows]; !slices.Equal(got, want) {
+		t.Errorf("rows %q, want %q", got, want)
+	}
+}
+
+// BenchmarkEditNearTop types at the top of a big Go file full of block
+// comments and redraws, as the editor does for each key. Highlighting only
+// as far as the screen ("screen") is compared with the whole file ("file"),
+// which is what carrying the comments down eagerly would cost
+func BenchmarkEditNearTop(b *testing.B) {
+	lines := make([]string, 10_000)
+	for i := range lines {
+		switch i % 10 {
+		case 0:
+			lines[i] = "/* a block comment"
+		case 2:
+			lines[i] = "   ends here */"
+		default:
+			lines[i] = fmt.Sprintf("\tx := f(%d, \"s\") // note", i)
+		}
+	}
+
+	for _, whole := range []bool{false, true} {
+		name := map[bool]string{false: "screen", true: "file"}[whole]
+		b.Run(name, func(b *testing.B) {
+			cfg := newTestEditor(b, "", lines...)
+			editorSetFileName(cfg, "main.go")
+			editorSelectSyntaxHighlight(cfg)
+			editorSyncHighlight(cfg, cfg.numRows)
+			cfg.cursorY, cfg.cursorX = 1, 0
+
+			var buf bytes.Buffer
+			b.ResetTimer()
+			for i := range b.N {
+				// opening and closing a comment flips every row below
+				if i%2 == 0 {
+					editorInsertChar(cfg, '/')
+					editorInsertChar(cfg, '*')
+				} else {
+					editorBackspace(cfg)
+					editorBackspace(cfg)
+				}
+				if whole {
+					editorSyncHighlight(cfg, cfg.numRows)
+				}
+				buf.Reset()
+				editorDrawRows(cfg, &buf)
+			}
+		})
+	}
+}
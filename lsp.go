@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A minimal Language Server Protocol client. It only knows enough of the
+// protocol to keep the server in sync with the buffer (full document sync)
+// and to collect the diagnostics it publishes. It is enabled per filetype
+// in .kilorc:
+//
+//	[go]
+//	lsp = gopls
+
+const (
+	LSP_SEVERITY_ERROR   = 1
+	LSP_SEVERITY_WARNING = 2
+)
+
+type lspClient struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	uri        string
+	languageID string
+
+	// The buffer's edit count when it was last sent. Only the editor
+	// touches it
+	edits int
+
+	// Messages waiting for writeLoop, the only writer to stdin. Queueing
+	// never blocks, so neither the editor nor readLoop can get stuck behind
+	// a server that has stopped reading. queueMu guards queue and closing,
+	// and wake holds a value whenever there may be something to do
+	queueMu sync.Mutex
+	queue   [][]byte
+	closing bool
+	wake    chan struct{}
+
+	// mu guards everything below, which is shared with the goroutine
+	// reading the server's output
+	mu sync.Mutex
+
+	nextID  int
+	version int
+
+	// The most recent buffer contents. didOpen is only sent once the
+	// server has answered initialize, so until then this is just kept
+	ready    bool
+	lastText string
+
+	diagnostics []lspDiagnostic
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+type lspOutgoing struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      *int   `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type lspReply struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type lspIncoming struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// editorStartLSP launches the language server configured for the buffer's
+// filetype, if there is one. A server that can't be started only costs a
+// status message
+func editorStartLSP(cfg *EditorConfig) {
+	if cfg.syntax == nil || cfg.fileName == "" {
+		return
+	}
+
+	args := strings.Fields(cfg.rc.get(cfg.syntax.fileType, "lsp"))
+	if len(args) == 0 {
+		return
+	}
+
+	client, err := startLSP(args, cfg.filePath, cfg.syntax.fileType, editorRowsToString(cfg))
+	if err != nil {
+		editorSetStatusMessage(cfg, "Language server unavailable: %s", err.Error())
+		return
+	}
+
+	client.edits = cfg.edits
+	cfg.lsp = client
+}
+
+// editorSyncLSP sends the buffer to the language server if it was edited
+// since the last sync
+func editorSyncLSP(cfg *EditorConfig) {
+	if cfg.lsp == nil || cfg.lsp.edits == cfg.edits {
+		return
+	}
+
+	cfg.lsp.edits = cfg.edits
+	cfg.lsp.sync(editorRowsToString(cfg))
+}
+
+func startLSP(args []string, fileName, languageID, text string) (*lspClient, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", fileName, err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = filepath.Dir(path)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	client := &lspClient{
+		cmd:        cmd,
+		stdin:      stdin,
+		uri:        fileURI(path),
+		languageID: languageID,
+		lastText:   text,
+		wake:       make(chan struct{}, 1),
+	}
+
+	go client.readLoop(stdout)
+	go client.writeLoop()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	err = client.request("initialize", map[string]any{
+		"processId": nil,
+		"rootUri":   fileURI(filepath.Dir(path)),
+		"capabilities": map[string]any{
+			"textDocument": map[string]any{
+				"publishDiagnostics": map[string]any{},
+			},
+		},
+	})
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// fileURI turns an absolute path into a file URI, escaping what needs it
+func fileURI(path string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
+
+func (c *lspClient) sync(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if text == c.lastText {
+		return
+	}
+
+	c.lastText = text
+	if !c.ready {
+		return
+	}
+
+	c.version++
+	c.notify("textDocument/didChange", map[string]any{
+		"textDocument": map[string]any{
+			"uri":     c.uri,
+			"version": c.version,
+		},
+		"contentChanges": []map[string]any{
+			{"text": text},
+		},
+	})
+}
+
+// stop asks the server to shut down, and kills it if it doesn't
+func (c *lspClient) stop() {
+	c.mu.Lock()
+	c.request("shutdown", nil)
+	c.notify("exit", nil)
+	c.mu.Unlock()
+
+	// writeLoop closes stdin once the queue is empty
+	c.queueMu.Lock()
+	c.closing = true
+	c.queueMu.Unlock()
+	c.wakeWriter()
+
+	timer := time.AfterFunc(time.Second, func() {
+		c.cmd.Process.Kill()
+	})
+	c.cmd.Wait()
+	timer.Stop()
+}
+
+// rowDiagnostic returns the part of a row covered by diagnostics, in chars
+// coordinates. A diagnostic spanning several rows covers every row in between
+func (c *lspClient) rowDiagnostic(row int, chars string) (start, end int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := len(chars)
+	start, end = size, 0
+	for _, d := range c.diagnostics {
+		if row < d.Range.Start.Line || row > d.Range.End.Line {
+			continue
+		}
+
+		from, to := 0, size
+		if row == d.Range.Start.Line {
+			from = utf16ToByte(chars, d.Range.Start.Character)
+		}
+
+		if row == d.Range.End.Line {
+			to = utf16ToByte(chars, d.Range.End.Character)
+		}
+
+		// an empty range still deserves a mark
+		if to <= from {
+			to = from + 1
+		}
+
+		start = min(start, from)
+		end = max(end, to)
+		ok = true
+	}
+
+	if !ok {
+		return 0, 0, false
+	}
+
+	start = min(start, size)
+	end = min(end, size)
+	if start == end {
+		start = 0
+	}
+
+	return start, end, true
+}
+
+// utf16ToByte turns a character offset into a line, which LSP counts in
+// UTF-16 code units, into a byte offset. Offsets past the end of the line
+// run on a byte at a time, so an empty range there still gets its mark
+func utf16ToByte(line string, units int) int {
+	i := 0
+	for units > 0 && i < len(line) {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		units -= utf16.RuneLen(r)
+		i += size
+	}
+
+	return i + max(units, 0)
+}
+
+// summary counts the current diagnostics by severity
+func (c *lspClient) summary() (errs, warnings int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.diagnostics {
+		switch d.Severity {
+		case LSP_SEVERITY_ERROR:
+			errs++
+		case LSP_SEVERITY_WARNING:
+			warnings++
+		}
+	}
+
+	return errs, warnings
+}
+
+// message returns the first diagnostic reported for a row
+func (c *lspClient) message(row int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.diagnostics {
+		if row >= d.Range.Start.Line && row <= d.Range.End.Line {
+			return d.Message
+		}
+	}
+
+	return ""
+}
+
+func (c *lspClient) readLoop(r io.Reader) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+
+	for {
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader.R, body); err != nil {
+			return
+		}
+
+		var msg lspIncoming
+		if err := json.Unmarshal(body, &msg); err != nil {
+			continue
+		}
+
+		c.handle(msg)
+	}
+}
+
+func (c *lspClient) handle(msg lspIncoming) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case msg.Method == "textDocument/publishDiagnostics":
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil && params.URI == c.uri {
+			c.diagnostics = params.Diagnostics
+		}
+
+	case msg.Method != "" && msg.ID != nil:
+		// a request from the server. We don't support any of them, but
+		// some servers wait for an answer, so give each a null result.
+		// workspace/configuration expects one entry per item asked for
+		var result any
+		if msg.Method == "workspace/configuration" {
+			var params struct {
+				Items []any `json:"items"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			result = make([]any, len(params.Items))
+		}
+		c.write(lspReply{JSONRPC: "2.0", ID: msg.ID, Result: result})
+
+	case msg.Method == "" && string(msg.ID) == "1" && !c.ready:
+		// the answer to initialize, which always goes out first
+		c.ready = true
+		c.notify("initialized", map[string]any{})
+		c.notify("textDocument/didOpen", map[string]any{
+			"textDocument": map[string]any{
+				"uri":        c.uri,
+				"languageId": c.languageID,
+				"version":    c.version,
+				"text":       c.lastText,
+			},
+		})
+	}
+}
+
+// request and notify must be called with mu held, which keeps the ids and
+// the order of the messages straight
+
+func (c *lspClient) request(method string, params any) error {
+	c.nextID++
+	id := c.nextID
+	return c.write(lspOutgoing{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+}
+
+func (c *lspClient) notify(method string, params any) error {
+	return c.write(lspOutgoing{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (c *lspClient) write(msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encoding lsp message: %w", err)
+	}
+
+	c.queueMu.Lock()
+	if !c.closing {
+		c.queue = append(c.queue, fmt.Appendf(nil, "Content-Length: %d\r\n\r\n%s", len(body), body))
+	}
+	c.queueMu.Unlock()
+	c.wakeWriter()
+
+	return nil
+}
+
+func (c *lspClient) wakeWriter() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop sends the queued messages to the server until stop has been
+// called and the queue is empty, or the server stops taking them
+func (c *lspClient) writeLoop() {
+	defer c.stdin.Close()
+
+	for range c.wake {
+		c.queueMu.Lock()
+		queue, closing := c.queue, c.closing
+		c.queue = nil
+		c.queueMu.Unlock()
+
+		for _, msg := range queue {
+			if _, err := c.stdin.Write(msg); err != nil {
+				// the server is gone, so drop whatever comes next
+				c.queueMu.Lock()
+				c.closing = true
+				c.queueMu.Unlock()
+				return
+			}
+		}
+
+		if closing {
+			return
+		}
+	}
+}
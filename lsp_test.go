@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRowDiagnosticUTF16(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		from, to   int
+		start, end int
+	}{
+		{"ascii", "x := y", 5, 6, 5, 6},
+		// é is one UTF-16 unit but two bytes
+		{"two byte", `s := "é" + y`, 11, 12, 12, 13},
+		// 😀 is two UTF-16 units and four bytes
+		{"surrogate pair", `s := "😀" + y`, 12, 13, 14, 15},
+		// a mark past the end of the line falls back to the whole line
+		{"past the end", "ab", 5, 5, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &lspClient{diagnostics: []lspDiagnostic{{
+				Range: lspRange{
+					Start: lspPosition{Line: 0, Character: tt.from},
+					End:   lspPosition{Line: 0, Character: tt.to},
+				},
+			}}}
+
+			start, end, ok := c.rowDiagnostic(0, tt.line)
+			if !ok {
+				t.Fatal("no diagnostic on the row")
+			}
+			if start != tt.start || end != tt.end {
+				t.Errorf("rowDiagnostic = %d, %d, want %d, %d", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestLSPRepliesDoNotBlock(t *testing.T) {
+	// a server that never reads what it is sent
+	r, w := io.Pipe()
+	c := &lspClient{stdin: w, wake: make(chan struct{}, 1)}
+	go c.writeLoop()
+
+	done := make(chan struct{})
+	go func() {
+		for i := range 100 {
+			c.handle(lspIncoming{
+				ID:     json.RawMessage(strconv.Itoa(i)),
+				Method: "workspace/configuration",
+				Params: json.RawMessage(`{"items": [{}]}`),
+			})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handle blocked on a server that isn't reading")
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Length") == "" {
+		t.Errorf("reply header = %v, want a Content-Length", header)
+	}
+	r.Close()
+}
+
+func TestSyncLSPOnlyAfterEdits(t *testing.T) {
+	cfg := newTestEditor(t, "", "package main")
+	cfg.lsp = &lspClient{ready: true, wake: make(chan struct{}, 1)}
+	cfg.lsp.edits = cfg.edits
+
+	editorSyncLSP(cfg)
+	if len(cfg.lsp.queue) != 0 {
+		t.Fatalf("synced %d messages without an edit", len(cfg.lsp.queue))
+	}
+
+	editorInsertChar(cfg, 'x')
+	editorSyncLSP(cfg)
+	editorSyncLSP(cfg)
+	if len(cfg.lsp.queue) != 1 {
+		t.Fatalf("synced %d messages after one edit, want 1", len(cfg.lsp.queue))
+	}
+	if !strings.Contains(string(cfg.lsp.queue[0]), `"text":"xpackage main\n"`) {
+		t.Errorf("didChange = %s, want the new text", cfg.lsp.queue[0])
+	}
+}
+
+func TestFileURI(t *testing.T) {
+	if got, want := fileURI("/tmp/my project/main.go"), "file:///tmp/my%20project/main.go"; got != want {
+		t.Errorf("fileURI = %q, want %q", got, want)
+	}
+}